@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/hekmon/httplog/v3"
+)
+
+// adminMux returns the handlers of the admin listener: operational endpoints
+// that must never be exposed to LLM clients on the public listener.
+func adminMux(cfg Config, httplogger *httplog.Logger, logLevelCtrl *logLevelController) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", metricsHandler)
+	mux.HandleFunc("GET /admin/stats", statsHandler(cfg, httplogger))
+	mux.HandleFunc("GET /admin/loglevel", logLevelCtrl.handler)
+	mux.HandleFunc("PUT /admin/loglevel", logLevelCtrl.handler)
+	// Go runtime profiling
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// adminAuth protects next with a bearer token. An empty token disables authentication.
+func adminAuth(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			logger.Warn("unauthorized admin request",
+				"client", r.RemoteAddr,
+				"URI", r.URL.RequestURI(),
+			)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="qwen35-rp admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
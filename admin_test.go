@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for _, tc := range []struct {
+		name          string
+		token         string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "no token configured", wantStatus: http.StatusNoContent},
+		{name: "no token configured with header", authorization: "Bearer anything", wantStatus: http.StatusNoContent},
+		{name: "missing token", token: "admin-secret", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", token: "admin-secret", authorization: "Bearer admin-wrong", wantStatus: http.StatusUnauthorized},
+		{name: "token prefix", token: "admin-secret", authorization: "Bearer admin", wantStatus: http.StatusUnauthorized},
+		{name: "not bearer", token: "admin-secret", authorization: "Basic admin-secret", wantStatus: http.StatusUnauthorized},
+		{name: "correct token", token: "admin-secret", authorization: "Bearer admin-secret", wantStatus: http.StatusNoContent},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			adminAuth(tc.token, next).ServeHTTP(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("got HTTP %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if challenge := rec.Header().Get("WWW-Authenticate"); (rec.Code == http.StatusUnauthorized) != (challenge != "") {
+				t.Errorf("got WWW-Authenticate %q with HTTP %d", challenge, rec.Code)
+			}
+		})
+	}
+}
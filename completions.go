@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,9 +11,25 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
+)
 
-	"github.com/hekmon/httplog/v3"
+// Profile names, used in logs and metrics
+const (
+	profileThinkingGeneral   = "thinking_general"
+	profileThinkingCoding    = "thinking_coding"
+	profileInstructGeneral   = "instruct_general"
+	profileInstructReasoning = "instruct_reasoning"
+)
+
+var profiles = []string{profileThinkingGeneral, profileThinkingCoding, profileInstructGeneral, profileInstructReasoning}
+
+// Qwen chat template markup, used to disable thinking within raw completion prompts
+const (
+	assistantGenerationMarker = "<|im_start|>assistant\n"
+	emptyThinkBlock           = "<think>\n\n</think>\n\n"
 )
 
 var (
@@ -56,12 +73,16 @@ var (
 
 // legacyCompletions handles /v1/completions (text completions API).
 // Unlike chat completions, this endpoint uses raw prompts with no chat template.
-// We only validate the virtual model name, swap it to the served model, and fix
-// the model name in the response. No sampling params or chat_template_kwargs.
-func legacyCompletions(httpCli *http.Client, target *url.URL,
-	servedModel, thinkingGeneral, thinkingCoding, instructGeneral, instructReasoning string) http.HandlerFunc {
+// We validate the virtual model name, swap it to the served model, and fix the model
+// name in the response. No chat_template_kwargs: the profile sampling params and the
+// disabled thinking of the instruct profiles are only applied when opted in.
+func legacyCompletions(httpCli *http.Client, target *url.URL, cfg Config) http.HandlerFunc {
+	servedModel, thinkingGeneral, thinkingCoding, instructGeneral, instructReasoning := cfg.ServedModelName,
+		cfg.ThinkingGeneralModel, cfg.ThinkingCodingModel, cfg.InstructGeneralModel, cfg.InstructReasoningModel
+	enforceSamplingParams, samplingParams, disableThinking := cfg.EnforceSamplingParams,
+		cfg.CompletionsSamplingParams, cfg.CompletionsDisableThinking
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger := logger.With(httplog.GetReqIDSLogAttr(r.Context()))
+		logger := requestLogger(r.Context())
 		ctx := r.Context()
 		// Read request body
 		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
@@ -85,14 +106,33 @@ func legacyCompletions(httpCli *http.Client, target *url.URL,
 			return
 		}
 		// Validate virtual model name
+		var think bool
+		var profile string
+		var profileParams map[string]any
 		switch modelName {
-		case thinkingGeneral, thinkingCoding, instructGeneral, instructReasoning:
-			logger.Info("legacy completions model matched", slog.String("virtual_model", modelName))
+		case thinkingGeneral:
+			think, profile, profileParams = true, profileThinkingGeneral, thinkingGeneralParams
+		case thinkingCoding:
+			think, profile, profileParams = true, profileThinkingCoding, thinkingCodingParams
+		case instructGeneral:
+			think, profile, profileParams = false, profileInstructGeneral, instructGeneralParams
+		case instructReasoning:
+			think, profile, profileParams = false, profileInstructReasoning, instructReasoningParams
 		default:
 			logger.Error("unsupported model", slog.String("model", modelName))
 			httpError(ctx, w, http.StatusBadRequest)
 			return
 		}
+		logger.Info("legacy completions model matched",
+			slog.String("type", profile),
+			slog.String("virtual_model", modelName),
+		)
+		if samplingParams {
+			applySamplingParams(data, profileParams, logger, enforceSamplingParams)
+		}
+		if disableThinking && !think {
+			disablePromptThinking(data, logger)
+		}
 		// Track streaming mode for response fixing
 		var stream bool
 		if streamVal, ok := data["stream"]; ok {
@@ -109,16 +149,29 @@ func legacyCompletions(httpCli *http.Client, target *url.URL,
 		}
 		logger.Debug("rewritten request body", slog.String("body", string(requestBody)))
 		modifiedRequests.Add(1)
-		// Prepare and send outgoing request
-		outreq := r.Clone(ctx)
+		// Prepare and send outgoing request, it is cancelled as soon as the client goes away
+		upstreamCtx, cancelUpstream := context.WithCancelCause(ctx)
+		defer cancelUpstream(nil)
+		outreq := r.Clone(upstreamCtx)
 		rewriteRequestURL(outreq, target)
 		stripHopByHopHeaders(outreq)
 		outreq.Body = io.NopCloser(bytes.NewReader(requestBody))
 		outreq.ContentLength = int64(len(requestBody))
 		outreq.RequestURI = ""
+		// Keep streaming requests alive while vLLM prefills the prompt
+		if stream && cfg.SSEKeepAlive > 0 {
+			keepAliveWriter := newSSEKeepAliveWriter(ctx, w, cfg.SSEKeepAlive, logger)
+			defer keepAliveWriter.stop()
+			w = keepAliveWriter
+		}
 		outResp, err := httpCli.Do(outreq)
 		if err != nil {
+			if ctx.Err() != nil {
+				recordClientAbort(profile, -1, logger)
+				return
+			}
 			logger.Error("failed to send upstream request", slog.Any("error", err))
+			recordBackendError(r.URL.Path, err.Error())
 			switch {
 			case errors.Is(err, syscall.ECONNREFUSED):
 				httpError(ctx, w, http.StatusBadGateway)
@@ -132,20 +185,39 @@ func legacyCompletions(httpCli *http.Client, target *url.URL,
 			logger.Debug("streaming response to client with model name fix")
 			copyHeaders(w, outResp)
 			w.WriteHeader(outResp.StatusCode)
-			if err = streamResponse(w, outResp.Body, virtualModel, logger); err != nil {
+			fixer := newStreamFixer(virtualModel, false, false, reasoningOutput{}, nil, nil, logger)
+			err = streamResponse(w, outResp.Body, fixer, cfg.SSEKeepAlive)
+			switch {
+			case err == nil:
+			case errors.Is(err, errClientAborted) || ctx.Err() != nil:
+				// Let vLLM free the sequence right away
+				cancelUpstream(errClientAborted)
+				recordClientAbort(profile, fixer.generatedTokens(), logger)
+			default:
 				logger.Error("failed to stream response", slog.String("error", err.Error()))
+				recordBackendError(r.URL.Path, err.Error())
+				httpStreamError(ctx, w, http.StatusBadGateway)
 			}
 		} else if stream {
 			logger.Warn("backend returned error for streaming request, passing through raw response",
 				slog.Int("status", outResp.StatusCode),
 			)
+			// Written at once: an error event replaces it if the SSE keepalive already sent the header
+			errorBody, err := io.ReadAll(outResp.Body)
+			if err != nil {
+				logger.Error("failed to read error response", slog.String("error", err.Error()))
+			}
 			copyHeaders(w, outResp)
 			w.WriteHeader(outResp.StatusCode)
-			if _, err = io.Copy(w, outResp.Body); err != nil {
+			if _, err = w.Write(errorBody); err != nil {
 				logger.Error("failed to write error response", slog.String("error", err.Error()))
 			}
 		} else {
 			responseBody, err := io.ReadAll(outResp.Body)
+			if err != nil && ctx.Err() != nil {
+				recordClientAbort(profile, -1, logger)
+				return
+			}
 			if err != nil {
 				logger.Error("failed to read response body", slog.String("error", err.Error()))
 				httpError(ctx, w, http.StatusInternalServerError)
@@ -159,7 +231,41 @@ func legacyCompletions(httpCli *http.Client, target *url.URL,
 			w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
 			w.WriteHeader(outResp.StatusCode)
 			if _, err = w.Write(responseBody); err != nil {
-				logger.Error("failed to write response", slog.String("error", err.Error()))
+				logger.Debug("failed to write response", slog.String("error", err.Error()))
+				recordClientAbort(profile, responseCompletionTokens(responseBody), logger)
+			}
+		}
+	}
+}
+
+// responseCompletionTokens returns the completion tokens reported by the usage of a non-streaming
+// response, -1 if unknown
+func responseCompletionTokens(responseBody []byte) int {
+	var response struct {
+		Usage map[string]any `json:"usage"`
+	}
+	if err := json.Unmarshal(responseBody, &response); err != nil || response.Usage == nil {
+		return -1
+	}
+	return usageInt(response.Usage, "completion_tokens")
+}
+
+// disablePromptThinking appends an empty think block to the prompts ending with the assistant
+// generation marker, as the chat template does when thinking is disabled. Token prompts are
+// left untouched.
+func disablePromptThinking(data map[string]any, logger *slog.Logger) {
+	switch prompt := data["prompt"].(type) {
+	case string:
+		if strings.HasSuffix(prompt, assistantGenerationMarker) {
+			data["prompt"] = prompt + emptyThinkBlock
+			logger.Debug("empty think block appended to the prompt")
+		}
+	case []any:
+		// Batch of prompts
+		for i, item := range prompt {
+			if text, ok := item.(string); ok && strings.HasSuffix(text, assistantGenerationMarker) {
+				prompt[i] = text + emptyThinkBlock
+				logger.Debug("empty think block appended to the prompt", slog.Int("prompt_index", i))
 			}
 		}
 	}
@@ -186,13 +292,18 @@ func fixModelNameInResponse(responseBody []byte, virtualModel string, logger *sl
 	return responseBody
 }
 
-func transform(httpCli *http.Client, target *url.URL,
-	servedModel, thinkingGeneral, thinkingCoding, instructGeneral, instructReasoning string, enforceSamplingParams bool) http.HandlerFunc {
+func transform(httpCli *http.Client, target *url.URL, cfg Config) http.HandlerFunc {
+	servedModel, thinkingGeneral, thinkingCoding, instructGeneral, instructReasoning := cfg.ServedModelName,
+		cfg.ThinkingGeneralModel, cfg.ThinkingCodingModel, cfg.InstructGeneralModel, cfg.InstructReasoningModel
+	enforceSamplingParams, countReasoningTokens := cfg.EnforceSamplingParams, cfg.CountReasoningTokens
+	reasoning, _ := newReasoningPolicy(cfg)                                // validated with the config
+	toolValidations, _ := parseToolValidationRules(cfg.ToolCallValidation) // validated with the config
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Prepare
-		logger := logger.With(httplog.GetReqIDSLogAttr(r.Context()))
+		logger := requestLogger(r.Context())
 		ctx := r.Context()
 		var think, stream bool // Track thinking mode and streaming for response fixing
+		var profile string     // Track the matched profile for metrics
 		// Read request body
 		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
 		requestBody, err := io.ReadAll(r.Body)
@@ -215,6 +326,8 @@ func transform(httpCli *http.Client, target *url.URL,
 			httpError(ctx, w, http.StatusBadRequest)
 			return
 		}
+		// Tools whose calls may have to be parsed from the content
+		tools := newToolSchemas(data)
 		// Track streaming mode for response fixing
 		if streamVal, ok := data["stream"]; ok {
 			stream, _ = streamVal.(bool)
@@ -223,37 +336,37 @@ func transform(httpCli *http.Client, target *url.URL,
 		switch modelName {
 		case thinkingGeneral:
 			think = true
-			logger.Info("model matched",
-				slog.String("type", "thinking_general"),
-				slog.String("virtual_model", modelName),
-			)
+			profile = profileThinkingGeneral
 			applySamplingParams(data, thinkingGeneralParams, logger, enforceSamplingParams)
 		case thinkingCoding:
 			think = true
-			logger.Info("model matched",
-				slog.String("type", "thinking_coding"),
-				slog.String("virtual_model", modelName),
-			)
+			profile = profileThinkingCoding
 			applySamplingParams(data, thinkingCodingParams, logger, enforceSamplingParams)
 		case instructGeneral:
 			think = false
-			logger.Info("model matched",
-				slog.String("type", "instruct_general"),
-				slog.String("virtual_model", modelName),
-			)
+			profile = profileInstructGeneral
 			applySamplingParams(data, instructGeneralParams, logger, enforceSamplingParams)
 		case instructReasoning:
 			think = false
-			logger.Info("model matched",
-				slog.String("type", "instruct_reasoning"),
-				slog.String("virtual_model", modelName),
-			)
+			profile = profileInstructReasoning
 			applySamplingParams(data, instructReasoningParams, logger, enforceSamplingParams)
 		default:
 			logger.Error("unsupported model", slog.String("model", modelName))
 			httpError(ctx, w, http.StatusBadRequest)
 			return
 		}
+		logger.Info("model matched",
+			slog.String("type", profile),
+			slog.String("virtual_model", modelName),
+		)
+		requestsMetric.Add(1, profile)
+		// Resolve how reasoning is returned, the control headers are not forwarded
+		output, err := reasoning.output(profile, think, r.Header)
+		if err != nil {
+			logger.Error("invalid reasoning output request", slog.Any("error", err))
+			httpError(ctx, w, http.StatusBadRequest)
+			return
+		}
 		// Track the virtual model name requested by client (before override)
 		virtualModel := modelName
 		// override model name for backend
@@ -272,6 +385,12 @@ func transform(httpCli *http.Client, target *url.URL,
 		} else {
 			data["chat_template_kwargs"] = map[string]any{"enable_thinking": think}
 		}
+		// Stream from the backend even for non-streaming clients: chunks are aggregated back
+		aggregate := !stream && cfg.UpstreamStreaming
+		if aggregate {
+			data["stream"] = true
+			data["stream_options"] = map[string]any{"include_usage": true}
+		}
 		// marshal request body
 		requestBody, err = json.Marshal(data)
 		if err != nil {
@@ -282,17 +401,38 @@ func transform(httpCli *http.Client, target *url.URL,
 		logger.Debug("rewritten request body", slog.String("body", string(requestBody)))
 		// Track modified request
 		modifiedRequests.Add(1)
-		// prepare outgoing request
-		outreq := r.Clone(ctx)
+		// prepare outgoing request, it can be aborted by the stall detection
+		upstreamCtx, cancelUpstream := context.WithCancelCause(ctx)
+		defer cancelUpstream(nil)
+		outreq := r.Clone(upstreamCtx)
 		rewriteRequestURL(outreq, target)
 		stripHopByHopHeaders(outreq)
 		outreq.Body = io.NopCloser(bytes.NewReader(requestBody))
 		outreq.ContentLength = int64(len(requestBody))
 		outreq.RequestURI = ""
+		// Keep long non-streaming responses alive, the response header is sent right away
+		if !stream && cfg.JSONKeepAlive > 0 {
+			keepAliveWriter := newJSONKeepAliveWriter(ctx, w, cfg.JSONKeepAlive, logger)
+			defer keepAliveWriter.stop()
+			w = keepAliveWriter
+		}
+		// Keep streaming requests alive while vLLM prefills the prompt
+		if stream && cfg.SSEKeepAlive > 0 {
+			keepAliveWriter := newSSEKeepAliveWriter(ctx, w, cfg.SSEKeepAlive, logger)
+			defer keepAliveWriter.stop()
+			w = keepAliveWriter
+		}
 		// send request
+		requestStart := time.Now()
 		outResp, err := httpCli.Do(outreq)
 		if err != nil {
+			if ctx.Err() != nil {
+				recordClientAbort(profile, -1, logger)
+				return
+			}
 			logger.Error("failed to send upstream request", slog.Any("error", err))
+			recordBackendError(r.URL.Path, err.Error())
+			requestErrorsMetric.Add(1, profile)
 			switch {
 			case errors.Is(err, syscall.ECONNREFUSED):
 				httpError(ctx, w, http.StatusBadGateway)
@@ -301,6 +441,9 @@ func transform(httpCli *http.Client, target *url.URL,
 			}
 			return
 		}
+		if cfg.StallTimeout > 0 && (stream || aggregate) && outResp.StatusCode >= 200 && outResp.StatusCode < 300 {
+			outResp.Body = newStallWatcher(outResp.Body, cfg.StallTimeout, cancelUpstream)
+		}
 		defer outResp.Body.Close()
 
 		if stream && outResp.StatusCode >= 200 && outResp.StatusCode < 300 {
@@ -308,42 +451,147 @@ func transform(httpCli *http.Client, target *url.URL,
 			logger.Debug("streaming response to client with model name fix")
 			copyHeaders(w, outResp)
 			w.WriteHeader(outResp.StatusCode)
-			if err = streamResponse(w, outResp.Body, virtualModel, logger); err != nil {
+			var toolValidation *toolValidation
+			if validation, found := toolValidations[profile]; found {
+				toolValidation = &validation
+			}
+			fixer := newStreamFixer(virtualModel, think, countReasoningTokens, output, tools, toolValidation, logger)
+			err = streamResponse(w, outResp.Body, fixer, cfg.SSEKeepAlive)
+			switch {
+			case err == nil:
+			case errors.Is(err, errClientAborted) || ctx.Err() != nil:
+				// Let vLLM free the sequence right away
+				cancelUpstream(errClientAborted)
+				recordClientAbort(profile, fixer.generatedTokens(), logger)
+			default:
+				statusCode := http.StatusBadGateway
+				if errors.Is(context.Cause(upstreamCtx), errUpstreamStalled) {
+					err = errUpstreamStalled
+					statusCode = http.StatusGatewayTimeout
+				}
 				logger.Error("failed to stream response", slog.String("error", err.Error()))
+				recordBackendError(r.URL.Path, err.Error())
+				requestErrorsMetric.Add(1, profile)
+				httpStreamError(ctx, w, statusCode)
 			}
+			if !fixer.firstChunkAt.IsZero() {
+				timeToFirstTokenMetric.Observe(fixer.firstChunkAt.Sub(requestStart).Seconds(), profile)
+			}
+			fixer.stats.record(profile, countReasoningTokens, logger)
+			fixer.toolOutcomes.record(profile)
 		} else if stream {
 			// Backend returned an error for a streaming request: pass through the raw error body
 			logger.Warn("backend returned error for streaming request, passing through raw response",
 				slog.Int("status", outResp.StatusCode),
 			)
+			recordBackendError(r.URL.Path, fmt.Sprintf("backend returned HTTP %d", outResp.StatusCode))
+			requestErrorsMetric.Add(1, profile)
+			// Written at once: an error event replaces it if the SSE keepalive already sent the header
+			errorBody, err := io.ReadAll(outResp.Body)
+			if err != nil {
+				logger.Error("failed to read error response", slog.String("error", err.Error()))
+			}
 			copyHeaders(w, outResp)
 			w.WriteHeader(outResp.StatusCode)
-			if _, err = io.Copy(w, outResp.Body); err != nil {
+			if _, err = w.Write(errorBody); err != nil {
 				logger.Error("failed to write error response", slog.String("error", err.Error()))
 			}
 		} else {
-			// Non-streaming mode: read full response, fix bugs, then write
-			responseBody, err := io.ReadAll(outResp.Body)
+			// Non-streaming mode: read full response (aggregating the chunks when streamed), fix bugs, then write
+			statusCode := outResp.StatusCode
+			var responseBody []byte
+			generatedTokens := -1 // unknown until the response is read
+			if aggregate && statusCode >= 200 && statusCode < 300 {
+				aggregator := newChatCompletionAggregator()
+				responseBody, err = aggregator.aggregate(outResp.Body)
+				if !aggregator.firstChunkAt.IsZero() {
+					timeToFirstTokenMetric.Observe(aggregator.firstChunkAt.Sub(requestStart).Seconds(), profile)
+				}
+				generatedTokens = aggregator.generatedTokens()
+				// Errors sent by the backend within the stream are passed through as non-streaming errors
+				var upstreamErr *upstreamError
+				if errors.As(err, &upstreamErr) {
+					responseBody, statusCode, err = upstreamErr.body, upstreamErr.statusCode, nil
+				}
+			} else {
+				responseBody, err = io.ReadAll(outResp.Body)
+			}
+			if err != nil && ctx.Err() != nil {
+				recordClientAbort(profile, generatedTokens, logger)
+				return
+			}
 			if err != nil {
+				stalled := errors.Is(context.Cause(upstreamCtx), errUpstreamStalled)
+				if stalled {
+					err = errUpstreamStalled
+				}
 				logger.Error("failed to read response body", slog.String("error", err.Error()))
-				httpError(ctx, w, http.StatusInternalServerError)
+				recordBackendError(r.URL.Path, err.Error())
+				requestErrorsMetric.Add(1, profile)
+				if stalled {
+					httpError(ctx, w, http.StatusGatewayTimeout)
+				} else {
+					httpError(ctx, w, http.StatusInternalServerError)
+				}
 				return
 			}
 
 			// Only attempt JSON fixes on success responses; pass through errors as-is
-			if outResp.StatusCode >= 200 && outResp.StatusCode < 300 {
-				responseBody = fixNonStreamingResponse(responseBody, think, virtualModel, logger)
+			if statusCode >= 200 && statusCode < 300 {
+				var tokenCounter func(text string) (int, error)
+				if countReasoningTokens {
+					tokenCounter = func(text string) (int, error) {
+						return countTokens(ctx, httpCli, target, servedModel, r.Header.Get("Authorization"), text)
+					}
+				}
+				var stats completionStats
+				responseBody, stats = fixNonStreamingResponse(responseBody, think, virtualModel, output, tools, tokenCounter, logger)
+				stats.record(profile, countReasoningTokens, logger)
+				generatedTokens = stats.completionTokens
+				// Re-issue the request (or a variation of it) for the validations
+				complete := func(body []byte) ([]byte, error) {
+					retried, err := resend(httpCli, outreq, body, aggregate, cfg.StallTimeout, cancelUpstream)
+					if err != nil {
+						return nil, err
+					}
+					retried, stats := fixNonStreamingResponse(retried, think, virtualModel, output, tools, tokenCounter, logger)
+					stats.record(profile, countReasoningTokens, logger)
+					return retried, nil
+				}
+				// Validate tool calls against the request schemas
+				if validation, found := toolValidations[profile]; found && tools != nil {
+					var outcomes toolCallOutcomes
+					responseBody, outcomes = checkToolCallsWithRetries(responseBody, requestBody, tools, validation, logger, complete)
+					outcomes.record(profile)
+				}
+				// Validate structured output against the requested format
+				if format := newResponseFormat(data); cfg.StructuredOutput && format != nil {
+					var outcome string
+					if responseBody, outcome, err = format.enforceStructuredOutput(responseBody, data,
+						cfg.StructuredOutputRetry, logger, complete); err != nil {
+						statusCode = http.StatusUnprocessableEntity
+						responseBody = structuredOutputError(ctx, err)
+						requestErrorsMetric.Add(1, profile)
+					}
+					structuredOutputValidationsMetric.Add(1, profile, outcome)
+				}
 			} else {
 				logger.Warn("backend returned error for non-streaming request, passing through raw response",
-					slog.Int("status", outResp.StatusCode),
+					slog.Int("status", statusCode),
 				)
+				recordBackendError(r.URL.Path, fmt.Sprintf("backend returned HTTP %d", statusCode))
+				requestErrorsMetric.Add(1, profile)
 			}
 
 			copyHeaders(w, outResp)
+			if aggregate {
+				w.Header().Set("Content-Type", "application/json")
+			}
 			w.Header().Set("Content-Length", strconv.Itoa(len(responseBody)))
-			w.WriteHeader(outResp.StatusCode)
+			w.WriteHeader(statusCode)
 			if _, err = w.Write(responseBody); err != nil {
-				logger.Error("failed to write response", slog.String("error", err.Error()))
+				logger.Debug("failed to write response", slog.String("error", err.Error()))
+				recordClientAbort(profile, generatedTokens, logger)
 			}
 		}
 	}
@@ -352,10 +600,16 @@ func transform(httpCli *http.Client, target *url.URL,
 // fixNonStreamingResponse fixes the non-streaming response in a single JSON pass:
 //   - Replaces the backend model name with the virtual model name
 //   - When think=false, moves misplaced reasoning_content/reasoning to content (vLLM bug)
-func fixNonStreamingResponse(responseBody []byte, think bool, virtualModel string, logger *slog.Logger) []byte {
+//   - When think=true, moves think blocks leaked in content to reasoning_content
+//   - When tools is not nil, converts Qwen3 tool calls left in content to tool_calls
+//   - When tokenCounter is not nil, fills usage.completion_tokens_details.reasoning_tokens
+//   - When output.strip is set, removes the reasoning once accounted, otherwise
+//     inlines it in think tags (output.thinkTags) or applies output.field
+func fixNonStreamingResponse(responseBody []byte, think bool, virtualModel string, output reasoningOutput, tools toolSchemas,
+	tokenCounter func(text string) (int, error), logger *slog.Logger) (fixedBody []byte, stats completionStats) {
 	var data map[string]any
 	if err := json.Unmarshal(responseBody, &data); err != nil {
-		return responseBody
+		return responseBody, stats
 	}
 
 	modified := false
@@ -375,18 +629,124 @@ func fixNonStreamingResponse(responseBody []byte, think bool, virtualModel strin
 		if fixReasoningContentBug(data, logger) {
 			modified = true
 		}
+	} else if recoverThinkLeaks(data, logger) {
+		// Fix missing reasoning parser: thinking responses with think blocks leaked in content
+		modified = true
+	}
+
+	// Fix missing tool call parser: Qwen3 tool calls left in content
+	if tools != nil && tools.recoverToolCalls(data, logger) {
+		modified = true
+	}
+
+	// Account reasoning tokens, vLLM does not report them for Qwen
+	usage, _ := data["usage"].(map[string]any)
+	stats.completionTokens = usageInt(usage, "completion_tokens")
+	if tokenCounter != nil && usage != nil {
+		if reasoningTokens, reported := usageReasoningTokens(usage); reported {
+			stats.reasoningTokens = reasoningTokens
+		} else {
+			var counted bool
+			if stats.reasoningTokens, counted = countReasoningTokens(data, tokenCounter, logger); counted {
+				setUsageReasoningTokens(usage, stats.reasoningTokens)
+				modified = true
+			} else {
+				// A partial count would be reported as exact
+				stats.reasoningUnknown = true
+			}
+		}
+	}
+
+	// Strip reasoning or apply its field convention once accounted
+	if output.strip && stripMessageReasoning(data) {
+		logger.Debug("reasoning stripped from response")
+		modified = true
+	} else if output.thinkTags && inlineMessageReasoning(data) {
+		modified = true
+	} else if output.field != "" && setMessageReasoningField(data, output.field) {
+		modified = true
 	}
 
 	if !modified {
-		return responseBody
+		return responseBody, stats
 	}
 
 	fixedBody, err := json.Marshal(data)
 	if err != nil {
 		logger.Error("failed to marshal fixed response body", slog.Any("error", err))
-		return responseBody
+		return responseBody, stats
+	}
+	return fixedBody, stats
+}
+
+// countReasoningTokens tokenizes the reasoning of every choice of a parsed Chat Completions response.
+// Errors are logged, counted is false if the reasoning of any choice could not be tokenized.
+func countReasoningTokens(data map[string]any, tokenCounter func(text string) (int, error),
+	logger *slog.Logger) (total int, counted bool) {
+	choices, _ := data["choices"].([]any)
+	for i, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		message, _ := choiceMap["message"].(map[string]any)
+		reasoning, _ := message["reasoning_content"].(string)
+		if reasoning == "" {
+			reasoning, _ = message["reasoning"].(string)
+		}
+		if reasoning == "" {
+			continue
+		}
+		count, err := tokenCounter(reasoning)
+		if err != nil {
+			logger.Warn("failed to count reasoning tokens",
+				slog.Int("choice_index", i),
+				slog.String("error", err.Error()),
+			)
+			return 0, false
+		}
+		total += count
 	}
-	return fixedBody
+	return total, true
+}
+
+// completionStats holds the token figures of a completion
+type completionStats struct {
+	completionTokens int
+	reasoningTokens  int
+	reasoningUnknown bool // the reasoning tokens could not be counted
+}
+
+// record exports the completion figures to metrics
+func (cs completionStats) record(profile string, withReasoning bool, logger *slog.Logger) {
+	completionTokensMetric.Add(float64(cs.completionTokens), profile)
+	if withReasoning && !cs.reasoningUnknown {
+		reasoningTokensMetric.Add(float64(cs.reasoningTokens), profile)
+	}
+	logger.Debug("completion accounted",
+		slog.Int("completion_tokens", cs.completionTokens),
+		slog.Int("reasoning_tokens", cs.reasoningTokens),
+	)
+}
+
+// usageInt returns an integer field of a usage object, 0 if missing
+func usageInt(usage map[string]any, key string) int {
+	value, _ := usage[key].(float64)
+	return int(value)
+}
+
+// usageReasoningTokens returns usage.completion_tokens_details.reasoning_tokens if the backend reported it
+func usageReasoningTokens(usage map[string]any) (int, bool) {
+	details, _ := usage["completion_tokens_details"].(map[string]any)
+	reasoningTokens, ok := details["reasoning_tokens"].(float64)
+	return int(reasoningTokens), ok
+}
+
+// setUsageReasoningTokens sets usage.completion_tokens_details.reasoning_tokens, keeping other details
+func setUsageReasoningTokens(usage map[string]any, reasoningTokens int) {
+	details, ok := usage["completion_tokens_details"].(map[string]any)
+	if !ok {
+		details = make(map[string]any, 1)
+	}
+	details["reasoning_tokens"] = reasoningTokens
+	usage["completion_tokens_details"] = details
 }
 
 // fixReasoningContentBug fixes a vLLM bug where non-thinking responses have content
@@ -449,116 +809,3 @@ func fixReasoningContentBug(data map[string]any, logger *slog.Logger) bool {
 	}
 	return fixed
 }
-
-// streamResponse streams SSE events from backend to client, fixing model name in all events.
-// Note: no explicit Flush() call is needed here — the httplog middleware wraps the ResponseWriter
-// and auto-flushes on every Write() when Content-Type is a streamable type (e.g. text/event-stream).
-func streamResponse(w http.ResponseWriter, backendBody io.ReadCloser, virtualModel string, logger *slog.Logger) error {
-	buf := make([]byte, 0, 4096)
-	temp := make([]byte, 4096)
-
-	for {
-		n, err := backendBody.Read(temp)
-		if n > 0 {
-			buf = append(buf, temp[:n]...)
-		}
-		if err != nil && err != io.EOF {
-			return err
-		}
-
-		// Guard against unbounded buffer growth from malformed streams
-		if len(buf) > maxSSEEventSize {
-			return fmt.Errorf("SSE buffer exceeded maximum size (%d bytes)", maxSSEEventSize)
-		}
-
-		// Process complete SSE events (separated by double newline)
-		for {
-			idx := bytes.Index(buf, []byte("\n\n"))
-			if idx == -1 {
-				break // Need more data
-			}
-
-			event := buf[:idx+2] // Include the \n\n
-			buf = buf[idx+2:]
-
-			// Fix model name in ALL data events (backend includes model in every chunk)
-			event = fixModelNameInSSE(event, virtualModel, logger)
-
-			if _, werr := w.Write(event); werr != nil {
-				return werr
-			}
-		}
-
-		// Compact buffer to release consumed prefix memory
-		if cap(buf) > 4096 && len(buf) < cap(buf)/2 {
-			buf = append(make([]byte, 0, len(buf)), buf...)
-		}
-
-		if err == io.EOF {
-			// Attempt to fix model name in any remaining data before writing
-			if len(buf) > 0 {
-				buf = fixModelNameInSSE(buf, virtualModel, logger)
-				if _, werr := w.Write(buf); werr != nil {
-					return werr
-				}
-			}
-			return nil
-		}
-	}
-}
-
-// fixModelNameInSSE fixes the model field in an SSE event while preserving
-// all SSE fields (id:, event:, retry:, etc.). Only the data: line containing
-// JSON with a model field is modified.
-func fixModelNameInSSE(event []byte, virtualModel string, logger *slog.Logger) []byte {
-	// Split event into lines, preserving structure
-	// Event includes trailing \n\n — trim it for processing, re-add at end
-	trimmed := bytes.TrimRight(event, "\n")
-	lines := bytes.Split(trimmed, []byte("\n"))
-
-	modified := false
-	for i, line := range lines {
-		if !bytes.HasPrefix(line, []byte("data: ")) {
-			continue
-		}
-
-		jsonPart := bytes.TrimSpace(line[6:])
-
-		// Skip [DONE] or empty data lines
-		if len(jsonPart) == 0 || bytes.Equal(jsonPart, []byte("[DONE]")) {
-			continue
-		}
-
-		// Try to parse and fix
-		var data map[string]any
-		if err := json.Unmarshal(jsonPart, &data); err != nil {
-			continue
-		}
-
-		if modelStr, ok := data["model"].(string); ok {
-			logger.Debug("fixing model name in streaming event",
-				slog.String("original", modelStr),
-				slog.String("replacement", virtualModel),
-			)
-			data["model"] = virtualModel
-
-			fixedJSON, err := json.Marshal(data)
-			if err != nil {
-				logger.Error("failed to marshal streaming event", slog.Any("error", err))
-				continue
-			}
-
-			lines[i] = append([]byte("data: "), fixedJSON...)
-			modified = true
-		}
-	}
-
-	if !modified {
-		return event
-	}
-
-	// Reassemble event with original \n\n terminator
-	result := bytes.Join(lines, []byte("\n"))
-	result = append(result, []byte("\n\n")...)
-	return result
-}
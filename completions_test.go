@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestCountReasoningTokens(t *testing.T) {
+	// One token per word, failing on "fail"
+	tokenCounter := func(text string) (int, error) {
+		if strings.Contains(text, "fail") {
+			return 0, errors.New("tokenize returned HTTP 500")
+		}
+		return len(strings.Fields(text)), nil
+	}
+	tests := []struct {
+		name        string
+		choices     string
+		want        int
+		wantCounted bool
+	}{
+		{
+			name:        "every choice",
+			choices:     `[{"message":{"reasoning_content":"a b c"}},{"message":{"reasoning":"d e"}}]`,
+			want:        5,
+			wantCounted: true,
+		},
+		{
+			name:        "choice without reasoning",
+			choices:     `[{"message":{"content":"x y","reasoning_content":null}},{"message":{"reasoning_content":"a"}}]`,
+			want:        1,
+			wantCounted: true,
+		},
+		{
+			name:        "no choice",
+			choices:     `[]`,
+			wantCounted: true,
+		},
+		{
+			name:    "a choice fails",
+			choices: `[{"message":{"reasoning_content":"a b c"}},{"message":{"reasoning_content":"fail"}}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var choices []any
+			if err := json.Unmarshal([]byte(tt.choices), &choices); err != nil {
+				t.Fatal(err)
+			}
+			got, counted := countReasoningTokens(map[string]any{"choices": choices}, tokenCounter, slog.New(slog.DiscardHandler))
+			if got != tt.want || counted != tt.wantCounted {
+				t.Errorf("got %d (counted=%v), want %d (counted=%v)", got, counted, tt.want, tt.wantCounted)
+			}
+		})
+	}
+}
+
+func TestSetUsageReasoningTokens(t *testing.T) {
+	tests := []struct {
+		usage string
+		want  string
+	}{
+		{`{"completion_tokens":10}`, `{"completion_tokens":10,"completion_tokens_details":{"reasoning_tokens":4}}`},
+		{`{"completion_tokens_details":null}`, `{"completion_tokens_details":{"reasoning_tokens":4}}`},
+		{`{"completion_tokens_details":{"audio_tokens":1}}`, `{"completion_tokens_details":{"audio_tokens":1,"reasoning_tokens":4}}`},
+	}
+	for _, tt := range tests {
+		var usage map[string]any
+		if err := json.Unmarshal([]byte(tt.usage), &usage); err != nil {
+			t.Fatal(err)
+		}
+		setUsageReasoningTokens(usage, 4)
+		got, _ := json.Marshal(usage)
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.usage, got, tt.want)
+		}
+		// Once sent, the figure is read back from the JSON
+		var sent map[string]any
+		if err := json.Unmarshal(got, &sent); err != nil {
+			t.Fatal(err)
+		}
+		if reasoningTokens, reported := usageReasoningTokens(sent); !reported || reasoningTokens != 4 {
+			t.Errorf("%s: got %d reported=%v", tt.usage, reasoningTokens, reported)
+		}
+	}
+}
+
+func TestFixNonStreamingResponseReasoningTokens(t *testing.T) {
+	tests := []struct {
+		name        string
+		response    string
+		counterErr  error
+		wantUsage   string
+		wantTokens  int
+		wantUnknown bool
+	}{
+		{
+			name:       "counted",
+			response:   `{"choices":[{"message":{"content":"a","reasoning_content":"r"}}],"usage":{"completion_tokens":5}}`,
+			wantUsage:  `{"completion_tokens":5,"completion_tokens_details":{"reasoning_tokens":3}}`,
+			wantTokens: 3,
+		},
+		{
+			name:       "reported by the backend",
+			response:   `{"choices":[{"message":{"content":"a","reasoning_content":"r"}}],"usage":{"completion_tokens_details":{"reasoning_tokens":2}}}`,
+			wantUsage:  `{"completion_tokens_details":{"reasoning_tokens":2}}`,
+			wantTokens: 2,
+		},
+		{
+			name:        "tokenize failure",
+			response:    `{"choices":[{"message":{"content":"a","reasoning_content":"r"}}],"usage":{"completion_tokens":5}}`,
+			counterErr:  errors.New("backend tokenize returned HTTP 401"),
+			wantUsage:   `{"completion_tokens":5}`,
+			wantUnknown: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenCounter := func(string) (int, error) { return 3, tt.counterErr }
+			fixed, stats := fixNonStreamingResponse([]byte(tt.response), true, "qwen", reasoningOutput{}, nil,
+				tokenCounter, slog.New(slog.DiscardHandler))
+			var data struct {
+				Usage json.RawMessage
+			}
+			if err := json.Unmarshal(fixed, &data); err != nil {
+				t.Fatal(err)
+			}
+			if got := normalizeJSON(t, data.Usage); got != normalizeJSON(t, []byte(tt.wantUsage)) {
+				t.Errorf("got usage %s, want %s", got, tt.wantUsage)
+			}
+			if stats.reasoningTokens != tt.wantTokens || stats.reasoningUnknown != tt.wantUnknown {
+				t.Errorf("got stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestDisablePromptThinking(t *testing.T) {
+	const (
+		conversation = "<|im_start|>system\nBe brief.<|im_end|>\n<|im_start|>user\nHello<|im_end|>\n"
+		marker       = "<|im_start|>assistant\n"
+		thinkBlock   = "<think>\n\n</think>\n\n"
+	)
+	tests := []struct {
+		name   string
+		prompt any
+		want   any
+	}{
+		{
+			name:   "assistant generation marker",
+			prompt: conversation + marker,
+			want:   conversation + marker + thinkBlock,
+		},
+		{
+			name:   "think block already present",
+			prompt: conversation + marker + thinkBlock,
+			want:   conversation + marker + thinkBlock,
+		},
+		{
+			name:   "think block opened by the prompt",
+			prompt: conversation + marker + "<think>\n",
+			want:   conversation + marker + "<think>\n",
+		},
+		{
+			name:   "assistant answer prefilled",
+			prompt: conversation + marker + "Sure,",
+			want:   conversation + marker + "Sure,",
+		},
+		{
+			name:   "plain text",
+			prompt: "Once upon a time",
+			want:   "Once upon a time",
+		},
+		{
+			name:   "batch of prompts",
+			prompt: []any{conversation + marker, conversation + marker + thinkBlock, "Once upon a time"},
+			want:   []any{conversation + marker + thinkBlock, conversation + marker + thinkBlock, "Once upon a time"},
+		},
+		{
+			name:   "token prompt",
+			prompt: []any{151644.0, 77091.0, 198.0},
+			want:   []any{151644.0, 77091.0, 198.0},
+		},
+		{
+			name:   "batch of token prompts",
+			prompt: []any{[]any{151644.0, 77091.0, 198.0}},
+			want:   []any{[]any{151644.0, 77091.0, 198.0}},
+		},
+	}
+	logger := slog.New(slog.DiscardHandler)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]any{"model": "qwen", "prompt": tt.prompt}
+			disablePromptThinking(data, logger)
+			got, err := json.Marshal(data["prompt"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := json.Marshal(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("got prompt %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // COMPLETE is a log level more verbose than DEBUG for complete request/response dumps
@@ -15,16 +17,43 @@ const COMPLETE = slog.LevelDebug - 4
 const COMPLETE_LEVEL = "COMPLETE"
 
 type Config struct {
-	Listen                 string
-	Port                   int
-	Target                 string
-	LogLevel               string
-	ServedModelName        string
-	ThinkingGeneralModel   string
-	ThinkingCodingModel    string
-	InstructGeneralModel   string
-	InstructReasoningModel string
-	EnforceSamplingParams  bool
+	Listen                     string
+	Port                       int
+	Target                     string
+	LogLevel                   string
+	ServedModelName            string
+	ThinkingGeneralModel       string
+	ThinkingCodingModel        string
+	InstructGeneralModel       string
+	InstructReasoningModel     string
+	EnforceSamplingParams      bool
+	RedactDumps                bool
+	RedactRules                string
+	CountReasoningTokens       bool
+	SSEKeepAlive               time.Duration
+	JSONKeepAlive              time.Duration
+	UpstreamStreaming          bool
+	StallTimeout               time.Duration
+	StripReasoning             string
+	ThinkTags                  string
+	ToolCallValidation         string
+	StructuredOutput           bool
+	StructuredOutputRetry      int
+	CompletionsSamplingParams  bool
+	CompletionsDisableThinking bool
+	ResponseStoreTTL           time.Duration
+	ResponseStoreDir           string
+	ResponseStoreReasoning     bool
+	ReasoningField             string
+	ReasoningFieldRules        string
+	ReadyCheckInterval         time.Duration
+	BackendAPIKey              string
+	WatchdogRequireReady       bool
+	AdminListen                string
+	AdminPort                  int
+	AdminToken                 string
+	LogLevelRevert             time.Duration
+	DebugLogTrustedCIDRs       string
 }
 
 func (c Config) Validate() error {
@@ -55,6 +84,51 @@ func (c Config) Validate() error {
 	if c.InstructReasoningModel == "" {
 		return errors.New("instruct-reasoning model name cannot be empty")
 	}
+	if c.AdminPort < 0 || c.AdminPort > 65535 {
+		return errors.New("admin port must be between 1 and 65535, or 0 to disable the admin listener")
+	}
+	if c.AdminPort != 0 && c.AdminPort == c.Port {
+		return errors.New("admin port must differ from the listening port")
+	}
+	if c.AdminPort != 0 && c.AdminListen == "" {
+		return errors.New("admin listen address cannot be empty")
+	}
+	if c.AdminPort != 0 && c.AdminToken == "" && !isLoopback(c.AdminListen) {
+		return errors.New("admin token is required when the admin listener is not bound to a loopback address")
+	}
+	if c.LogLevelRevert < 0 {
+		return errors.New("log level revert delay cannot be negative")
+	}
+	if _, err := parsePrefixes(c.DebugLogTrustedCIDRs); err != nil {
+		return err
+	}
+	if c.SSEKeepAlive < 0 {
+		return errors.New("SSE keepalive interval cannot be negative")
+	}
+	if c.JSONKeepAlive < 0 {
+		return errors.New("JSON keepalive interval cannot be negative")
+	}
+	if c.ResponseStoreTTL < 0 {
+		return errors.New("response store TTL cannot be negative")
+	}
+	if c.StallTimeout < 0 {
+		return errors.New("stall timeout cannot be negative")
+	}
+	if _, err := newReasoningPolicy(c); err != nil {
+		return err
+	}
+	if _, err := parseToolValidationRules(c.ToolCallValidation); err != nil {
+		return err
+	}
+	if c.StructuredOutputRetry < 0 {
+		return errors.New("structured output retries cannot be negative")
+	}
+	if c.ReadyCheckInterval <= 0 {
+		return errors.New("ready check interval must be positive")
+	}
+	if _, err := parseRedactRules(c.RedactRules); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -71,6 +145,33 @@ func LoadConfig() (Config, error) {
 	instructGeneral := flag.String("instruct-general", "qwen3.5-instruct-general", "Name of the instruct-general model")
 	instructReasoning := flag.String("instruct-reasoning", "qwen3.5-instruct-reasoning", "Name of the instruct-reasoning model")
 	enforceSampling := flag.Bool("enforce-sampling-params", false, "Enforce sampling parameters, overriding client-provided values")
+	redactDumps := flag.Bool("redact-dumps", false, "Redact message contents, base64 payloads and credentials from logged request/response bodies")
+	redactRules := flag.String("redact-rules", defaultRedactRules, "Comma separated json.path=action redaction rules (actions: truncate:N, hash, strip)")
+	countReasoning := flag.Bool("count-reasoning-tokens", false, "Fill usage.completion_tokens_details.reasoning_tokens (non-streaming responses are tokenized by the backend)")
+	sseKeepAlive := flag.Duration("sse-keepalive", 0, "Send a keepalive comment on streaming responses idle for this long, including while waiting for the backend response header, 0 to disable")
+	jsonKeepAlive := flag.Duration("json-keepalive", 0, "Send a space at this interval while waiting for non-streaming chat completions (the response header is sent right away), 0 to disable")
+	upstreamStreaming := flag.Bool("upstream-streaming", false, "Stream non-streaming chat completions from the backend, aggregating the chunks back into a single response")
+	stallTimeout := flag.Duration("stall-timeout", 0, "Abort backend streams silent for this long once the first token has been received, 0 to disable")
+	stripReasoning := flag.String("strip-reasoning", "", "Comma separated profiles whose responses are returned without reasoning (e.g. thinking_general)")
+	thinkTags := flag.String("think-tags", "", "Comma separated thinking profiles whose reasoning is inlined in the content within <think> tags")
+	reasoningField := flag.String("reasoning-field", "", "Field of the reasoning in responses (reasoning_content, reasoning or both), empty to keep the backend one")
+	reasoningFieldRules := flag.String("reasoning-field-rules", "", "Comma separated key:<api key>=field and ua:<regexp>=field rules overriding -reasoning-field per client")
+	toolCallValidation := flag.String("tool-call-validation", "", "Comma separated profile=action rules validating tool call arguments against the request schemas (actions: annotate, repair, retry:N)")
+	structuredOutput := flag.Bool("structured-output", false, "Validate non-streaming responses against their response_format, stripping Markdown code fences and retrying invalid ones")
+	structuredOutputRetries := flag.Int("structured-output-retries", 1, "Maximum number of re-issued requests for structured output that does not validate")
+	completionsSampling := flag.Bool("completions-sampling-params", false, "Apply the profile sampling parameters to /v1/completions requests")
+	completionsDisableThinking := flag.Bool("completions-disable-thinking", false, "Append an empty think block to the /v1/completions prompts of instruct profiles ending with the assistant generation marker")
+	responseStoreTTL := flag.Duration("response-store-ttl", 0, "Store completed responses and conversations for previous_response_id and /v1/conversations, expiring once unused for this long, 0 to disable")
+	responseStoreDir := flag.String("response-store-dir", "", "Directory persisting the response store across restarts, empty to keep it in memory")
+	responseStoreReasoning := flag.Bool("response-store-reasoning", false, "Keep the reasoning items of the stored responses")
+	readyCheckInterval := flag.Duration("ready-check-interval", 10*time.Second, "Interval between backend readiness checks")
+	backendAPIKey := flag.String("backend-api-key", "", "API key of the backend (vLLM --api-key) sent by the readiness checks, empty to send none")
+	watchdogRequireReady := flag.Bool("watchdog-require-ready", false, "Stop systemd watchdog heartbeats while the backend is not ready")
+	adminListen := flag.String("admin-listen", "127.0.0.1", "IP address the admin listener (metrics, stats, pprof) listens on")
+	adminPort := flag.Int("admin-port", 9001, "Port of the admin listener, 0 to disable it")
+	adminToken := flag.String("admin-token", "", "Bearer token required by the admin listener, empty to disable authentication")
+	logLevelRevert := flag.Duration("loglevel-revert", 0, "Revert runtime log level changes (admin endpoint, SIGUSR1) after this delay, 0 to keep them")
+	debugLogTrusted := flag.String("debug-log-trusted-cidrs", "127.0.0.0/8,::1/128", "Comma separated CIDRs allowed to raise the log level of their requests with the X-Debug-Log header")
 
 	flag.Parse()
 
@@ -82,16 +183,91 @@ func LoadConfig() (Config, error) {
 	cfg.ThinkingCodingModel = getEnvOrFlag(*thinkingCoding, "QWEN35RP_THINKING_CODING_MODEL")
 	cfg.InstructGeneralModel = getEnvOrFlag(*instructGeneral, "QWEN35RP_INSTRUCT_GENERAL_MODEL")
 	cfg.InstructReasoningModel = getEnvOrFlag(*instructReasoning, "QWEN35RP_INSTRUCT_REASONING_MODEL")
+	cfg.RedactRules = getEnvOrFlag(*redactRules, "QWEN35RP_REDACT_RULES")
+	cfg.AdminListen = getEnvOrFlag(*adminListen, "QWEN35RP_ADMIN_LISTEN")
+	cfg.AdminToken = getEnvOrFlag(*adminToken, "QWEN35RP_ADMIN_TOKEN")
+	cfg.BackendAPIKey = getEnvOrFlag(*backendAPIKey, "QWEN35RP_BACKEND_API_KEY")
+	cfg.DebugLogTrustedCIDRs = getEnvOrFlag(*debugLogTrusted, "QWEN35RP_DEBUG_LOG_TRUSTED_CIDRS")
+	cfg.StripReasoning = getEnvOrFlag(*stripReasoning, "QWEN35RP_STRIP_REASONING")
+	cfg.ThinkTags = getEnvOrFlag(*thinkTags, "QWEN35RP_THINK_TAGS")
+	cfg.ToolCallValidation = getEnvOrFlag(*toolCallValidation, "QWEN35RP_TOOL_CALL_VALIDATION")
+	cfg.ReasoningField = getEnvOrFlag(*reasoningField, "QWEN35RP_REASONING_FIELD")
+	cfg.ReasoningFieldRules = getEnvOrFlag(*reasoningFieldRules, "QWEN35RP_REASONING_FIELD_RULES")
+	cfg.ResponseStoreDir = getEnvOrFlag(*responseStoreDir, "QWEN35RP_RESPONSE_STORE_DIR")
 
 	var err error
 	cfg.Port, err = getEnvOrFlagInt(*port, "QWEN35RP_PORT")
 	if err != nil {
 		return cfg, err
 	}
+	cfg.AdminPort, err = getEnvOrFlagInt(*adminPort, "QWEN35RP_ADMIN_PORT")
+	if err != nil {
+		return cfg, err
+	}
 	cfg.EnforceSamplingParams, err = getEnvOrFlagBool(*enforceSampling, "QWEN35RP_ENFORCE_SAMPLING_PARAMS")
 	if err != nil {
 		return cfg, err
 	}
+	cfg.RedactDumps, err = getEnvOrFlagBool(*redactDumps, "QWEN35RP_REDACT_DUMPS")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.CountReasoningTokens, err = getEnvOrFlagBool(*countReasoning, "QWEN35RP_COUNT_REASONING_TOKENS")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.SSEKeepAlive, err = getEnvOrFlagDuration(*sseKeepAlive, "QWEN35RP_SSE_KEEPALIVE")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.JSONKeepAlive, err = getEnvOrFlagDuration(*jsonKeepAlive, "QWEN35RP_JSON_KEEPALIVE")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.UpstreamStreaming, err = getEnvOrFlagBool(*upstreamStreaming, "QWEN35RP_UPSTREAM_STREAMING")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.StallTimeout, err = getEnvOrFlagDuration(*stallTimeout, "QWEN35RP_STALL_TIMEOUT")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.StructuredOutput, err = getEnvOrFlagBool(*structuredOutput, "QWEN35RP_STRUCTURED_OUTPUT")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.StructuredOutputRetry, err = getEnvOrFlagInt(*structuredOutputRetries, "QWEN35RP_STRUCTURED_OUTPUT_RETRIES")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.CompletionsSamplingParams, err = getEnvOrFlagBool(*completionsSampling, "QWEN35RP_COMPLETIONS_SAMPLING_PARAMS")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.CompletionsDisableThinking, err = getEnvOrFlagBool(*completionsDisableThinking, "QWEN35RP_COMPLETIONS_DISABLE_THINKING")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ResponseStoreTTL, err = getEnvOrFlagDuration(*responseStoreTTL, "QWEN35RP_RESPONSE_STORE_TTL")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ResponseStoreReasoning, err = getEnvOrFlagBool(*responseStoreReasoning, "QWEN35RP_RESPONSE_STORE_REASONING")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ReadyCheckInterval, err = getEnvOrFlagDuration(*readyCheckInterval, "QWEN35RP_READY_CHECK_INTERVAL")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.LogLevelRevert, err = getEnvOrFlagDuration(*logLevelRevert, "QWEN35RP_LOGLEVEL_REVERT")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.WatchdogRequireReady, err = getEnvOrFlagBool(*watchdogRequireReady, "QWEN35RP_WATCHDOG_REQUIRE_READY")
+	if err != nil {
+		return cfg, err
+	}
 
 	return cfg, cfg.Validate()
 }
@@ -125,6 +301,17 @@ func getEnvOrFlagBool(flagVal bool, envName string) (bool, error) {
 	return flagVal, nil
 }
 
+func getEnvOrFlagDuration(flagVal time.Duration, envName string) (time.Duration, error) {
+	if envVal, exists := os.LookupEnv(envName); exists {
+		durationVal, err := time.ParseDuration(envVal)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value for %s=%q: %w", envName, envVal, err)
+		}
+		return durationVal, nil
+	}
+	return flagVal, nil
+}
+
 // parseLogLevel parses a log level string, including the COMPLETE level
 func parseLogLevel(levelStr string) slog.Level {
 	switch strings.ToUpper(levelStr) {
@@ -142,3 +329,12 @@ func parseLogLevel(levelStr string) slog.Level {
 		return slog.LevelInfo
 	}
 }
+
+// isLoopback reports whether a listen address only accepts local connections
+func isLoopback(listen string) bool {
+	if listen == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(listen)
+	return err == nil && addr.IsLoopback()
+}
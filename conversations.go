@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Endpoints of the stored responses and conversations, served when the response store is enabled:
+//
+//	GET    /v1/responses/{id}
+//	DELETE /v1/responses/{id}
+//	POST   /v1/conversations
+//	GET    /v1/conversations/{id}
+//	DELETE /v1/conversations/{id}
+//	GET    /v1/conversations/{id}/items
+//
+// Records of other tenants (API keys) are reported as not found.
+
+// maxConversationItems caps the number of items listed at once
+const maxConversationItems = 100
+
+// retrieveStored handles GET /v1/responses/{id} and GET /v1/conversations/{id}, the id of
+// the records of the endpoint starting with prefix
+func retrieveStored(store *responseStore, prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		err := fmt.Errorf("%q %w", id, errStoredNotFound)
+		var object map[string]any
+		if strings.HasPrefix(id, prefix) {
+			object, err = store.object(tenantKey(r.Header), id)
+		}
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		writeStoreResponse(w, r, object)
+	}
+}
+
+// deleteStored handles DELETE /v1/responses/{id} and DELETE /v1/conversations/{id}, see
+// retrieveStored. object is the object type of the deletion confirmation.
+func deleteStored(store *responseStore, prefix, object string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		err := fmt.Errorf("%q %w", id, errStoredNotFound)
+		if strings.HasPrefix(id, prefix) {
+			err = store.delete(tenantKey(r.Header), id)
+		}
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		requestLogger(r.Context()).Info("stored record deleted", slog.String("id", id))
+		writeStoreResponse(w, r, map[string]any{"id": id, "object": object, "deleted": true})
+	}
+}
+
+// createConversation handles POST /v1/conversations
+func createConversation(store *responseStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r.Context())
+		ctx := r.Context()
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		requestBody, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error("failed to read body", slog.String("error", err.Error()))
+			httpError(ctx, w, readBodyStatusCode(err))
+			return
+		}
+		var request struct {
+			Items    []any          `json:"items"`
+			Metadata map[string]any `json:"metadata"`
+		}
+		if len(requestBody) > 0 {
+			if err = json.Unmarshal(requestBody, &request); err != nil {
+				logger.Error("failed to parse body as JSON", slog.String("error", err.Error()))
+				httpError(ctx, w, http.StatusBadRequest)
+				return
+			}
+		}
+		// Items are checked the way they will be translated
+		if len(request.Items) > 0 {
+			if _, err = responsesInputMessages(request.Items); err != nil {
+				logger.Error("invalid conversation items", slog.String("error", err.Error()))
+				responsesError(ctx, w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		conversation, err := store.createConversation(tenantKey(r.Header), request.Items, request.Metadata)
+		if err != nil {
+			logger.Error("failed to store conversation", slog.Any("error", err))
+			httpError(ctx, w, http.StatusInternalServerError)
+			return
+		}
+		logger.Info("conversation created", slog.Any("id", conversation["id"]))
+		writeStoreResponse(w, r, conversation)
+	}
+}
+
+// listConversationItems handles GET /v1/conversations/{id}/items, supporting the after, limit
+// and order (asc or desc, the default) query parameters
+func listConversationItems(store *responseStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		err := fmt.Errorf("%q %w", id, errStoredNotFound)
+		var items []any
+		if strings.HasPrefix(id, "conv_") {
+			items, err = store.items(tenantKey(r.Header), id)
+		}
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("order") != "asc" {
+			slices.Reverse(items)
+		}
+		if after := query.Get("after"); after != "" {
+			if i := slices.IndexFunc(items, func(item any) bool {
+				itemMap, _ := item.(map[string]any)
+				return itemMap["id"] == after
+			}); i >= 0 {
+				items = items[i+1:]
+			}
+		}
+		limit := 20
+		if raw := query.Get("limit"); raw != "" {
+			if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxConversationItems {
+				responsesError(r.Context(), w, http.StatusBadRequest,
+					errors.New("limit must be between 1 and "+strconv.Itoa(maxConversationItems)))
+				return
+			}
+		}
+		hasMore := len(items) > limit
+		items = items[:min(len(items), limit)]
+		list := map[string]any{
+			"object":   "list",
+			"data":     items,
+			"first_id": nil,
+			"last_id":  nil,
+			"has_more": hasMore,
+		}
+		if len(items) > 0 {
+			first, _ := items[0].(map[string]any)
+			last, _ := items[len(items)-1].(map[string]any)
+			list["first_id"], list["last_id"] = first["id"], last["id"]
+		}
+		writeStoreResponse(w, r, list)
+	}
+}
+
+// storeError writes the OpenAI error of a failed store operation
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errStoredNotFound) {
+		responsesError(r.Context(), w, http.StatusNotFound, err)
+		return
+	}
+	requestLogger(r.Context()).Error("response store failure", slog.Any("error", err))
+	httpError(r.Context(), w, http.StatusInternalServerError)
+}
+
+func writeStoreResponse(w http.ResponseWriter, r *http.Request, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		requestLogger(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
@@ -34,11 +34,15 @@ func rewriteRequestURL(req *http.Request, target *url.URL) {
 // with base64-encoded images can legitimately be very large.
 const maxRequestBodySize = 100 << 20 // 100 MB
 
-// maxSSEEventSize is the maximum allowed size for a single buffered SSE event (10 MB).
+// maxSSEEventSize is the maximum allowed size for a single buffered SSE event or line (10 MB).
 // This prevents unbounded memory growth if the backend sends a malformed stream
 // without proper event delimiters.
 const maxSSEEventSize = 10 << 20 // 10 MB
 
+// maxDumpBodySize is the maximum body size dumped by the COMPLETE log level when dumps are
+// redacted (1 MB). Larger bodies are only reported by their size.
+const maxDumpBodySize = 1 << 20 // 1 MB
+
 // hopByHopHeaders lists headers that must not be forwarded by proxies (RFC 7230 §6.1)
 var hopByHopHeaders = []string{
 	"Connection",
@@ -96,25 +100,59 @@ func copyHeaders(w http.ResponseWriter, resp *http.Response) {
 	}
 }
 
+// cancelOnClose is a ReadCloser releasing a context when closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
 // httpError writes an OpenAI-compatible JSON error response
 func httpError(ctx context.Context, w http.ResponseWriter, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(openAIError(ctx, statusCode)); err != nil {
+		logger.Error("failed to write error response", slog.Any("error", err))
+	}
+}
+
+// httpStreamError ends a SSE response failing after its header has been sent with an
+// OpenAI-compatible error event followed by [DONE], so clients do not see a truncated stream
+func httpStreamError(ctx context.Context, w http.ResponseWriter, statusCode int) {
+	payload, err := json.Marshal(openAIError(ctx, statusCode))
+	if err != nil {
+		logger.Error("failed to marshal stream error event", slog.Any("error", err))
+		return
+	}
+	writer := newSSEWriter(w)
+	var event sseEvent
+	for _, data := range [][]byte{payload, sseDone} {
+		event.setData(data)
+		if err = writer.writeEvent(&event); err != nil {
+			logger.Error("failed to write stream error event", slog.Any("error", err))
+			return
+		}
+	}
+}
+
+// openAIError returns an OpenAI-compatible error object referencing the request ID
+func openAIError(ctx context.Context, statusCode int) map[string]any {
 	reqID := ctx.Value(httplog.ReqIDKey)
 	message := fmt.Sprintf("%s - check qwen35-rp logs for more details (request id #%v)",
 		http.StatusText(statusCode),
 		reqID,
 	)
-	errResp := map[string]any{
+	return map[string]any{
 		"error": map[string]any{
 			"message": message,
 			"type":    http.StatusText(statusCode),
 			"code":    statusCode,
 		},
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	if err := json.NewEncoder(w).Encode(errResp); err != nil {
-		logger.Error("failed to write error response", slog.Any("error", err))
-	}
 }
 
 // readBodyStatusCode returns the appropriate HTTP status code for a body read error.
@@ -126,23 +164,3 @@ func readBodyStatusCode(err error) int {
 	}
 	return http.StatusInternalServerError
 }
-
-// extractSSEDataJSON extracts the JSON payload from an SSE event.
-// It handles multi-line events by scanning all lines for the first "data: " line
-// that contains parseable JSON (skipping [DONE] and empty data lines).
-// Returns nil if no valid JSON data line is found.
-func extractSSEDataJSON(event []byte) []byte {
-	trimmed := bytes.TrimRight(event, "\n\r ")
-	lines := bytes.Split(trimmed, []byte("\n"))
-	for _, line := range lines {
-		if !bytes.HasPrefix(line, []byte("data: ")) {
-			continue
-		}
-		jsonPart := bytes.TrimSpace(line[6:])
-		if len(jsonPart) == 0 || bytes.Equal(jsonPart, []byte("[DONE]")) {
-			continue
-		}
-		return jsonPart
-	}
-	return nil
-}
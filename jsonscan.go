@@ -0,0 +1,147 @@
+package main
+
+import "bytes"
+
+// findTopLevelValue locates the raw value of key in a JSON object without decoding it.
+// start and end delimit the value within payload (end excluded). As with encoding/json,
+// the last occurrence of a duplicated key wins.
+// ok is false if payload is not an object, if the key is missing or if the JSON is malformed.
+func findTopLevelValue(payload []byte, key string) (start, end int, ok bool) {
+	i := skipJSONSpaces(payload, 0)
+	if i >= len(payload) || payload[i] != '{' {
+		return
+	}
+	i = skipJSONSpaces(payload, i+1)
+	if i < len(payload) && payload[i] == '}' {
+		return // empty object
+	}
+	for {
+		if i >= len(payload) || payload[i] != '"' {
+			return 0, 0, false
+		}
+		keyEnd := skipJSONString(payload, i)
+		if keyEnd < 0 {
+			return 0, 0, false
+		}
+		matched := keyEnd-i-2 == len(key) && string(payload[i+1:keyEnd-1]) == key
+		i = skipJSONSpaces(payload, keyEnd)
+		if i >= len(payload) || payload[i] != ':' {
+			return 0, 0, false
+		}
+		i = skipJSONSpaces(payload, i+1)
+		valueEnd := skipJSONValue(payload, i)
+		if valueEnd < 0 {
+			return 0, 0, false
+		}
+		if matched {
+			start, end = i, valueEnd
+		}
+		i = skipJSONSpaces(payload, valueEnd)
+		if i >= len(payload) {
+			return 0, 0, false // truncated
+		}
+		switch payload[i] {
+		case '}':
+			return start, end, end > 0
+		case ',':
+			i = skipJSONSpaces(payload, i+1)
+		default:
+			return 0, 0, false
+		}
+	}
+}
+
+// skipJSONSpaces returns the index of the first non whitespace byte from i
+func skipJSONSpaces(payload []byte, i int) int {
+	for i < len(payload) {
+		switch payload[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipJSONString returns the index following the string starting at i (on its opening quote), -1 if unterminated
+func skipJSONString(payload []byte, i int) int {
+	for i++; i < len(payload); i++ {
+		switch payload[i] {
+		case '\\':
+			i++ // skip the escaped byte
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// skipJSONValue returns the index following the value starting at i, -1 if malformed
+func skipJSONValue(payload []byte, i int) int {
+	if i >= len(payload) {
+		return -1
+	}
+	switch payload[i] {
+	case '"':
+		return skipJSONString(payload, i)
+	case '{', '[':
+		depth := 0
+		for i < len(payload) {
+			switch payload[i] {
+			case '"':
+				if i = skipJSONString(payload, i); i < 0 {
+					return -1
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+		return -1
+	default:
+		// number, true, false, null: up to the next delimiter
+		start := i
+		for i < len(payload) {
+			switch payload[i] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				if i == start {
+					return -1
+				}
+				return i
+			}
+			i++
+		}
+		return i
+	}
+}
+
+// countStringFields counts the occurrences of "key" having a non empty string value, at any depth.
+// It is a raw byte search: occurrences within string values are only excluded when escaped.
+func countStringFields(payload []byte, quotedKey []byte) (count int) {
+	for offset := 0; ; {
+		idx := bytes.Index(payload[offset:], quotedKey)
+		if idx < 0 {
+			return
+		}
+		i := offset + idx
+		offset = i + len(quotedKey)
+		if i > 0 && payload[i-1] == '\\' {
+			continue
+		}
+		j := skipJSONSpaces(payload, offset)
+		if j >= len(payload) || payload[j] != ':' {
+			continue
+		}
+		j = skipJSONSpaces(payload, j+1)
+		if j+1 < len(payload) && payload[j] == '"' && payload[j+1] != '"' {
+			count++
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFindTopLevelValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		payload string
+		want    string // raw value, empty if not found
+	}{
+		{"string value", "model", `{"id":"chatcmpl-1","model":"qwen","choices":[]}`, `"qwen"`},
+		{"spaces", "model", " {\n \"model\" : \"qwen\" \n}", `"qwen"`},
+		{"last key", "model", `{"id":"x","model":"qwen"}`, `"qwen"`},
+		{"null value", "model", `{"model":null}`, `null`},
+		{"object value", "usage", `{"id":"x","usage":{"total_tokens":3}}`, `{"total_tokens":3}`},
+		{"escaped quotes before", "model", `{"id":"a\"model\":\"x","model":"qwen"}`, `"qwen"`},
+		{"escaped quotes within", "model", `{"model":"q\"w\\"}`, `"q\"w\\"`},
+		{"nested objects before", "model", `{"meta":{"model":"inner","a":[{"model":"x"}]},"model":"qwen"}`, `"qwen"`},
+		{"nested only", "model", `{"choices":[{"model":"inner"}]}`, ``},
+		{"braces within strings", "model", `{"content":"}]{[","model":"qwen"}`, `"qwen"`},
+		{"duplicated key", "model", `{"model":"first","id":"x","model":"last"}`, `"last"`},
+		{"key prefix", "model", `{"models":"qwen","mode":"x"}`, ``},
+		{"escaped key", "model", `{"mo\"del":"qwen"}`, ``},
+		{"truncated value", "model", `{"model":"qw`, ``},
+		{"truncated after value", "model", `{"model":"qwen"`, ``},
+		{"truncated after next value", "model", `{"model":"qwen","choices":[{"delta":`, ``},
+		{"truncated number", "model", `{"model":"qwen","created":17`, ``},
+		{"missing colon", "model", `{"model" "qwen"}`, ``},
+		{"empty object", "model", `{}`, ``},
+		{"array", "model", `["model","qwen"]`, ``},
+		{"empty", "model", ``, ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, ok := findTopLevelValue([]byte(tt.payload), tt.key)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("expected not found, got %q", tt.payload[start:end])
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected %s, got not found", tt.want)
+			}
+			if got := tt.payload[start:end]; got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipJSONValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		start   int
+		want    int
+	}{
+		{"string", `"abc",`, 0, 5},
+		{"escaped quote", `"a\"b",`, 0, 6},
+		{"escaped backslash", `"a\\",`, 0, 5},
+		{"unterminated string", `"abc`, 0, -1},
+		{"unterminated escape", `"abc\`, 0, -1},
+		{"object", `{"a":1},`, 0, 7},
+		{"nested", `{"a":{"b":[1,{"c":[]}]}}]`, 0, 24},
+		{"brackets within strings", `{"a":"}]"}`, 0, 10},
+		{"escaped quote within object", `["\"]",1]`, 0, 9},
+		{"unterminated object", `{"a":[1,2]`, 0, -1},
+		{"unterminated string within object", `{"a":"}`, 0, -1},
+		{"number", `12.5e3,`, 0, 6},
+		{"literal", `true}`, 0, 4},
+		{"literal at end", `null`, 0, 4},
+		{"offset", `{"a":false}`, 5, 10},
+		{"missing value", `,`, 0, -1},
+		{"out of range", `1`, 1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := skipJSONValue([]byte(tt.payload), tt.start); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountStringFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    int
+	}{
+		{"top level", `{"reasoning":"a"}`, 1},
+		{"nested choices", `{"choices":[{"delta":{"reasoning":"a"}},{"delta":{"reasoning":"b"}}]}`, 2},
+		{"spaces", `{"reasoning" : "a"}`, 1},
+		{"empty string", `{"reasoning":""}`, 0},
+		{"null", `{"reasoning":null}`, 0},
+		{"object", `{"reasoning":{"a":"b"}}`, 0},
+		{"as a value", `{"field":"reasoning"}`, 0},
+		{"escaped within a string", `{"content":"say \"reasoning\": \"x\""}`, 0},
+		{"other key", `{"reasoning_content":"a"}`, 0},
+		{"truncated after colon", `{"reasoning":`, 0},
+		{"truncated after quote", `{"reasoning":"`, 0},
+		{"truncated key", `{"reaso`, 0},
+	}
+	quotedKey := []byte(`"reasoning"`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countStringFields([]byte(tt.payload), quotedKey); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// benchmarkChunk is a typical streamed chat completion chunk
+var benchmarkChunk = []byte(`{"id":"chatcmpl-8c1a6f0e5b7d4e2f9a3b","object":"chat.completion.chunk","created":1760000000,` +
+	`"model":"Qwen/Qwen3.5-397B-A17B-FP8","choices":[{"index":0,"delta":{"content":" the answer is"},` +
+	`"logprobs":null,"finish_reason":null}],"system_fingerprint":null}`)
+
+// BenchmarkModelRewrite compares the model name rewrite of a chunk by decoding and re-encoding it
+// with the raw splice of the fast path
+func BenchmarkModelRewrite(b *testing.B) {
+	quotedModel := []byte(`"qwen3.5"`)
+	b.Run("decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			var data map[string]any
+			if err := json.Unmarshal(benchmarkChunk, &data); err != nil {
+				b.Fatal(err)
+			}
+			data["model"] = "qwen3.5"
+			if _, err := json.Marshal(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("splice", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for b.Loop() {
+			start, end, ok := findTopLevelValue(benchmarkChunk, "model")
+			if !ok {
+				b.Fatal("model not found")
+			}
+			buf = append(buf[:0], benchmarkChunk[:start]...)
+			buf = append(buf, quotedModel...)
+			buf = append(buf, benchmarkChunk[end:]...)
+		}
+	})
+}
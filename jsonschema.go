@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// validateSchema validates a decoded JSON value against a JSON schema. The keywords models are
+// usually given are supported: type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minLength, maxLength, minimum, maximum, anyOf, oneOf and allOf.
+// Other keywords ($ref, format, pattern...) are ignored. path locates value in error messages.
+func validateSchema(value any, schema map[string]any, path string) error {
+	if schema == nil {
+		return nil
+	}
+	if types := schemaTypes(schema); len(types) > 0 && !slices.ContainsFunc(types, func(typ string) bool {
+		return matchesType(value, typ)
+	}) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonTypeName(value))
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.ContainsFunc(enum, func(item any) bool {
+		return jsonEqual(value, item)
+	}) {
+		return fmt.Errorf("%s: value is not one of the allowed values", path)
+	}
+	if constant, ok := schema["const"]; ok && !jsonEqual(value, constant) {
+		return fmt.Errorf("%s: value does not match the constant", path)
+	}
+	switch typed := value.(type) {
+	case map[string]any:
+		if err := validateObject(typed, schema, path); err != nil {
+			return err
+		}
+	case []any:
+		if err := validateArray(typed, schema, path); err != nil {
+			return err
+		}
+	case string:
+		length := len([]rune(typed))
+		if minLength, ok := schemaNumber(schema, "minLength"); ok && float64(length) < minLength {
+			return fmt.Errorf("%s: string shorter than %v", path, minLength)
+		}
+		if maxLength, ok := schemaNumber(schema, "maxLength"); ok && float64(length) > maxLength {
+			return fmt.Errorf("%s: string longer than %v", path, maxLength)
+		}
+	case float64:
+		if minimum, ok := schemaNumber(schema, "minimum"); ok && typed < minimum {
+			return fmt.Errorf("%s: %v is lower than the minimum %v", path, typed, minimum)
+		}
+		if maximum, ok := schemaNumber(schema, "maximum"); ok && typed > maximum {
+			return fmt.Errorf("%s: %v is greater than the maximum %v", path, typed, maximum)
+		}
+	}
+	return validateCombinations(value, schema, path)
+}
+
+func validateObject(object map[string]any, schema map[string]any, path string) error {
+	required, _ := schema["required"].([]any)
+	for _, name := range required {
+		if name, _ := name.(string); name != "" {
+			if _, found := object[name]; !found {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]any)
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys) // deterministic error messages
+	for _, key := range keys {
+		if property, ok := properties[key].(map[string]any); ok {
+			if err := validateSchema(object[key], property, path+"."+key); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: unexpected property %q", path, key)
+			}
+		case map[string]any:
+			if err := validateSchema(object[key], additional, path+"."+key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateArray(array []any, schema map[string]any, path string) error {
+	if minItems, ok := schemaNumber(schema, "minItems"); ok && float64(len(array)) < minItems {
+		return fmt.Errorf("%s: fewer than %v items", path, minItems)
+	}
+	if maxItems, ok := schemaNumber(schema, "maxItems"); ok && float64(len(array)) > maxItems {
+		return fmt.Errorf("%s: more than %v items", path, maxItems)
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range array {
+			if err := validateSchema(item, items, path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateCombinations(value any, schema map[string]any, path string) error {
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for _, subSchema := range allOf {
+			subSchemaMap, _ := subSchema.(map[string]any)
+			if err := validateSchema(value, subSchemaMap, path); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		if matches, firstErr := countMatches(value, anyOf, path, 1); matches == 0 && firstErr != nil {
+			return fmt.Errorf("%s: no anyOf alternative matches (first one: %w)", path, firstErr)
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		switch matches, firstErr := countMatches(value, oneOf, path, 2); {
+		case matches == 0 && firstErr != nil:
+			return fmt.Errorf("%s: no oneOf alternative matches (first one: %w)", path, firstErr)
+		case matches > 1:
+			return fmt.Errorf("%s: more than one oneOf alternative matches", path)
+		}
+	}
+	return nil
+}
+
+// countMatches counts the alternatives value matches, up to limit, along with the error of the
+// first one it does not match
+func countMatches(value any, alternatives []any, path string, limit int) (matches int, firstErr error) {
+	for _, alternative := range alternatives {
+		alternativeMap, _ := alternative.(map[string]any)
+		err := validateSchema(value, alternativeMap, path)
+		if err == nil {
+			if matches++; matches == limit {
+				return
+			}
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return
+}
+
+// schemaTypes returns the types allowed by a schema, if any
+func schemaTypes(schema map[string]any) (types []string) {
+	switch typ := schema["type"].(type) {
+	case string:
+		return []string{typ}
+	case []any:
+		for _, item := range typ {
+			if name, _ := item.(string); name != "" {
+				types = append(types, name)
+			}
+		}
+	}
+	return
+}
+
+func schemaNumber(schema map[string]any, keyword string) (float64, bool) {
+	number, ok := schema[keyword].(float64)
+	return number, ok
+}
+
+// matchesType returns true if a decoded JSON value is of the JSON schema type typ
+func matchesType(value any, typ string) bool {
+	switch typ {
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return jsonTypeName(value) == typ
+	}
+}
+
+// jsonTypeName returns the JSON schema type name of a decoded JSON value
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// jsonEqual compares decoded JSON values
+func jsonEqual(a, b any) bool {
+	switch typedA := a.(type) {
+	case []any:
+		typedB, ok := b.([]any)
+		return ok && slices.EqualFunc(typedA, typedB, jsonEqual)
+	case map[string]any:
+		typedB, ok := b.(map[string]any)
+		if !ok || len(typedA) != len(typedB) {
+			return false
+		}
+		for key, valueA := range typedA {
+			if valueB, found := typedB[key]; !found || !jsonEqual(valueA, valueB) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
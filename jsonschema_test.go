@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		value   string
+		wantErr string // empty if valid
+	}{
+		{"no schema", `null`, `{"a":1}`, ""},
+		{"type", `{"type":"string"}`, `1`, "arguments: expected string, got number"},
+		{"type list", `{"type":["integer","null"]}`, `null`, ""},
+		{"integer", `{"type":"integer"}`, `3.0`, ""},
+		{"not an integer", `{"type":"integer"}`, `3.5`, "arguments: expected integer, got number"},
+		{"enum", `{"enum":["c","f"]}`, `"k"`, "arguments: value is not one of the allowed values"},
+		{"enum object", `{"enum":[{"a":[1]}]}`, `{"a":[1]}`, ""},
+		{"const", `{"const":2}`, `2`, ""},
+		{"required", `{"type":"object","required":["city"]}`, `{}`, `arguments: missing required property "city"`},
+		{"nested property", `{"properties":{"a":{"properties":{"b":{"type":"boolean"}}}}}`, `{"a":{"b":"yes"}}`, "arguments.a.b: expected boolean, got string"},
+		{"additional properties denied", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1,"b":2}`, `arguments: unexpected property "b"`},
+		{"additional properties schema", `{"additionalProperties":{"type":"number"}}`, `{"a":"1"}`, "arguments.a: expected number, got string"},
+		{"items", `{"items":{"type":"string"}}`, `["a",2]`, "arguments[1]: expected string, got number"},
+		{"min items", `{"minItems":2}`, `[1]`, "arguments: fewer than 2 items"},
+		{"max items", `{"maxItems":1}`, `[1,2]`, "arguments: more than 1 items"},
+		{"min length in runes", `{"minLength":3}`, `"été"`, ""},
+		{"max length", `{"maxLength":2}`, `"abc"`, "arguments: string longer than 2"},
+		{"minimum", `{"minimum":0}`, `-1`, "arguments: -1 is lower than the minimum 0"},
+		{"maximum", `{"maximum":10}`, `11`, "arguments: 11 is greater than the maximum 10"},
+		{"allOf", `{"allOf":[{"type":"number"},{"minimum":5}]}`, `4`, "arguments: 4 is lower than the minimum 5"},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"type":"number"}]}`, `1`, ""},
+		{"anyOf several matches", `{"anyOf":[{"type":"number"},{"minimum":0}]}`, `1`, ""},
+		{"anyOf no match", `{"anyOf":[{"type":"string"},{"type":"boolean"}]}`, `1`, "arguments: no anyOf alternative matches (first one: arguments: expected string, got number)"},
+		{"oneOf", `{"oneOf":[{"type":"string"},{"type":"number"}]}`, `1`, ""},
+		{"oneOf several matches", `{"oneOf":[{"type":"number"},{"minimum":0}]}`, `1`, "arguments: more than one oneOf alternative matches"},
+		{"oneOf no match", `{"oneOf":[{"type":"string"}]}`, `1`, "arguments: no oneOf alternative matches (first one: arguments: expected string, got number)"},
+		{"unsupported keywords are ignored", `{"type":"string","format":"email","pattern":"^a"}`, `"b"`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema map[string]any
+			var value any
+			if err := json.Unmarshal([]byte(tt.schema), &schema); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatal(err)
+			}
+			err := validateSchema(value, schema, "arguments")
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type responseControllerKeyType struct{}
+
+// responseControllerKey is the request context key holding the controller of the server
+// response writer: the httplog wrapper only flushes streaming content types.
+var responseControllerKey responseControllerKeyType
+
+// withResponseController makes the controller of the server response writer available to next
+func withResponseController(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), responseControllerKey, http.NewResponseController(w))
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// flushResponse sends the buffered response data to the client
+func flushResponse(ctx context.Context) error {
+	controller, ok := ctx.Value(responseControllerKey).(*http.ResponseController)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return controller.Flush()
+}
+
+var jsonKeepAliveSpace = []byte(" ")
+
+// jsonKeepAliveWriter keeps long non-streaming responses alive: a 200 JSON response header is
+// sent right away, then a space every interval until the actual response is written (leading
+// whitespace is valid before a JSON document). The actual status code cannot be sent anymore,
+// errors are reported by the OpenAI error object of the body.
+type jsonKeepAliveWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	logger      *slog.Logger
+	header      http.Header // actual response headers, too late to be sent
+	statusCode  int
+	bodyStarted bool
+	stopOnce    sync.Once
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+func newJSONKeepAliveWriter(ctx context.Context, w http.ResponseWriter, interval time.Duration, logger *slog.Logger) *jsonKeepAliveWriter {
+	kw := &jsonKeepAliveWriter{
+		ResponseWriter: w,
+		ctx:            ctx,
+		logger:         logger,
+		header:         make(http.Header),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	go kw.run(interval)
+	return kw
+}
+
+func (kw *jsonKeepAliveWriter) run(interval time.Duration) {
+	defer close(kw.stopped)
+	if err := flushResponse(kw.ctx); err != nil {
+		kw.logger.Warn("failed to send the JSON keepalive response header", slog.Any("error", err))
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, err := kw.ResponseWriter.Write(jsonKeepAliveSpace)
+			if err == nil {
+				err = flushResponse(kw.ctx)
+			}
+			if err != nil {
+				kw.logger.Debug("failed to write JSON keepalive", slog.Any("error", err))
+				return
+			}
+		case <-kw.done:
+			return
+		}
+	}
+}
+
+// stop stops the keepalive, waiting for an ongoing write. It must be called before the handler returns.
+func (kw *jsonKeepAliveWriter) stop() {
+	kw.stopOnce.Do(func() {
+		close(kw.done)
+		<-kw.stopped
+	})
+}
+
+// Header returns the headers of the actual response, they are not sent
+func (kw *jsonKeepAliveWriter) Header() http.Header {
+	return kw.header
+}
+
+// WriteHeader records the status of the actual response, the 200 status being already sent
+func (kw *jsonKeepAliveWriter) WriteHeader(statusCode int) {
+	kw.stop()
+	kw.statusCode = statusCode
+	if statusCode >= http.StatusBadRequest {
+		kw.logger.Warn("response status already sent by the JSON keepalive, reporting the error in the body",
+			slog.Int("status", statusCode),
+		)
+	}
+}
+
+// Write writes the actual response body. Error bodies are expected in a single call:
+// they are replaced by an OpenAI error object if they are not one already.
+func (kw *jsonKeepAliveWriter) Write(payload []byte) (int, error) {
+	kw.stop()
+	if !kw.bodyStarted && kw.statusCode >= http.StatusBadRequest {
+		kw.bodyStarted = true
+		if start, _, found := findTopLevelValue(payload, "error"); !found || payload[start] != '{' {
+			errorBody, err := json.Marshal(openAIError(kw.ctx, kw.statusCode))
+			if err != nil {
+				return 0, err
+			}
+			if _, err = kw.ResponseWriter.Write(errorBody); err != nil {
+				return 0, err
+			}
+			return len(payload), nil
+		}
+	}
+	kw.bodyStarted = true
+	return kw.ResponseWriter.Write(payload)
+}
+
+// sseKeepAliveWriter keeps streaming requests alive until the backend response header is
+// received, prefill and queueing taking minutes on large prompts: once the backend has been
+// silent for interval, a 200 event stream response header is sent, then a keepalive comment
+// every interval until the actual response starts. The actual status code cannot be sent
+// anymore, errors are then reported by an OpenAI error event followed by [DONE].
+type sseKeepAliveWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	logger      *slog.Logger
+	header      http.Header // actual response headers, sent unless the keepalive already sent its own
+	headerSent  bool        // by the keepalive, only read once it is stopped
+	wroteHeader bool
+	statusCode  int
+	errorSent   bool
+	stopOnce    sync.Once
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+func newSSEKeepAliveWriter(ctx context.Context, w http.ResponseWriter, interval time.Duration, logger *slog.Logger) *sseKeepAliveWriter {
+	kw := &sseKeepAliveWriter{
+		ResponseWriter: w,
+		ctx:            ctx,
+		logger:         logger,
+		header:         make(http.Header),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	go kw.run(interval)
+	return kw
+}
+
+func (kw *sseKeepAliveWriter) run(interval time.Duration) {
+	defer close(kw.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !kw.headerSent {
+				kw.logger.Debug("backend response header still pending, sending the stream response header")
+				kw.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+				kw.ResponseWriter.Header().Set("Cache-Control", "no-cache")
+				kw.ResponseWriter.WriteHeader(http.StatusOK)
+				kw.headerSent = true
+			}
+			_, err := kw.ResponseWriter.Write(sseKeepAliveComment)
+			if err == nil {
+				err = flushResponse(kw.ctx)
+			}
+			if err != nil {
+				kw.logger.Debug("failed to write SSE keepalive comment", slog.Any("error", err))
+				return
+			}
+		case <-kw.done:
+			return
+		}
+	}
+}
+
+// stop stops the keepalive, waiting for an ongoing write. It must be called before the handler returns.
+func (kw *sseKeepAliveWriter) stop() {
+	kw.stopOnce.Do(func() {
+		close(kw.done)
+		<-kw.stopped
+	})
+}
+
+// Header returns the headers of the actual response
+func (kw *sseKeepAliveWriter) Header() http.Header {
+	return kw.header
+}
+
+// WriteHeader sends the actual response header, or records its status if the keepalive
+// already sent its own
+func (kw *sseKeepAliveWriter) WriteHeader(statusCode int) {
+	kw.stop()
+	if kw.wroteHeader {
+		return
+	}
+	kw.wroteHeader = true
+	kw.statusCode = statusCode
+	if !kw.headerSent {
+		maps.Copy(kw.ResponseWriter.Header(), kw.header)
+		kw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	if statusCode >= http.StatusBadRequest {
+		kw.logger.Warn("response status already sent by the SSE keepalive, reporting the error in the stream",
+			slog.Int("status", statusCode),
+		)
+	}
+}
+
+// Write writes the actual response body. Once the keepalive sent the response header, error
+// bodies are expected in a single call: they are replaced by an error event and [DONE].
+func (kw *sseKeepAliveWriter) Write(payload []byte) (int, error) {
+	if !kw.wroteHeader {
+		kw.WriteHeader(http.StatusOK)
+	}
+	if !kw.headerSent || kw.statusCode < http.StatusBadRequest {
+		return kw.ResponseWriter.Write(payload)
+	}
+	if kw.errorSent {
+		return len(payload), nil
+	}
+	kw.errorSent = true
+	// Keep the error object of the body if any, on a single data line
+	var errorBody bytes.Buffer
+	if start, _, found := findTopLevelValue(payload, "error"); !found || payload[start] != '{' ||
+		json.Compact(&errorBody, payload) != nil {
+		errorBody.Reset()
+		if err := json.NewEncoder(&errorBody).Encode(openAIError(kw.ctx, kw.statusCode)); err != nil {
+			return 0, err
+		}
+	}
+	var event sseEvent
+	var events []byte
+	for _, data := range [][]byte{bytes.TrimSpace(errorBody.Bytes()), sseDone} {
+		event.setData(data)
+		events = event.appendTo(events)
+	}
+	if _, err := kw.ResponseWriter.Write(events); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
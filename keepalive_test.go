@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hekmon/httplog/v3"
+)
+
+// keepAliveRecorder records a response, counting the response headers sent
+type keepAliveRecorder struct {
+	*httptest.ResponseRecorder
+	headers int
+}
+
+func (kr *keepAliveRecorder) WriteHeader(statusCode int) {
+	kr.headers++
+	kr.ResponseRecorder.WriteHeader(statusCode)
+}
+
+// newKeepAliveRecorder returns a recorder and a request context holding its controller
+func newKeepAliveRecorder() (*keepAliveRecorder, context.Context) {
+	recorder := &keepAliveRecorder{ResponseRecorder: httptest.NewRecorder()}
+	ctx := context.WithValue(context.Background(), httplog.ReqIDKey, uint64(42))
+	ctx = context.WithValue(ctx, responseControllerKey, http.NewResponseController(recorder))
+	return recorder, ctx
+}
+
+// keepAliveIdle lets a keepalive writer with a 10ms interval send a few keepalives
+func keepAliveIdle() {
+	time.Sleep(55 * time.Millisecond)
+}
+
+func TestJSONKeepAliveWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{
+			name:   "success",
+			status: http.StatusOK,
+			body:   `{"id":"chatcmpl-1","choices":[]}`,
+			want:   `{"id":"chatcmpl-1","choices":[]}`,
+		},
+		{
+			name:   "OpenAI error kept",
+			status: http.StatusBadRequest,
+			body:   `{"error":{"message":"context too long","code":400}}`,
+			want:   `{"error":{"message":"context too long","code":400}}`,
+		},
+		{
+			name:   "plain error replaced",
+			status: http.StatusBadGateway,
+			body:   "upstream connect error",
+			want:   `{"error":{"message":"Bad Gateway - check qwen35-rp logs for more details (request id #42)","type":"Bad Gateway","code":502}}`,
+		},
+		{
+			name:   "error without error object replaced",
+			status: http.StatusInternalServerError,
+			body:   `{"detail":"boom"}`,
+			want:   `{"error":{"message":"Internal Server Error - check qwen35-rp logs for more details (request id #42)","type":"Internal Server Error","code":500}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, ctx := newKeepAliveRecorder()
+			kw := newJSONKeepAliveWriter(ctx, recorder, 10*time.Millisecond, slog.New(slog.DiscardHandler))
+			keepAliveIdle()
+			kw.Header().Set("Content-Type", "text/plain")
+			kw.Header().Set("X-Backend", "vllm")
+			kw.WriteHeader(tc.status)
+			if n, err := kw.Write([]byte(tc.body)); err != nil || n != len(tc.body) {
+				t.Fatalf("got write %d %v", n, err)
+			}
+			kw.stop()
+			// The 200 JSON response header is sent once, before the keepalives
+			if recorder.headers != 1 || recorder.Code != http.StatusOK {
+				t.Errorf("got %d headers, status %d", recorder.headers, recorder.Code)
+			}
+			if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("got content type %q", got)
+			}
+			if got := recorder.Header().Get("X-Backend"); got != "" {
+				t.Errorf("actual header sent: %q", got)
+			}
+			body := recorder.Body.String()
+			trimmed := strings.TrimLeft(body, " ")
+			if len(body)-len(trimmed) < 2 {
+				t.Errorf("got %d keepalive spaces, want several", len(body)-len(trimmed))
+			}
+			if !json.Valid([]byte(body)) {
+				t.Errorf("body is not a valid JSON document: %q", body)
+			}
+			if got, want := normalizeJSON(t, []byte(trimmed)), normalizeJSON(t, []byte(tc.want)); got != want {
+				t.Errorf("got body %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestJSONKeepAliveWriterFastResponse(t *testing.T) {
+	recorder, ctx := newKeepAliveRecorder()
+	kw := newJSONKeepAliveWriter(ctx, recorder, time.Hour, slog.New(slog.DiscardHandler))
+	kw.WriteHeader(http.StatusOK)
+	kw.Write([]byte(`{"id":"chatcmpl-1"}`))
+	kw.stop()
+	// The header is flushed right away, the body follows without keepalive
+	if recorder.headers != 1 || !recorder.Flushed {
+		t.Errorf("got %d headers, flushed %v", recorder.headers, recorder.Flushed)
+	}
+	if got := recorder.Body.String(); got != `{"id":"chatcmpl-1"}` {
+		t.Errorf("got body %q", got)
+	}
+}
+
+func TestSSEKeepAliveWriter(t *testing.T) {
+	const openAIErrorEvent = `data: {"error":{"code":503,"message":"Service Unavailable - check qwen35-rp logs for more details (request id #42)","type":"Service Unavailable"}}` + "\n\n"
+	for _, tc := range []struct {
+		name           string
+		idle           bool // the backend response header comes after a few keepalives
+		status         int
+		writes         []string
+		wantStatus     int
+		wantKeepAlives bool
+		wantBody       string
+		wantHeader     string // X-Backend header of the response
+	}{
+		{
+			name:       "fast stream",
+			status:     http.StatusOK,
+			writes:     []string{"data: {\"id\":\"1\"}\n\n", "data: [DONE]\n\n"},
+			wantStatus: http.StatusOK,
+			wantBody:   "data: {\"id\":\"1\"}\n\ndata: [DONE]\n\n",
+			wantHeader: "vllm",
+		},
+		{
+			name:       "fast error",
+			status:     http.StatusBadRequest,
+			writes:     []string{`{"error":{"message":"bad"}}`},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"message":"bad"}}`,
+			wantHeader: "vllm",
+		},
+		{
+			name:           "slow stream",
+			idle:           true,
+			status:         http.StatusOK,
+			writes:         []string{"data: {\"id\":\"1\"}\n\n", "data: [DONE]\n\n"},
+			wantStatus:     http.StatusOK,
+			wantKeepAlives: true,
+			wantBody:       "data: {\"id\":\"1\"}\n\ndata: [DONE]\n\n",
+		},
+		{
+			name:           "slow OpenAI error",
+			idle:           true,
+			status:         http.StatusBadRequest,
+			writes:         []string{"{\n  \"error\": {\"message\": \"context too long\", \"code\": 400}\n}\n", "ignored"},
+			wantStatus:     http.StatusOK,
+			wantKeepAlives: true,
+			wantBody:       `data: {"error":{"message":"context too long","code":400}}` + "\n\ndata: [DONE]\n\n",
+		},
+		{
+			name:           "slow plain error",
+			idle:           true,
+			status:         http.StatusServiceUnavailable,
+			writes:         []string{"no healthy upstream"},
+			wantStatus:     http.StatusOK,
+			wantKeepAlives: true,
+			wantBody:       openAIErrorEvent + "data: [DONE]\n\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, ctx := newKeepAliveRecorder()
+			kw := newSSEKeepAliveWriter(ctx, recorder, 10*time.Millisecond, slog.New(slog.DiscardHandler))
+			if tc.idle {
+				keepAliveIdle()
+			}
+			kw.Header().Set("X-Backend", "vllm")
+			kw.WriteHeader(tc.status)
+			for _, write := range tc.writes {
+				if n, err := kw.Write([]byte(write)); err != nil || n != len(write) {
+					t.Fatalf("got write %d %v", n, err)
+				}
+			}
+			kw.stop()
+			if recorder.headers != 1 || recorder.Code != tc.wantStatus {
+				t.Errorf("got %d headers, status %d, want one with status %d", recorder.headers, recorder.Code, tc.wantStatus)
+			}
+			if got := recorder.Header().Get("X-Backend"); got != tc.wantHeader {
+				t.Errorf("got X-Backend header %q, want %q", got, tc.wantHeader)
+			}
+			body := recorder.Body.String()
+			var keepAlives int
+			for strings.HasPrefix(body, string(sseKeepAliveComment)) {
+				body = body[len(sseKeepAliveComment):]
+				keepAlives++
+			}
+			if (keepAlives > 0) != tc.wantKeepAlives {
+				t.Errorf("got %d keepalive comments", keepAlives)
+			}
+			if tc.wantKeepAlives {
+				if got := recorder.Header().Get("Content-Type"); got != "text/event-stream" {
+					t.Errorf("got content type %q", got)
+				}
+			}
+			if body != tc.wantBody {
+				t.Errorf("got body %q, want %q", body, tc.wantBody)
+			}
+		})
+	}
+}
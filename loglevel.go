@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hekmon/httplog/v3"
+)
+
+// debugLogHeader allows trusted callers to raise the log level of a single request
+const debugLogHeader = "X-Debug-Log"
+
+type debugLogKeyType struct{}
+
+// debugLogKey is the request context key holding the log level requested with debugLogHeader
+var debugLogKey debugLogKeyType
+
+// logLevel is the dynamic level of the root logger
+var logLevel = new(slog.LevelVar)
+
+// sensitiveDumpsWarning is logged whenever the COMPLETE level is enabled without redaction
+const sensitiveDumpsWarning = "COMPLETE log level enabled - full request/response bodies will be logged, including potentially sensitive data"
+
+// levelName returns the name of a log level, including the COMPLETE level
+func levelName(level slog.Level) string {
+	if level == COMPLETE {
+		return COMPLETE_LEVEL
+	}
+	return level.String()
+}
+
+// validLogLevel parses a log level name, returning an error for unknown levels
+func validLogLevel(levelStr string) (slog.Level, error) {
+	switch strings.ToUpper(levelStr) {
+	case COMPLETE_LEVEL, "DEBUG", "INFO", "WARN", "ERROR":
+		return parseLogLevel(levelStr), nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", levelStr)
+	}
+}
+
+// logLevelController changes the root logger level at runtime, optionally
+// reverting to the configured level after a while.
+type logLevelController struct {
+	defaultLevel  slog.Level
+	defaultRevert time.Duration
+	redactDumps   bool
+	mu            sync.Mutex
+	revertTimer   *time.Timer
+	revertAt      time.Time
+}
+
+func newLogLevelController(defaultLevel slog.Level, defaultRevert time.Duration, redactDumps bool) *logLevelController {
+	logLevel.Set(defaultLevel)
+	return &logLevelController{
+		defaultLevel:  defaultLevel,
+		defaultRevert: defaultRevert,
+		redactDumps:   redactDumps,
+	}
+}
+
+// set changes the log level. If revertAfter is positive and level differs from
+// the configured one, the configured level is restored after revertAfter.
+func (llc *logLevelController) set(level slog.Level, revertAfter time.Duration) {
+	llc.mu.Lock()
+	defer llc.mu.Unlock()
+	if llc.revertTimer != nil {
+		llc.revertTimer.Stop()
+		llc.revertTimer = nil
+		llc.revertAt = time.Time{}
+	}
+	previous := logLevel.Level()
+	logLevel.Set(level)
+	if revertAfter > 0 && level != llc.defaultLevel {
+		llc.revertAt = time.Now().Add(revertAfter)
+		llc.revertTimer = time.AfterFunc(revertAfter, llc.reset)
+	}
+	logger.Warn("log level changed",
+		slog.String("previous", levelName(previous)),
+		slog.String("current", levelName(level)),
+		slog.Duration("revert_after", revertAfter),
+	)
+	if level <= COMPLETE && previous > COMPLETE && !llc.redactDumps {
+		logger.Warn(sensitiveDumpsWarning, slog.Duration("revert_after", revertAfter))
+	}
+}
+
+// reset restores the configured log level
+func (llc *logLevelController) reset() {
+	llc.set(llc.defaultLevel, 0)
+}
+
+// raise makes the log level one step more verbose, down to COMPLETE
+func (llc *logLevelController) raise() {
+	switch current := logLevel.Level(); {
+	case current > slog.LevelDebug:
+		llc.set(max(current-4, slog.LevelDebug), llc.defaultRevert)
+	case current > COMPLETE:
+		llc.set(COMPLETE, llc.defaultRevert)
+	default:
+		logger.Warn("log level already at its most verbose", slog.String("current", levelName(current)))
+	}
+}
+
+// handleSignals raises the log level on SIGUSR1 and restores the configured one on SIGUSR2
+func (llc *logLevelController) handleSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGUSR1 {
+				llc.raise()
+			} else {
+				llc.reset()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type logLevelState struct {
+	Level    string     `json:"level"`
+	Default  string     `json:"default"`
+	RevertAt *time.Time `json:"revert_at,omitempty"`
+}
+
+type logLevelChange struct {
+	Level       string `json:"level"`
+	RevertAfter string `json:"revert_after"`
+}
+
+// handler exposes the log level: GET returns it, PUT changes it
+func (llc *logLevelController) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var change logLevelChange
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&change); err != nil {
+			http.Error(w, fmt.Sprintf("invalid body: %s", err), http.StatusBadRequest)
+			return
+		}
+		level, err := validLogLevel(change.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		revertAfter := llc.defaultRevert
+		if change.RevertAfter != "" {
+			if revertAfter, err = time.ParseDuration(change.RevertAfter); err != nil {
+				http.Error(w, fmt.Sprintf("invalid revert_after: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		llc.set(level, revertAfter)
+	}
+	llc.mu.Lock()
+	state := logLevelState{
+		Level:   levelName(logLevel.Level()),
+		Default: levelName(llc.defaultLevel),
+	}
+	if !llc.revertAt.IsZero() {
+		revertAt := llc.revertAt
+		state.RevertAt = &revertAt
+	}
+	llc.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		logger.Error("failed to write log level response", slog.Any("error", err))
+	}
+}
+
+// debugLogHandler is a slog.Handler enabling records below the root logger level
+// when a per-request log level has been set.
+type debugLogHandler struct {
+	next   slog.Handler
+	forced *slog.Level
+}
+
+func (h *debugLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.forced != nil && level >= *h.forced {
+		return true
+	}
+	if forced, ok := ctx.Value(debugLogKey).(slog.Level); ok && level >= forced {
+		return true
+	}
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *debugLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.next.Handle(ctx, record)
+}
+
+func (h *debugLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &debugLogHandler{next: h.next.WithAttrs(attrs), forced: h.forced}
+}
+
+func (h *debugLogHandler) WithGroup(name string) slog.Handler {
+	return &debugLogHandler{next: h.next.WithGroup(name), forced: h.forced}
+}
+
+// requestLogger returns the logger to use within a request handler: it carries the
+// request ID and honors the per-request log level requested with debugLogHeader.
+func requestLogger(ctx context.Context) *slog.Logger {
+	reqLogger := logger.With(httplog.GetReqIDSLogAttr(ctx))
+	if forced, ok := ctx.Value(debugLogKey).(slog.Level); ok {
+		return slog.New(&debugLogHandler{next: reqLogger.Handler(), forced: &forced})
+	}
+	return reqLogger
+}
+
+// debugLogMiddleware honors debugLogHeader for callers within trusted prefixes.
+// The header is never forwarded to the backend.
+func debugLogMiddleware(trusted []netip.Prefix, redactDumps bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested := r.Header.Get(debugLogHeader)
+		if requested == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(debugLogHeader)
+		if !trustedCaller(r.RemoteAddr, trusted) {
+			logger.Warn("ignoring debug log header from untrusted caller", slog.String("client", r.RemoteAddr))
+			next.ServeHTTP(w, r)
+			return
+		}
+		level := slog.LevelDebug
+		if strings.EqualFold(requested, COMPLETE_LEVEL) {
+			level = COMPLETE
+			if !redactDumps {
+				logger.Warn(sensitiveDumpsWarning,
+					slog.String("client", r.RemoteAddr),
+					slog.String("URI", r.URL.RequestURI()),
+				)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), debugLogKey, level)))
+	})
+}
+
+// trustedCaller returns true if remoteAddr belongs to one of the trusted prefixes
+func trustedCaller(remoteAddr string, trusted []netip.Prefix) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses a comma separated list of CIDR prefixes
+func parsePrefixes(raw string) (prefixes []netip.Prefix, err error) {
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR prefix %q: %w", item, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
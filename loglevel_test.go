@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects the text output of the root logger, safe for concurrent use
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *logBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+// captureLogs replaces the root logger and its level for the duration of the test
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	previousLogger, previousLevel := logger, logLevel.Level()
+	t.Cleanup(func() {
+		logger = previousLogger
+		logLevel.Set(previousLevel)
+	})
+	output := new(logBuffer)
+	logger = slog.New(slog.NewTextHandler(output, &slog.HandlerOptions{Level: COMPLETE}))
+	return output
+}
+
+func TestLogLevelController(t *testing.T) {
+	for _, redactDumps := range []bool{false, true} {
+		output := captureLogs(t)
+		llc := newLogLevelController(slog.LevelInfo, 0, redactDumps)
+		for _, step := range []struct {
+			action func()
+			want   slog.Level
+		}{
+			{llc.raise, slog.LevelDebug},
+			{llc.raise, COMPLETE},
+			{llc.raise, COMPLETE},
+			{llc.reset, slog.LevelInfo},
+			{func() { llc.set(slog.LevelError, 0) }, slog.LevelError},
+			{llc.raise, slog.LevelWarn},
+			{func() { llc.set(COMPLETE, 0) }, COMPLETE},
+			{func() { llc.set(COMPLETE, 0) }, COMPLETE},
+		} {
+			step.action()
+			if got := logLevel.Level(); got != step.want {
+				t.Fatalf("redact %v: got level %s, want %s", redactDumps, levelName(got), levelName(step.want))
+			}
+		}
+		if !strings.Contains(output.String(), "log level already at its most verbose") {
+			t.Errorf("redact %v: raising past COMPLETE not logged", redactDumps)
+		}
+		// Warned each time COMPLETE is entered, only without redaction
+		want := 2
+		if redactDumps {
+			want = 0
+		}
+		if got := strings.Count(output.String(), sensitiveDumpsWarning); got != want {
+			t.Errorf("redact %v: got %d sensitive data warnings, want %d", redactDumps, got, want)
+		}
+	}
+}
+
+func TestLogLevelControllerRevert(t *testing.T) {
+	captureLogs(t)
+	llc := newLogLevelController(slog.LevelInfo, time.Hour, false)
+	// Restoring the configured level never schedules a revert
+	llc.set(slog.LevelInfo, time.Hour)
+	if !llc.revertAt.IsZero() {
+		t.Error("revert scheduled for the configured level")
+	}
+	// Signals use the default revert delay
+	llc.raise()
+	if llc.revertAt.IsZero() || time.Until(llc.revertAt) < 59*time.Minute {
+		t.Errorf("got revert at %v, want in an hour", llc.revertAt)
+	}
+	// A new change replaces the scheduled revert
+	llc.set(COMPLETE, 10*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for logLevel.Level() != slog.LevelInfo {
+		if time.Now().After(deadline) {
+			t.Fatalf("level not reverted: %s", levelName(logLevel.Level()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	llc.mu.Lock()
+	defer llc.mu.Unlock()
+	if !llc.revertAt.IsZero() || llc.revertTimer != nil {
+		t.Error("revert still scheduled once reverted")
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	captureLogs(t)
+	llc := newLogLevelController(slog.LevelWarn, 0, true)
+	defer llc.reset()
+	call := func(method, body string) (int, logLevelState) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		llc.handler(rec, httptest.NewRequest(method, "/admin/loglevel", strings.NewReader(body)))
+		var state logLevelState
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+				t.Fatalf("invalid body %q: %v", rec.Body, err)
+			}
+		}
+		return rec.Code, state
+	}
+	if code, state := call(http.MethodGet, ""); code != http.StatusOK || state.Level != "WARN" || state.Default != "WARN" || state.RevertAt != nil {
+		t.Errorf("GET: got HTTP %d %+v", code, state)
+	}
+	if code, state := call(http.MethodPut, `{"level":"complete","revert_after":"1h"}`); code != http.StatusOK || state.Level != COMPLETE_LEVEL || state.RevertAt == nil {
+		t.Errorf("PUT: got HTTP %d %+v", code, state)
+	}
+	for _, body := range []string{`{"level":"TRACE"}`, `{"level":"DEBUG","revert_after":"soon"}`, `not json`} {
+		if code, _ := call(http.MethodPut, body); code != http.StatusBadRequest {
+			t.Errorf("PUT %s: got HTTP %d, want 400", body, code)
+		}
+	}
+	if got := logLevel.Level(); got != COMPLETE {
+		t.Errorf("invalid changes applied: level %s", levelName(got))
+	}
+}
+
+func TestTrustedCaller(t *testing.T) {
+	trusted, err := parsePrefixes("127.0.0.0/8, ::1/128,,10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for remoteAddr, want := range map[string]bool{
+		"127.0.0.1:5000":        true,
+		"[::1]:5000":            true,
+		"[::ffff:10.1.2.3]:443": true,
+		"10.1.2.3":              true,
+		"10.2.0.1:5000":         false,
+		"[2001:db8::1]:5000":    false,
+		"not an address":        false,
+	} {
+		if got := trustedCaller(remoteAddr, trusted); got != want {
+			t.Errorf("%s: got %v, want %v", remoteAddr, got, want)
+		}
+	}
+	if _, err = parsePrefixes("10.0.0.0/33"); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+}
+
+func TestDebugLogHandler(t *testing.T) {
+	next := slog.NewTextHandler(new(bytes.Buffer), &slog.HandlerOptions{Level: slog.LevelInfo})
+	handler := &debugLogHandler{next: next}
+	ctx := context.Background()
+	if handler.Enabled(ctx, slog.LevelDebug) || !handler.Enabled(ctx, slog.LevelInfo) {
+		t.Error("root level not honored without a requested level")
+	}
+	debugCtx := context.WithValue(ctx, debugLogKey, slog.LevelDebug)
+	if !handler.Enabled(debugCtx, slog.LevelDebug) || handler.Enabled(debugCtx, COMPLETE) {
+		t.Error("level requested in the context not honored")
+	}
+	forced := COMPLETE
+	derived := (&debugLogHandler{next: next, forced: &forced}).WithAttrs([]slog.Attr{slog.String("k", "v")}).WithGroup("g")
+	if !derived.Enabled(ctx, COMPLETE) {
+		t.Error("forced level lost by derived handlers")
+	}
+}
+
+func TestDebugLogMiddleware(t *testing.T) {
+	trusted, _ := parsePrefixes("127.0.0.0/8")
+	for _, tc := range []struct {
+		name        string
+		remoteAddr  string
+		header      string
+		redactDumps bool
+		wantLevel   string // name of the level of the request, empty for none
+		wantWarning bool
+	}{
+		{name: "no header", remoteAddr: "127.0.0.1:5000"},
+		{name: "untrusted", remoteAddr: "10.0.0.1:5000", header: "COMPLETE"},
+		{name: "debug", remoteAddr: "127.0.0.1:5000", header: "1", wantLevel: "DEBUG"},
+		{name: "complete", remoteAddr: "127.0.0.1:5000", header: "complete", wantLevel: COMPLETE_LEVEL, wantWarning: true},
+		{name: "complete redacted", remoteAddr: "127.0.0.1:5000", header: "COMPLETE", redactDumps: true, wantLevel: COMPLETE_LEVEL},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			output := captureLogs(t)
+			var gotLevel string
+			var forwarded string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if level, ok := r.Context().Value(debugLogKey).(slog.Level); ok {
+					gotLevel = levelName(level)
+				}
+				forwarded = r.Header.Get(debugLogHeader)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.header != "" {
+				req.Header.Set(debugLogHeader, tc.header)
+			}
+			debugLogMiddleware(trusted, tc.redactDumps, next).ServeHTTP(httptest.NewRecorder(), req)
+			if forwarded != "" {
+				t.Errorf("header forwarded: %q", forwarded)
+			}
+			if gotLevel != tc.wantLevel {
+				t.Errorf("got level %q, want %q", gotLevel, tc.wantLevel)
+			}
+			if got := strings.Contains(output.String(), sensitiveDumpsWarning); got != tc.wantWarning {
+				t.Errorf("got sensitive data warning %v, want %v", got, tc.wantWarning)
+			}
+		})
+	}
+}
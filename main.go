@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -18,6 +20,7 @@ import (
 	autoslog "github.com/iguanesolutions/auto-slog/v2"
 	sysd "github.com/iguanesolutions/go-systemd/v6"
 	sysdnotify "github.com/iguanesolutions/go-systemd/v6/notify"
+	sysdwatchdog "github.com/iguanesolutions/go-systemd/v6/notify/watchdog"
 )
 
 const (
@@ -35,17 +38,34 @@ func main() {
 		log.Fatalf("load config: %s\n", err)
 	}
 
-	// Init
+	// Init, the log level can be changed at runtime
+	logLevelCtrl := newLogLevelController(parseLogLevel(cfg.LogLevel), cfg.LogLevelRevert, cfg.RedactDumps)
 	logger = autoslog.NewLogger(slog.HandlerOptions{
 		AddSource: true,
-		Level:     parseLogLevel(cfg.LogLevel),
+		Level:     logLevel,
 	})
-	// Warn if COMPLETE log level is enabled
-	if cfg.LogLevel == COMPLETE_LEVEL {
-		logger.Warn("COMPLETE log level enabled - full request/response bodies will be logged, including potentially sensitive data",
+	// Redact dumped bodies if requested, otherwise warn if COMPLETE log level is enabled (runtime
+	// changes to COMPLETE log the same warning)
+	if cfg.RedactDumps {
+		redactRules, err := parseRedactRules(cfg.RedactRules)
+		if err != nil {
+			log.Fatalf("parse redact rules: %s\n", err)
+		}
+		logger = slog.New(newRedactHandler(logger.Handler(), redactRules))
+		logger.Info("logged request/response bodies will be redacted",
+			slog.Int("rules", len(redactRules)),
+		)
+	} else if cfg.LogLevel == COMPLETE_LEVEL {
+		logger.Warn(sensitiveDumpsWarning,
 			slog.String("log_level", cfg.LogLevel),
 		)
 	}
+	// Allow per-request log levels (X-Debug-Log header)
+	logger = slog.New(&debugLogHandler{next: logger.Handler()})
+	debugLogTrusted, err := parsePrefixes(cfg.DebugLogTrustedCIDRs)
+	if err != nil {
+		log.Fatalf("parse debug log trusted CIDRs: %s\n", err)
+	}
 	backendURL, err := url.Parse(cfg.Target)
 	if err != nil {
 		logger.Error("failed to parse backend URL", slog.Any("error", err))
@@ -53,69 +73,118 @@ func main() {
 	}
 
 	// Define HTTP handlers and middleware
-	httplogger := httplog.New(logger, &httplog.Config{
+	httplogConfig := &httplog.Config{
 		RequestDumpLogLevel:  COMPLETE,
 		ResponseDumpLogLevel: COMPLETE,
-	})
+	}
+	if cfg.RedactDumps {
+		// Redacted dumps are meant for production: bound them and mask the credentials
+		httplogConfig.BodyMaxRead = maxDumpBodySize
+		httplogConfig.SanitizeHeaders = sensitiveHeaders
+	}
+	httplogger := httplog.New(logger, httplogConfig)
 	// Create pooled HTTP client for forwarding requests
 	httpClient := cleanhttp.DefaultPooledClient()
+	// Public handlers, dedicated mux to never expose anything registered on the default one
+	mux := http.NewServeMux()
 	// Explicit handlers for POST paths that need transformation
-	http.HandleFunc("POST /tokenize", httplogger.LogFunc(
+	mux.HandleFunc("POST /tokenize", trackInFlight(httplogger.LogFunc(
 		tokenize(httpClient, backendURL,
 			cfg.ServedModelName, cfg.ThinkingGeneralModel, cfg.ThinkingCodingModel,
 			cfg.InstructGeneralModel, cfg.InstructReasoningModel,
 		),
-	))
-	http.HandleFunc("POST /v1/responses", httplogger.LogFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w,
-			"responses endpoint on vLLM does not support kwargs to activate Qwen profiles",
-			http.StatusNotImplemented,
-		)
-	}))
-	http.HandleFunc("POST /v1/chat/completions", httplogger.LogFunc(
-		transform(httpClient, backendURL,
-			cfg.ServedModelName, cfg.ThinkingGeneralModel, cfg.ThinkingCodingModel,
-			cfg.InstructGeneralModel, cfg.InstructReasoningModel, cfg.EnforceSamplingParams,
-		),
-	))
-	http.HandleFunc("POST /v1/completions", httplogger.LogFunc(
-		legacyCompletions(httpClient, backendURL,
-			cfg.ServedModelName, cfg.ThinkingGeneralModel, cfg.ThinkingCodingModel,
-			cfg.InstructGeneralModel, cfg.InstructReasoningModel,
-		),
-	))
+	)))
+	// Responses are translated to chat completions: vLLM's own endpoint ignores the kwargs activating Qwen profiles
+	var store *responseStore
+	if cfg.ResponseStoreTTL > 0 {
+		if store, err = newResponseStore(cfg.ResponseStoreTTL, cfg.ResponseStoreDir, cfg.ResponseStoreReasoning); err != nil {
+			logger.Error("failed to initialize the response store", slog.Any("error", err))
+			os.Exit(1)
+		}
+		mux.HandleFunc("GET /v1/responses/{id}", httplogger.LogFunc(retrieveStored(store, "resp_")))
+		mux.HandleFunc("DELETE /v1/responses/{id}", httplogger.LogFunc(deleteStored(store, "resp_", "response")))
+		mux.HandleFunc("POST /v1/conversations", httplogger.LogFunc(createConversation(store)))
+		mux.HandleFunc("GET /v1/conversations/{id}", httplogger.LogFunc(retrieveStored(store, "conv_")))
+		mux.HandleFunc("DELETE /v1/conversations/{id}", httplogger.LogFunc(deleteStored(store, "conv_", "conversation.deleted")))
+		mux.HandleFunc("GET /v1/conversations/{id}/items", httplogger.LogFunc(listConversationItems(store)))
+	}
+	chatCompletions := transform(httpClient, backendURL, cfg)
+	mux.HandleFunc("POST /v1/responses", trackInFlight(withResponseController(httplogger.LogFunc(
+		responses(chatCompletions, store),
+	))))
+	mux.HandleFunc("POST /v1/chat/completions", trackInFlight(withResponseController(httplogger.LogFunc(
+		chatCompletions,
+	))))
+	mux.HandleFunc("POST /v1/completions", trackInFlight(withResponseController(httplogger.LogFunc(
+		legacyCompletions(httpClient, backendURL, cfg),
+	))))
 	// Models endpoint handler (enriches backend models with virtual model names)
-	http.HandleFunc("GET /v1/models", httplogger.LogFunc(
+	mux.HandleFunc("GET /v1/models", trackInFlight(httplogger.LogFunc(
 		models(httpClient, backendURL,
 			cfg.ServedModelName, cfg.ThinkingGeneralModel, cfg.ThinkingCodingModel,
 			cfg.InstructGeneralModel, cfg.InstructReasoningModel),
-	))
-	// Health check endpoints (not logged)
-	http.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+	)))
+	// Health check endpoints (not logged): /health is a cheap liveness probe,
+	// /ready reports the cached result of the backend deep checks
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"healthy"}`))
 	})
+	backendReadiness := newReadiness(httpClient, backendURL, cfg.ServedModelName, cfg.BackendAPIKey, cfg.ReadyCheckInterval)
+	mux.HandleFunc("GET /ready", backendReadiness.handler)
 	// Catch-all for all other paths (passthrough)
-	http.HandleFunc("/", httplogger.LogFunc(passthrough(httpClient, backendURL)))
+	mux.HandleFunc("/", trackInFlight(httplogger.LogFunc(passthrough(httpClient, backendURL))))
 
-	// Prepare HTTP server and clean stop
-	server := &http.Server{Addr: fmt.Sprintf("%s:%d", cfg.Listen, cfg.Port)}
+	// Prepare HTTP servers and clean stop
+	server := &http.Server{
+		Addr:    net.JoinHostPort(cfg.Listen, strconv.Itoa(cfg.Port)),
+		Handler: debugLogMiddleware(debugLogTrusted, cfg.RedactDumps, mux),
+	}
+	servers := []*http.Server{server}
+	var adminServer *http.Server
+	if cfg.AdminPort != 0 {
+		adminServer = &http.Server{
+			Addr:    net.JoinHostPort(cfg.AdminListen, strconv.Itoa(cfg.AdminPort)),
+			Handler: adminAuth(cfg.AdminToken, adminMux(cfg, httplogger, logLevelCtrl)),
+		}
+		servers = append(servers, adminServer)
+	}
 	signalStopCtx, signalStopCtxCancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer signalStopCtxCancel()
-	go cleanStop(signalStopCtx, server)
+	go cleanStop(signalStopCtx, servers...)
+	go backendReadiness.run(signalStopCtx)
+	go logLevelCtrl.handleSignals(signalStopCtx)
+	if store != nil {
+		go store.run(signalStopCtx)
+	}
 
 	// Handle systemd if needed
 	if invocationID, sysdStarted := sysd.GetInvocationID(); sysdStarted {
 		logger.Info("systemd detected, activating systemd integration",
 			slog.String("invocation_id", invocationID),
 		)
-		go systemdIntegration(signalStopCtx, httplogger)
+		go systemdIntegration(signalStopCtx, cfg, httplogger, backendReadiness)
 	} else {
 		logger.Debug("systemd not detected, skipping systemd integration")
 	}
 
-	// Start server
+	// Start servers
+	if adminServer != nil {
+		logger.Info("starting admin server",
+			slog.String("listen", cfg.AdminListen),
+			slog.Int("port", cfg.AdminPort),
+			slog.Bool("auth", cfg.AdminToken != ""),
+		)
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("failed to start admin HTTP server", "err", err)
+				os.Exit(1)
+			}
+		}()
+	} else {
+		logger.Info("admin server disabled")
+	}
 	logger.Info("starting reverse proxy server",
 		slog.String("listen", cfg.Listen),
 		slog.Int("port", cfg.Port),
@@ -127,23 +196,47 @@ func main() {
 	}
 }
 
-func systemdIntegration(signalStopCtx context.Context, httplogger *httplog.Logger) {
+func systemdIntegration(signalStopCtx context.Context, cfg Config, httplogger *httplog.Logger, backendReadiness *readiness) {
 	var err error
 	if err = sysdnotify.Ready(); err != nil {
 		logger.Error("failed to send systemd ready notification", "err", err)
 	}
 	sysdUpdateTicker := time.NewTicker(time.Minute)
 	defer sysdUpdateTicker.Stop()
+	// Activate the watchdog if systemd asked for it (WatchdogSec= in the unit file)
+	var watchdogTick <-chan time.Time
+	watchdog, err := sysdwatchdog.New()
+	if err == nil {
+		logger.Info("systemd watchdog enabled",
+			slog.Duration("limit", watchdog.GetLimitDuration()),
+			slog.Bool("require_backend_ready", cfg.WatchdogRequireReady),
+		)
+		watchdogTicker := watchdog.NewTicker()
+		defer watchdogTicker.Stop()
+		watchdogTick = watchdogTicker.C
+	} else {
+		logger.Debug("systemd watchdog not enabled", "err", err)
+	}
 	for {
 		select {
 		case <-sysdUpdateTicker.C:
 			logger.Debug("sending systemd status notification")
-			if err = sysdnotify.Status(fmt.Sprintf("Modified %d requests on the %d proxified",
-				modifiedRequests.Load(),
-				httplogger.TotalRequests(),
-			)); err != nil {
+			if err = sysdnotify.Status(collectStats(cfg, httplogger).statusLine()); err != nil {
 				logger.Error("failed to send systemd status notification", "err", err)
 			}
+		case <-watchdogTick:
+			// Only ping the watchdog if we are still able to serve requests
+			if err = probeServer(signalStopCtx, cfg, watchdog.GetChecksDuration()); err != nil {
+				logger.Error("HTTP server self probe failed, skipping systemd watchdog heartbeat", "err", err)
+				continue
+			}
+			if cfg.WatchdogRequireReady && !backendReadiness.Ready() {
+				logger.Warn("backend is not ready, skipping systemd watchdog heartbeat")
+				continue
+			}
+			if err = watchdog.SendHeartbeat(); err != nil {
+				logger.Error("failed to send systemd watchdog heartbeat", "err", err)
+			}
 		case <-signalStopCtx.Done():
 			if err = sysdnotify.Stopping(); err != nil {
 				logger.Error("failed to send systemd stopping notification", "err", err)
@@ -153,14 +246,44 @@ func systemdIntegration(signalStopCtx context.Context, httplogger *httplog.Logge
 	}
 }
 
-func cleanStop(signalStopCtx context.Context, server *http.Server) {
+// probeServer checks that the HTTP server still accepts connections and handles requests
+// by calling its own liveness endpoint.
+func probeServer(ctx context.Context, cfg Config, timeout time.Duration) error {
+	host := cfg.Listen
+	switch host {
+	case "0.0.0.0", "":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	probeURL := fmt.Sprintf("http://%s/health", net.JoinHostPort(host, strconv.Itoa(cfg.Port)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("liveness endpoint returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func cleanStop(signalStopCtx context.Context, servers ...*http.Server) {
 	<-signalStopCtx.Done()
-	logger.Info("shutting down HTTP server...",
+	logger.Info("shutting down HTTP servers...",
 		slog.Duration("grace_period", stopTimeout),
 	)
 	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
-		logger.Error("failed to shutdown HTTP server properly", "err", err)
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("failed to shutdown HTTP server properly", "addr", server.Addr, "err", err)
+		}
 	}
 }
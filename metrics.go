@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	metricsRegistry []metricWriter
+	// Proxy metrics
+	requestsMetric = newMetric("qwen35rp_requests_total", "counter",
+		"Total number of chat completion requests per profile", "profile")
+	completionTokensMetric = newMetric("qwen35rp_completion_tokens_total", "counter",
+		"Total number of completion tokens reported by the backend per profile", "profile")
+	reasoningTokensMetric = newMetric("qwen35rp_reasoning_tokens_total", "counter",
+		"Total number of completion tokens spent on reasoning per profile", "profile")
+	toolCallValidationsMetric = newMetric("qwen35rp_tool_call_validations_total", "counter",
+		"Total number of tool calls validated against the request schemas per profile and outcome", "profile", "outcome")
+	structuredOutputValidationsMetric = newMetric("qwen35rp_structured_output_validations_total", "counter",
+		"Total number of structured output responses validated against the requested format per profile and outcome", "profile", "outcome")
+	timeToFirstTokenMetric = newHistogram("qwen35rp_time_to_first_token_seconds",
+		"Time between the backend request and the first streamed chunk per profile",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "profile")
+)
+
+// metricWriter is implemented by every registered metric
+type metricWriter interface {
+	writeTo(sb *strings.Builder)
+}
+
+// metric is a minimal Prometheus counter or gauge partitioned by label values
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64 // key is the label values joined by \xff
+}
+
+// newMetric creates and registers a new metric. kind is either "counter" or "gauge".
+func newMetric(name, kind, help string, labels ...string) *metric {
+	m := &metric{
+		name:   name,
+		kind:   kind,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+// Add adds value to the metric identified by labelValues
+func (m *metric) Add(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	m.values[key] += value
+	m.mu.Unlock()
+}
+
+// Set sets the value of the metric identified by labelValues
+func (m *metric) Set(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	m.values[key] = value
+	m.mu.Unlock()
+}
+
+// Get returns the current value of the metric identified by labelValues
+func (m *metric) Get(labelValues ...string) float64 {
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key]
+}
+
+// writeTo writes the metric using the Prometheus text exposition format
+func (m *metric) writeTo(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		writeSample(sb, m.name, m.labels, key, m.values[key])
+	}
+}
+
+// writeSample writes a sample line, extraLabel being an optional name/value pair added to the labels
+func writeSample(sb *strings.Builder, name string, labels []string, key string, value float64, extraLabel ...string) {
+	sb.WriteString(name)
+	if len(labels) > 0 || len(extraLabel) > 0 {
+		sb.WriteByte('{')
+		if len(labels) > 0 {
+			for i, labelValue := range strings.Split(key, "\xff") {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				fmt.Fprintf(sb, "%s=%s", labels[i], strconv.Quote(labelValue))
+			}
+		}
+		if len(extraLabel) == 2 {
+			if len(labels) > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(sb, "%s=%s", extraLabel[0], strconv.Quote(extraLabel[1]))
+		}
+		sb.WriteByte('}')
+	}
+	fmt.Fprintf(sb, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// histogram is a minimal Prometheus histogram partitioned by label values
+type histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, sorted
+	mu      sync.Mutex
+	series  map[string]*histogramSeries // key is the label values joined by \xff
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative, the last one being +Inf
+	sum    float64
+	count  uint64
+}
+
+// newHistogram creates and registers a new histogram
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	h := &histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+// Observe adds an observation to the histogram identified by labelValues
+func (h *histogram) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = series
+	}
+	bucket, _ := slices.BinarySearch(h.buckets, value)
+	series.counts[bucket]++
+	series.sum += value
+	series.count++
+}
+
+// writeTo writes the histogram using the Prometheus text exposition format
+func (h *histogram) writeTo(sb *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		var cumulative uint64
+		for i, upperBound := range h.buckets {
+			cumulative += series.counts[i]
+			writeSample(sb, h.name+"_bucket", h.labels, key, float64(cumulative),
+				"le", strconv.FormatFloat(upperBound, 'g', -1, 64))
+		}
+		writeSample(sb, h.name+"_bucket", h.labels, key, float64(series.count), "le", "+Inf")
+		writeSample(sb, h.name+"_sum", h.labels, key, series.sum)
+		writeSample(sb, h.name+"_count", h.labels, key, float64(series.count))
+	}
+}
+
+// metricsHandler exposes all registered metrics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var sb strings.Builder
+	for _, m := range metricsRegistry {
+		m.writeTo(&sb)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
@@ -7,15 +7,13 @@ import (
 	"net/http"
 	"net/url"
 	"path"
-
-	"github.com/hekmon/httplog/v3"
 )
 
 // models fetches backend models and enriches with 4 virtual model names
 func models(httpCli *http.Client, target *url.URL, servedModel, thinkingGeneral, thinkingCoding, instructGeneral, instructReasoning string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		logger := logger.With(httplog.GetReqIDSLogAttr(ctx))
+		logger := requestLogger(ctx)
 		logger.Debug("handling /v1/models request")
 
 		// Create request to backend (clone to copy all headers from incoming request)
@@ -29,6 +27,7 @@ func models(httpCli *http.Client, target *url.URL, servedModel, thinkingGeneral,
 		resp, err := httpCli.Do(req)
 		if err != nil {
 			logger.Error("failed to fetch models from backend", slog.Any("error", err))
+			recordBackendError(r.URL.Path, err.Error())
 			httpError(ctx, w, http.StatusBadGateway)
 			return
 		}
@@ -7,14 +7,12 @@ import (
 	"net/http"
 	"net/url"
 	"syscall"
-
-	"github.com/hekmon/httplog/v3"
 )
 
 func passthrough(httpCli *http.Client, target *url.URL) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Prepare
-		logger := logger.With(httplog.GetReqIDSLogAttr(r.Context()))
+		logger := requestLogger(r.Context())
 		ctx := r.Context()
 		// Create the outgoing request
 		outreq := r.Clone(ctx)
@@ -25,6 +23,7 @@ func passthrough(httpCli *http.Client, target *url.URL) http.HandlerFunc {
 		outResp, err := httpCli.Do(outreq)
 		if err != nil {
 			logger.Error("failed to send upstream request", slog.Any("error", err))
+			recordBackendError(r.URL.Path, err.Error())
 			switch {
 			case errors.Is(err, syscall.ECONNREFUSED):
 				httpError(ctx, w, http.StatusBadGateway)
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var backendReadyMetric = newMetric("qwen35rp_backend_ready", "gauge",
+	"Whether the backend passed the last readiness check (1) or not (0)")
+
+// readinessCheckTimeout caps the duration of each backend call of a readiness check
+const readinessCheckTimeout = 5 * time.Second
+
+// readinessState is the cached result of the last readiness check
+type readinessState struct {
+	Ready     bool      `json:"-"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// readiness periodically checks that the backend is able to serve requests for the proxy:
+// it must be reachable, its own /health must pass and it must serve the expected model.
+// Results are cached so probes never hit the backend directly. apiKey, when set, is sent
+// as a bearer token for backends started with --api-key.
+type readiness struct {
+	httpCli     *http.Client
+	target      *url.URL
+	servedModel string
+	apiKey      string
+	interval    time.Duration
+	state       atomic.Pointer[readinessState]
+}
+
+func newReadiness(httpCli *http.Client, target *url.URL, servedModel, apiKey string, interval time.Duration) *readiness {
+	rd := &readiness{
+		httpCli:     httpCli,
+		target:      target,
+		servedModel: servedModel,
+		apiKey:      apiKey,
+		interval:    interval,
+	}
+	rd.state.Store(&readinessState{
+		Status: "not_ready",
+		Reason: "backend not checked yet",
+	})
+	return rd
+}
+
+// run checks the backend right away then at every interval, until ctx is done
+func (rd *readiness) run(ctx context.Context) {
+	ticker := time.NewTicker(rd.interval)
+	defer ticker.Stop()
+	for {
+		rd.update(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// update performs a check and stores its result, logging state transitions
+func (rd *readiness) update(ctx context.Context) {
+	state := readinessState{
+		Ready:     true,
+		Status:    "ready",
+		CheckedAt: time.Now(),
+	}
+	if err := rd.check(ctx); err != nil {
+		state.Ready = false
+		state.Status = "not_ready"
+		state.Reason = err.Error()
+	}
+	previous := rd.state.Swap(&state)
+	switch {
+	case state.Ready && !previous.Ready:
+		logger.Info("backend is ready")
+		backendReadyMetric.Set(1)
+	case !state.Ready && (previous.Ready || previous.Reason != state.Reason):
+		logger.Warn("backend is not ready", slog.String("reason", state.Reason))
+		backendReadyMetric.Set(0)
+	}
+}
+
+// check returns an error describing why the backend is not ready
+func (rd *readiness) check(ctx context.Context) error {
+	// Backend own health check
+	resp, err := rd.get(ctx, "/health")
+	if err != nil {
+		return fmt.Errorf("backend unreachable: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backend health check failed: HTTP %d", resp.StatusCode)
+	}
+	// Served model must be listed
+	if resp, err = rd.get(ctx, "/v1/models"); err != nil {
+		return fmt.Errorf("backend unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized && rd.apiKey == "" {
+			return errors.New("backend models listing failed: HTTP 401 (set -backend-api-key)")
+		}
+		return fmt.Errorf("backend models listing failed: HTTP %d", resp.StatusCode)
+	}
+	var modelsResp struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&modelsResp); err != nil {
+		return fmt.Errorf("failed to parse backend models listing: %w", err)
+	}
+	available := make([]string, 0, len(modelsResp.Data))
+	for _, model := range modelsResp.Data {
+		if model.ID == rd.servedModel {
+			return nil
+		}
+		available = append(available, model.ID)
+	}
+	return fmt.Errorf("backend is not serving model %q (available: %s)", rd.servedModel, strings.Join(available, ", "))
+}
+
+func (rd *readiness) get(ctx context.Context, urlPath string) (*http.Response, error) {
+	// The timeout context is released when the response body is closed
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	checkURL := *rd.target
+	checkURL.Path = path.Join(rd.target.Path, urlPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if rd.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+rd.apiKey)
+	}
+	resp, err := rd.httpCli.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// Ready returns the cached readiness of the backend
+func (rd *readiness) Ready() bool {
+	return rd.state.Load().Ready
+}
+
+// handler exposes the cached readiness: 200 when ready, 503 with the reason otherwise
+func (rd *readiness) handler(w http.ResponseWriter, r *http.Request) {
+	state := rd.state.Load()
+	w.Header().Set("Content-Type", "application/json")
+	if state.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		logger.Error("failed to write readiness response", slog.Any("error", err))
+	}
+}
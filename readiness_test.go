@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBackend serves /health and /v1/models like vLLM, requiring apiKey when set
+func newTestBackend(t *testing.T, healthStatus int, apiKey string, models ...string) *url.URL {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(healthStatus)
+	})
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		if apiKey != "" && r.Header.Get("Authorization") != "Bearer "+apiKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var list struct {
+			Data []map[string]string `json:"data"`
+		}
+		for _, model := range models {
+			list.Data = append(list.Data, map[string]string{"id": model})
+		}
+		json.NewEncoder(w).Encode(list)
+	})
+	backend := httptest.NewServer(mux)
+	t.Cleanup(backend.Close)
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// probe returns the status code and body served by the readiness handler
+func probe(t *testing.T, rd *readiness) (int, readinessState) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	rd.handler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var state readinessState
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatalf("invalid readiness body %q: %v", rec.Body, err)
+	}
+	return rec.Code, state
+}
+
+func TestReadiness(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	for _, tc := range []struct {
+		name         string
+		healthStatus int
+		backendKey   string
+		apiKey       string
+		models       []string
+		wantReason   string // empty when ready
+	}{
+		{
+			name:         "ready",
+			healthStatus: http.StatusOK,
+			models:       []string{"other", "Qwen/Test"},
+		},
+		{
+			name:         "model missing",
+			healthStatus: http.StatusOK,
+			models:       []string{"other", "another"},
+			wantReason:   `backend is not serving model "Qwen/Test" (available: other, another)`,
+		},
+		{
+			name:         "health failing",
+			healthStatus: http.StatusServiceUnavailable,
+			models:       []string{"Qwen/Test"},
+			wantReason:   "backend health check failed: HTTP 503",
+		},
+		{
+			name:         "api key sent",
+			healthStatus: http.StatusOK,
+			backendKey:   "sk-backend",
+			apiKey:       "sk-backend",
+			models:       []string{"Qwen/Test"},
+		},
+		{
+			name:         "api key missing",
+			healthStatus: http.StatusOK,
+			backendKey:   "sk-backend",
+			models:       []string{"Qwen/Test"},
+			wantReason:   "backend models listing failed: HTTP 401 (set -backend-api-key)",
+		},
+		{
+			name:         "api key wrong",
+			healthStatus: http.StatusOK,
+			backendKey:   "sk-backend",
+			apiKey:       "sk-wrong",
+			models:       []string{"Qwen/Test"},
+			wantReason:   "backend models listing failed: HTTP 401",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := newTestBackend(t, tc.healthStatus, tc.backendKey, tc.models...)
+			rd := newReadiness(http.DefaultClient, target, "Qwen/Test", tc.apiKey, time.Minute)
+			rd.update(t.Context())
+			code, state := probe(t, rd)
+			if tc.wantReason == "" {
+				if code != http.StatusOK || !rd.Ready() || state.Status != "ready" || state.Reason != "" {
+					t.Errorf("got HTTP %d %+v, want ready", code, state)
+				}
+				return
+			}
+			if code != http.StatusServiceUnavailable || rd.Ready() || state.Status != "not_ready" {
+				t.Errorf("got HTTP %d %+v, want not ready", code, state)
+			}
+			if state.Reason != tc.wantReason {
+				t.Errorf("got reason %q, want %q", state.Reason, tc.wantReason)
+			}
+			if state.CheckedAt.IsZero() {
+				t.Error("checked_at not set")
+			}
+		})
+	}
+}
+
+func TestReadinessCache(t *testing.T) {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	var calls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/v1/models" {
+			w.Write([]byte(`{"data":[{"id":"Qwen/Test"}]}`))
+		}
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	rd := newReadiness(backend.Client(), target, "Qwen/Test", "", time.Minute)
+
+	// Not checked yet
+	code, state := probe(t, rd)
+	if code != http.StatusServiceUnavailable || state.Reason != "backend not checked yet" {
+		t.Errorf("got HTTP %d %+v before the first check", code, state)
+	}
+	rd.update(t.Context())
+	if calls != 2 {
+		t.Fatalf("got %d backend calls for a check, want 2", calls)
+	}
+	// Probes are served from the cache
+	for range 3 {
+		if code, _ = probe(t, rd); code != http.StatusOK {
+			t.Errorf("got HTTP %d, want 200", code)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("probes hit the backend: %d calls", calls)
+	}
+	// The cached state only changes with the next check
+	backend.Close()
+	if code, _ = probe(t, rd); code != http.StatusOK {
+		t.Errorf("got HTTP %d from the cache, want 200", code)
+	}
+	rd.update(t.Context())
+	if code, state = probe(t, rd); code != http.StatusServiceUnavailable || !strings.HasPrefix(state.Reason, "backend unreachable: ") {
+		t.Errorf("got HTTP %d %+v after the backend went down", code, state)
+	}
+}
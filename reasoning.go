@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// stripReasoningHeader allows clients to strip (true) or keep (false) the reasoning of
+// a single request, overriding the profile setting
+const stripReasoningHeader = "X-Strip-Reasoning"
+
+// thinkTagsHeader allows clients to get the reasoning of a single request inlined in the
+// content (true) or in its own field (false), overriding the profile setting
+const thinkTagsHeader = "X-Think-Tags"
+
+// Tags wrapping the reasoning inlined in the content, as the Qwen chat template renders it
+const (
+	thinkOpenTag  = "<think>\n"
+	thinkCloseTag = "\n</think>\n\n"
+)
+
+// Reasoning field conventions, an empty one keeps the field sent by the backend
+const (
+	reasoningFieldContent   = "reasoning_content"
+	reasoningFieldReasoning = "reasoning"
+	reasoningFieldBoth      = "both"
+)
+
+// reasoningFields are the fields vLLM may use for reasoning, depending on its version
+var reasoningFields = []string{reasoningFieldContent, reasoningFieldReasoning}
+
+// reasoningOutput describes how the reasoning of a response is returned to the client
+type reasoningOutput struct {
+	strip     bool   // reasoning is dropped from messages and deltas
+	thinkTags bool   // reasoning is inlined in the content, wrapped in <think> tags
+	field     string // field convention of the reasoning, empty to keep the backend one
+}
+
+// reasoningPolicy resolves the reasoning output of the requests from the configuration
+type reasoningPolicy struct {
+	stripProfiles []string
+	tagProfiles   []string
+	field         string
+	fieldRules    []reasoningFieldRule
+}
+
+// reasoningFieldRule selects the reasoning field convention of the clients using an API key
+// or whose User-Agent matches a pattern
+type reasoningFieldRule struct {
+	apiKey    string
+	userAgent *regexp.Regexp
+	field     string
+}
+
+func newReasoningPolicy(cfg Config) (policy *reasoningPolicy, err error) {
+	policy = new(reasoningPolicy)
+	if policy.stripProfiles, err = parseProfileList(cfg.StripReasoning); err != nil {
+		return nil, fmt.Errorf("invalid strip reasoning profiles: %w", err)
+	}
+	if policy.tagProfiles, err = parseProfileList(cfg.ThinkTags); err != nil {
+		return nil, fmt.Errorf("invalid think tags profiles: %w", err)
+	}
+	for _, profile := range policy.tagProfiles {
+		if profile != profileThinkingGeneral && profile != profileThinkingCoding {
+			return nil, fmt.Errorf("invalid think tags profiles: %s does not think", profile)
+		}
+	}
+	if policy.field, err = parseReasoningField(cfg.ReasoningField); err != nil {
+		return nil, err
+	}
+	if policy.fieldRules, err = parseReasoningFieldRules(cfg.ReasoningFieldRules); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// output returns the reasoning output of a request for profile, consuming the request
+// headers controlling it. Instruct profiles (think=false) never get think tags.
+func (rp *reasoningPolicy) output(profile string, think bool, header http.Header) (output reasoningOutput, err error) {
+	if output.strip, err = headerBool(header, stripReasoningHeader, slices.Contains(rp.stripProfiles, profile)); err != nil {
+		return
+	}
+	if output.thinkTags, err = headerBool(header, thinkTagsHeader, slices.Contains(rp.tagProfiles, profile)); err != nil {
+		return
+	}
+	output.thinkTags = output.thinkTags && think
+	output.field = rp.field
+	apiKey, _ := strings.CutPrefix(header.Get("Authorization"), "Bearer ")
+	userAgent := header.Get("User-Agent")
+	for _, rule := range rp.fieldRules {
+		if (rule.apiKey != "" && rule.apiKey == apiKey) ||
+			(rule.userAgent != nil && rule.userAgent.MatchString(userAgent)) {
+			output.field = rule.field
+			break
+		}
+	}
+	return output, nil
+}
+
+// headerBool consumes a boolean request header, returning defaultValue if it is not set
+func headerBool(header http.Header, name string, defaultValue bool) (value bool, err error) {
+	raw := header.Get(name)
+	header.Del(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	if value, err = strconv.ParseBool(raw); err != nil {
+		return false, fmt.Errorf("invalid %s header: %w", name, err)
+	}
+	return value, nil
+}
+
+// parseReasoningField validates a reasoning field convention
+func parseReasoningField(field string) (string, error) {
+	switch field {
+	case "", reasoningFieldContent, reasoningFieldReasoning, reasoningFieldBoth:
+		return field, nil
+	default:
+		return "", fmt.Errorf("invalid reasoning field %q: expected %s, %s or %s",
+			field, reasoningFieldContent, reasoningFieldReasoning, reasoningFieldBoth)
+	}
+}
+
+// parseReasoningFieldRules parses a comma separated list of "key:<api key>=field" and
+// "ua:<regexp>=field" rules
+func parseReasoningFieldRules(raw string) (rules []reasoningFieldRule, err error) {
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		separator := strings.LastIndexByte(item, '=')
+		if separator < 0 {
+			return nil, fmt.Errorf("invalid reasoning field rule %q: expected key:<api key>=field or ua:<regexp>=field", item)
+		}
+		var rule reasoningFieldRule
+		if rule.field, err = parseReasoningField(item[separator+1:]); err != nil || rule.field == "" {
+			return nil, fmt.Errorf("invalid reasoning field rule %q: unknown field %q", item, item[separator+1:])
+		}
+		kind, pattern, _ := strings.Cut(item[:separator], ":")
+		switch {
+		case pattern == "":
+			return nil, fmt.Errorf("invalid reasoning field rule %q: empty match", item)
+		case kind == "key":
+			rule.apiKey = pattern
+		case kind == "ua":
+			if rule.userAgent, err = regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("invalid reasoning field rule %q: %w", item, err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid reasoning field rule %q: unknown match %q", item, kind)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseProfileList parses a comma separated list of profile names
+func parseProfileList(raw string) (list []string, err error) {
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !slices.Contains(profiles, item) {
+			return nil, fmt.Errorf("unknown profile %q (valid profiles: %s)", item, strings.Join(profiles, ", "))
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+// stripMessageReasoning removes the reasoning of every choice of a parsed non-streaming response.
+// Returns true if the response has been modified.
+func stripMessageReasoning(data map[string]any) (modified bool) {
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		message, _ := choiceMap["message"].(map[string]any)
+		for _, field := range reasoningFields {
+			if _, found := message[field]; found {
+				delete(message, field)
+				modified = true
+			}
+		}
+	}
+	return
+}
+
+// stripDeltaReasoning removes the reasoning deltas of a parsed streaming chunk. Choices left
+// without anything to deliver are removed, the index of the remaining ones being preserved.
+// emptied is true when the chunk has nothing left to deliver and must be suppressed.
+func stripDeltaReasoning(data map[string]any) (modified, emptied bool) {
+	choices, _ := data["choices"].([]any)
+	kept := choices[:0]
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		delta, _ := choiceMap["delta"].(map[string]any)
+		stripped := false
+		for _, field := range reasoningFields {
+			if _, found := delta[field]; found {
+				delete(delta, field)
+				stripped = true
+			}
+		}
+		if !stripped {
+			kept = append(kept, choice)
+			continue
+		}
+		modified = true
+		if len(delta) > 0 || choiceMap["finish_reason"] != nil {
+			kept = append(kept, choice)
+		}
+	}
+	if !modified {
+		return false, false
+	}
+	data["choices"] = kept
+	return true, len(kept) == 0 && data["usage"] == nil
+}
+
+// setReasoningField moves the reasoning of a message or a delta to the fields of the field
+// convention. Returns true if the object has been modified.
+func setReasoningField(object map[string]any, field string) (modified bool) {
+	targets := []string{field}
+	if field == reasoningFieldBoth {
+		targets = reasoningFields
+	}
+	var reasoning any
+	found := false
+	for _, name := range reasoningFields {
+		value, present := object[name]
+		if !present {
+			continue
+		}
+		if !found || reasoning == nil {
+			reasoning = value
+		}
+		found = true
+		if !slices.Contains(targets, name) {
+			delete(object, name)
+			modified = true
+		}
+	}
+	if !found {
+		return false
+	}
+	for _, name := range targets {
+		if _, present := object[name]; !present {
+			modified = true
+		}
+		object[name] = reasoning
+	}
+	return
+}
+
+// setMessageReasoningField applies the field convention to every choice of a parsed
+// non-streaming response. Returns true if the response has been modified.
+func setMessageReasoningField(data map[string]any, field string) (modified bool) {
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		if message, ok := choiceMap["message"].(map[string]any); ok && setReasoningField(message, field) {
+			modified = true
+		}
+	}
+	return
+}
+
+// setDeltaReasoningField applies the field convention to every choice of a parsed streaming
+// chunk. Returns true if the chunk has been modified.
+func setDeltaReasoningField(data map[string]any, field string) (modified bool) {
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		if delta, ok := choiceMap["delta"].(map[string]any); ok && setReasoningField(delta, field) {
+			modified = true
+		}
+	}
+	return
+}
+
+// needsReasoningField returns true if a raw message or chunk may not follow the field convention
+func needsReasoningField(jsonPart []byte, field string) bool {
+	switch field {
+	case reasoningFieldContent:
+		return bytes.Contains(jsonPart, quotedReasoning)
+	case reasoningFieldReasoning:
+		return bytes.Contains(jsonPart, quotedReasoningContent)
+	case reasoningFieldBoth:
+		return bytes.Contains(jsonPart, unquotedReasoningPrefix)
+	default:
+		return false
+	}
+}
+
+// takeReasoning returns the reasoning of a message or a delta and removes it
+func takeReasoning(object map[string]any) (reasoning string) {
+	for _, field := range reasoningFields {
+		if text, _ := object[field].(string); text != "" && reasoning == "" {
+			reasoning = text
+		}
+		delete(object, field)
+	}
+	return
+}
+
+// inlineMessageReasoning moves the reasoning of every choice of a parsed non-streaming response
+// to its content, wrapped in think tags. Returns true if the response has been modified.
+func inlineMessageReasoning(data map[string]any) (modified bool) {
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		message, ok := choiceMap["message"].(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, field := range reasoningFields {
+			if _, found := message[field]; found {
+				modified = true
+			}
+		}
+		if reasoning := takeReasoning(message); reasoning != "" {
+			content, _ := message["content"].(string)
+			message["content"] = thinkOpenTag + reasoning + thinkCloseTag + content
+		}
+	}
+	return
+}
+
+// thinkTagsState tracks the think tags inlined in the content of a streamed choice
+type thinkTagsState int
+
+const (
+	thinkTagsNone thinkTagsState = iota
+	thinkTagsOpen
+	thinkTagsClosed
+)
+
+// inlineDeltaReasoning is the streaming counterpart of inlineMessageReasoning: the opening tag
+// is sent with the first reasoning delta of a choice, the closing one with its first content
+// delta (or tool call, or finish reason). states holds the tags state per choice index.
+func inlineDeltaReasoning(data map[string]any, states map[int]thinkTagsState) (modified bool) {
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		delta, ok := choiceMap["delta"].(map[string]any)
+		if !ok {
+			continue
+		}
+		index, _ := choiceMap["index"].(float64)
+		state := states[int(index)]
+		var inlined strings.Builder
+		if reasoning := takeReasoning(delta); reasoning != "" {
+			if state == thinkTagsNone {
+				inlined.WriteString(thinkOpenTag)
+				state = thinkTagsOpen
+			}
+			inlined.WriteString(reasoning)
+		}
+		content, _ := delta["content"].(string)
+		if state == thinkTagsOpen && (content != "" || delta["tool_calls"] != nil || choiceMap["finish_reason"] != nil) {
+			inlined.WriteString(thinkCloseTag)
+			state = thinkTagsClosed
+		}
+		states[int(index)] = state
+		if inlined.Len() == 0 {
+			continue
+		}
+		delta["content"] = inlined.String() + content
+		modified = true
+	}
+	return
+}
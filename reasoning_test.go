@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+)
+
+// parseJSONObject decodes a JSON object for the fixes working on parsed responses
+func parseJSONObject(t *testing.T, payload string) map[string]any {
+	t.Helper()
+	var object map[string]any
+	if err := json.Unmarshal([]byte(payload), &object); err != nil {
+		t.Fatalf("invalid JSON %s: %v", payload, err)
+	}
+	return object
+}
+
+// encodeJSON returns the canonical encoding of a parsed JSON value
+func encodeJSON(t *testing.T, value any) string {
+	t.Helper()
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return normalizeJSON(t, encoded)
+}
+
+func TestStripMessageReasoning(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		response     string
+		want         string
+		wantModified bool
+	}{
+		{
+			name:         "reasoning_content",
+			response:     `{"choices":[{"index":0,"message":{"role":"assistant","reasoning_content":"Let me think","content":"Hello"}}]}`,
+			want:         `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hello"}}]}`,
+			wantModified: true,
+		},
+		{
+			name:         "both fields and several choices",
+			response:     `{"choices":[{"index":0,"message":{"reasoning_content":"a","reasoning":"a","content":"A"}},{"index":1,"message":{"reasoning":"b","content":"B"}},{"index":2,"message":{"content":"C"}}]}`,
+			want:         `{"choices":[{"index":0,"message":{"content":"A"}},{"index":1,"message":{"content":"B"}},{"index":2,"message":{"content":"C"}}]}`,
+			wantModified: true,
+		},
+		{
+			name:         "null reasoning",
+			response:     `{"choices":[{"index":0,"message":{"reasoning_content":null,"content":"Hello"}}]}`,
+			want:         `{"choices":[{"index":0,"message":{"content":"Hello"}}]}`,
+			wantModified: true,
+		},
+		{
+			name:     "no reasoning",
+			response: `{"choices":[{"index":0,"message":{"content":"Hello"}}]}`,
+			want:     `{"choices":[{"index":0,"message":{"content":"Hello"}}]}`,
+		},
+		{
+			name:     "no choices",
+			response: `{"error":{"message":"boom"}}`,
+			want:     `{"error":{"message":"boom"}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := parseJSONObject(t, tc.response)
+			if modified := stripMessageReasoning(data); modified != tc.wantModified {
+				t.Errorf("got modified %v, want %v", modified, tc.wantModified)
+			}
+			if got, want := encodeJSON(t, data), normalizeJSON(t, []byte(tc.want)); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestStripDeltaReasoning(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		chunk        string
+		want         string
+		wantModified bool
+		wantEmptied  bool
+	}{
+		{
+			name:         "reasoning only chunk",
+			chunk:        `{"choices":[{"index":0,"delta":{"reasoning_content":"Let me"}}]}`,
+			want:         `{"choices":[]}`,
+			wantModified: true,
+			wantEmptied:  true,
+		},
+		{
+			name:         "reasoning field",
+			chunk:        `{"choices":[{"index":0,"delta":{"reasoning":"Let me"}}]}`,
+			want:         `{"choices":[]}`,
+			wantModified: true,
+			wantEmptied:  true,
+		},
+		{
+			name:         "content kept",
+			chunk:        `{"choices":[{"index":0,"delta":{"reasoning_content":"","content":"Hello"}}]}`,
+			want:         `{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+			wantModified: true,
+		},
+		{
+			name:         "emptied choice dropped, indexes preserved",
+			chunk:        `{"choices":[{"index":0,"delta":{"reasoning_content":"a"}},{"index":1,"delta":{"content":"B"}},{"index":2,"delta":{"reasoning":"c"}}]}`,
+			want:         `{"choices":[{"index":1,"delta":{"content":"B"}}]}`,
+			wantModified: true,
+		},
+		{
+			name:         "finish reason kept",
+			chunk:        `{"choices":[{"index":0,"delta":{"reasoning_content":"done"},"finish_reason":"stop"}]}`,
+			want:         `{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			wantModified: true,
+		},
+		{
+			name:         "usage kept",
+			chunk:        `{"choices":[{"index":0,"delta":{"reasoning_content":"a"}}],"usage":{"completion_tokens":3}}`,
+			want:         `{"choices":[],"usage":{"completion_tokens":3}}`,
+			wantModified: true,
+		},
+		{
+			name:  "no reasoning",
+			chunk: `{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+			want:  `{"choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+		},
+		{
+			name:  "usage only chunk",
+			chunk: `{"choices":[],"usage":{"completion_tokens":3}}`,
+			want:  `{"choices":[],"usage":{"completion_tokens":3}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := parseJSONObject(t, tc.chunk)
+			modified, emptied := stripDeltaReasoning(data)
+			if modified != tc.wantModified || emptied != tc.wantEmptied {
+				t.Errorf("got modified %v emptied %v, want %v %v", modified, emptied, tc.wantModified, tc.wantEmptied)
+			}
+			if got, want := encodeJSON(t, data), normalizeJSON(t, []byte(tc.want)); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestReasoningOutputStripHeader(t *testing.T) {
+	policy, err := newReasoningPolicy(Config{StripReasoning: profileThinkingCoding})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name      string
+		profile   string
+		header    string
+		wantStrip bool
+		wantErr   bool
+	}{
+		{name: "profile default", profile: profileThinkingCoding, wantStrip: true},
+		{name: "other profile", profile: profileThinkingGeneral},
+		{name: "header keeps", profile: profileThinkingCoding, header: "false"},
+		{name: "header strips", profile: profileThinkingGeneral, header: "1", wantStrip: true},
+		{name: "invalid header", profile: profileThinkingGeneral, header: "maybe", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			if tc.header != "" {
+				header.Set(stripReasoningHeader, tc.header)
+			}
+			output, err := policy.output(tc.profile, true, header)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if err == nil && output.strip != tc.wantStrip {
+				t.Errorf("got strip %v, want %v", output.strip, tc.wantStrip)
+			}
+			// The header is consumed: never forwarded to the backend
+			if _, found := header[stripReasoningHeader]; found {
+				t.Error("header not consumed")
+			}
+		})
+	}
+}
+
+func TestNewReasoningPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "empty", cfg: Config{}},
+		{name: "full", cfg: Config{
+			StripReasoning:      profileThinkingCoding + ", " + profileInstructGeneral,
+			ThinkTags:           profileThinkingGeneral,
+			ReasoningField:      reasoningFieldBoth,
+			ReasoningFieldRules: "key:sk-a=reasoning, ua:^OpenAI/=reasoning_content,,",
+		}},
+		{name: "unknown strip profile", cfg: Config{StripReasoning: "thinking"}, wantErr: true},
+		{name: "think tags on instruct", cfg: Config{ThinkTags: profileInstructReasoning}, wantErr: true},
+		{name: "unknown field", cfg: Config{ReasoningField: "thoughts"}, wantErr: true},
+		{name: "rule without field", cfg: Config{ReasoningFieldRules: "key:sk-a"}, wantErr: true},
+		{name: "rule with empty field", cfg: Config{ReasoningFieldRules: "key:sk-a="}, wantErr: true},
+		{name: "rule with unknown field", cfg: Config{ReasoningFieldRules: "key:sk-a=thoughts"}, wantErr: true},
+		{name: "rule with empty match", cfg: Config{ReasoningFieldRules: "key:=reasoning"}, wantErr: true},
+		{name: "rule without kind", cfg: Config{ReasoningFieldRules: "sk-a=reasoning"}, wantErr: true},
+		{name: "rule with unknown kind", cfg: Config{ReasoningFieldRules: "ip:10.0.0.1=reasoning"}, wantErr: true},
+		{name: "rule with invalid regexp", cfg: Config{ReasoningFieldRules: "ua:(=reasoning"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newReasoningPolicy(tc.cfg); (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReasoningOutputField(t *testing.T) {
+	policy, err := newReasoningPolicy(Config{
+		ReasoningField: reasoningFieldContent,
+		// An API key may contain "=": the field follows the last one
+		ReasoningFieldRules: "key:sk-a=b=reasoning, ua:^OpenAI/=both, key:sk-c=reasoning_content",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		userAgent     string
+		want          string
+	}{
+		{name: "default", authorization: "Bearer sk-other", userAgent: "curl/8", want: reasoningFieldContent},
+		{name: "api key", authorization: "Bearer sk-a=b", want: reasoningFieldReasoning},
+		{name: "user agent", userAgent: "OpenAI/Python 1.0", want: reasoningFieldBoth},
+		{name: "user agent not anchored", userAgent: "MyApp OpenAI/Python", want: reasoningFieldContent},
+		{name: "first matching rule wins", authorization: "Bearer sk-c", userAgent: "OpenAI/JS", want: reasoningFieldBoth},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Authorization", tc.authorization)
+			header.Set("User-Agent", tc.userAgent)
+			output, err := policy.output(profileThinkingGeneral, true, header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output.field != tc.want {
+				t.Errorf("got field %q, want %q", output.field, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetReasoningField(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		field        string
+		object       string
+		want         string
+		wantModified bool
+	}{
+		{
+			name:         "reasoning_content to reasoning",
+			field:        reasoningFieldReasoning,
+			object:       `{"reasoning_content":"Let me think","content":"Hi"}`,
+			want:         `{"reasoning":"Let me think","content":"Hi"}`,
+			wantModified: true,
+		},
+		{
+			name:         "reasoning to reasoning_content",
+			field:        reasoningFieldContent,
+			object:       `{"reasoning":"Let me think"}`,
+			want:         `{"reasoning_content":"Let me think"}`,
+			wantModified: true,
+		},
+		{
+			name:   "already following the convention",
+			field:  reasoningFieldContent,
+			object: `{"reasoning_content":"Let me think"}`,
+			want:   `{"reasoning_content":"Let me think"}`,
+		},
+		{
+			name:         "both from one",
+			field:        reasoningFieldBoth,
+			object:       `{"reasoning":"Let me think"}`,
+			want:         `{"reasoning_content":"Let me think","reasoning":"Let me think"}`,
+			wantModified: true,
+		},
+		{
+			name:         "duplicate dropped",
+			field:        reasoningFieldReasoning,
+			object:       `{"reasoning_content":"Let me think","reasoning":"Let me think"}`,
+			want:         `{"reasoning":"Let me think"}`,
+			wantModified: true,
+		},
+		{
+			name:         "null reasoning does not hide the other field",
+			field:        reasoningFieldReasoning,
+			object:       `{"reasoning_content":null,"reasoning":"Let me think"}`,
+			want:         `{"reasoning":"Let me think"}`,
+			wantModified: true,
+		},
+		{
+			name:         "null kept",
+			field:        reasoningFieldReasoning,
+			object:       `{"reasoning_content":null,"content":"Hi"}`,
+			want:         `{"reasoning":null,"content":"Hi"}`,
+			wantModified: true,
+		},
+		{
+			name:   "no reasoning",
+			field:  reasoningFieldBoth,
+			object: `{"content":"Hi"}`,
+			want:   `{"content":"Hi"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			object := parseJSONObject(t, tc.object)
+			if modified := setReasoningField(object, tc.field); modified != tc.wantModified {
+				t.Errorf("got modified %v, want %v", modified, tc.wantModified)
+			}
+			if got, want := encodeJSON(t, object), normalizeJSON(t, []byte(tc.want)); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestReasoningOutputThinkTags(t *testing.T) {
+	policy, err := newReasoningPolicy(Config{ThinkTags: profileThinkingGeneral})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		profile string
+		think   bool
+		header  string
+		want    bool
+	}{
+		{name: "profile default", profile: profileThinkingGeneral, think: true, want: true},
+		{name: "other profile", profile: profileThinkingCoding, think: true},
+		{name: "header enables", profile: profileThinkingCoding, think: true, header: "true", want: true},
+		{name: "header disables", profile: profileThinkingGeneral, think: true, header: "false"},
+		// Requests that do not think never get think tags
+		{name: "thinking disabled", profile: profileThinkingGeneral, think: false},
+		{name: "instruct with header", profile: profileInstructReasoning, think: false, header: "true"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			if tc.header != "" {
+				header.Set(thinkTagsHeader, tc.header)
+			}
+			output, err := policy.output(tc.profile, tc.think, header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output.thinkTags != tc.want {
+				t.Errorf("got think tags %v, want %v", output.thinkTags, tc.want)
+			}
+			if _, found := header[thinkTagsHeader]; found {
+				t.Error("header not consumed")
+			}
+		})
+	}
+}
+
+func TestInlineMessageReasoning(t *testing.T) {
+	data := parseJSONObject(t, `{"choices":[`+
+		`{"index":0,"message":{"reasoning_content":"Let me think","content":"Hello"}},`+
+		`{"index":1,"message":{"reasoning":"Hmm","content":null,"tool_calls":[{"id":"call_1"}]}},`+
+		`{"index":2,"message":{"reasoning_content":null,"content":"Hi"}},`+
+		`{"index":3,"message":{"content":"Hey"}}]}`)
+	if !inlineMessageReasoning(data) {
+		t.Error("not modified")
+	}
+	want := `{"choices":[` +
+		`{"index":0,"message":{"content":"<think>\nLet me think\n</think>\n\nHello"}},` +
+		`{"index":1,"message":{"content":"<think>\nHmm\n</think>\n\n","tool_calls":[{"id":"call_1"}]}},` +
+		`{"index":2,"message":{"content":"Hi"}},` +
+		`{"index":3,"message":{"content":"Hey"}}]}`
+	if got := encodeJSON(t, data); got != normalizeJSON(t, []byte(want)) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if inlineMessageReasoning(parseJSONObject(t, `{"choices":[{"index":0,"message":{"content":"Hey"}}]}`)) {
+		t.Error("modified without reasoning")
+	}
+}
+
+func TestInlineDeltaReasoning(t *testing.T) {
+	// Two interleaved choices: the first answers, the second calls a tool
+	chunks := []string{
+		`{"model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":""}},{"index":1,"delta":{"role":"assistant","content":""}}]}`,
+		`{"model":"m","choices":[{"index":0,"delta":{"reasoning_content":"Let me"}}]}`,
+		`{"model":"m","choices":[{"index":1,"delta":{"reasoning":"Hmm"}},{"index":0,"delta":{"reasoning_content":" think"}}]}`,
+		`{"model":"m","choices":[{"index":1,"delta":{"reasoning":"..."}}]}`,
+		`{"model":"m","choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+		`{"model":"m","choices":[{"index":0,"delta":{"content":" world"}},{"index":1,"delta":{"tool_calls":[{"index":0,"id":"call_1"}]}}]}`,
+		`{"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"},{"index":1,"delta":{},"finish_reason":"tool_calls"}]}`,
+	}
+	fixer := newStreamFixer("qwen", true, false, reasoningOutput{thinkTags: true}, nil, nil, slog.New(slog.DiscardHandler))
+	contents := make(map[int]string)
+	for _, chunk := range chunks {
+		fixed, _ := fixer.fixData([]byte(chunk))
+		if fixed == nil {
+			continue
+		}
+		var data struct {
+			Choices []struct {
+				Index int
+				Delta map[string]any
+			}
+		}
+		if err := json.Unmarshal(fixed, &data); err != nil {
+			t.Fatalf("invalid chunk %s: %v", fixed, err)
+		}
+		for _, choice := range data.Choices {
+			for _, field := range reasoningFields {
+				if _, found := choice.Delta[field]; found {
+					t.Errorf("reasoning left in chunk %s", fixed)
+				}
+			}
+			content, _ := choice.Delta["content"].(string)
+			contents[choice.Index] += content
+		}
+	}
+	for index, want := range map[int]string{
+		0: "<think>\nLet me think\n</think>\n\nHello world",
+		1: "<think>\nHmm...\n</think>\n\n",
+	} {
+		if contents[index] != want {
+			t.Errorf("choice %d: got content %q, want %q", index, contents[index], want)
+		}
+	}
+	if fixer.tagsOpen {
+		t.Error("think tags still open at the end of the stream")
+	}
+}
+
+func TestInlineDeltaReasoningClosedByFinish(t *testing.T) {
+	// A choice whose reasoning is cut by the length limit still gets its tags closed, once
+	states := make(map[int]thinkTagsState)
+	var content string
+	for _, chunk := range []string{
+		`{"choices":[{"index":0,"delta":{"reasoning_content":"Let me"}}]}`,
+		`{"choices":[{"index":0,"delta":{"reasoning_content":" think"},"finish_reason":"length"}]}`,
+		`{"choices":[],"usage":{"completion_tokens":2}}`,
+	} {
+		data := parseJSONObject(t, chunk)
+		inlineDeltaReasoning(data, states)
+		for _, choice := range data["choices"].([]any) {
+			delta, _ := choice.(map[string]any)["delta"].(map[string]any)
+			text, _ := delta["content"].(string)
+			content += text
+		}
+	}
+	if want := "<think>\nLet me think\n</think>\n\n"; content != want {
+		t.Errorf("got content %q, want %q", content, want)
+	}
+	if states[0] != thinkTagsClosed {
+		t.Errorf("got state %v, want closed", states[0])
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultRedactRules are applied to COMPLETE/DEBUG body dumps when redaction is enabled
+// and no custom rules are provided. They cover chat completions, legacy completions and
+// responses bodies, both for requests and (streamed) responses.
+const defaultRedactRules = "messages.*.content=truncate:64," +
+	"messages.*.reasoning_content=hash," +
+	"messages.*.reasoning=hash," +
+	"messages.*.tool_calls.*.function.arguments=hash," +
+	"prompt=truncate:64," +
+	"input=truncate:64," +
+	"instructions=truncate:64," +
+	"choices.*.text=truncate:64," +
+	"choices.*.message.content=truncate:64," +
+	"choices.*.message.reasoning_content=hash," +
+	"choices.*.message.reasoning=hash," +
+	"choices.*.message.tool_calls.*.function.arguments=hash," +
+	"choices.*.delta.content=hash," +
+	"choices.*.delta.reasoning_content=hash," +
+	"choices.*.delta.reasoning=hash," +
+	"choices.*.delta.tool_calls.*.function.arguments=hash"
+
+// sensitiveHeaders lists the headers masked in HTTP request dumps
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Api-Key",
+	"Api-Key",
+}
+
+// redactedBodyAttrs are the slog attribute keys carrying HTTP bodies that must be redacted
+var redactedBodyAttrs = []string{"body", "response_body"}
+
+const (
+	redactActionTruncate = "truncate"
+	redactActionHash     = "hash"
+	redactActionStrip    = "strip"
+)
+
+// redactRule rewrites every string value found under path using action.
+// Path elements are object keys or array indexes, "*" matching any of them.
+type redactRule struct {
+	path   []string
+	action string
+	length int // only used by truncate
+}
+
+// parseRedactRules parses a comma separated list of "json.path=action" rules.
+// Supported actions are "truncate:N", "hash" and "strip".
+func parseRedactRules(raw string) (rules []redactRule, err error) {
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path, action, found := strings.Cut(item, "=")
+		if !found || path == "" {
+			return nil, fmt.Errorf("invalid redact rule %q: expected json.path=action", item)
+		}
+		rule := redactRule{path: strings.Split(path, ".")}
+		action, param, _ := strings.Cut(action, ":")
+		switch action {
+		case redactActionTruncate:
+			if rule.length, err = strconv.Atoi(param); err != nil || rule.length < 0 {
+				return nil, fmt.Errorf("invalid redact rule %q: truncate requires a non-negative length", item)
+			}
+		case redactActionHash, redactActionStrip:
+		default:
+			return nil, fmt.Errorf("invalid redact rule %q: unknown action %q", item, action)
+		}
+		rule.action = action
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// redactBody returns a redacted copy of a JSON or SSE body suitable for logging.
+// Bodies that are neither valid JSON nor SSE are replaced by a placeholder: when redaction
+// is on, unknown content must not leak.
+func redactBody(body string, rules []redactRule) string {
+	trimmed := strings.TrimSpace(body)
+	if trimmed == "" {
+		return body
+	}
+	if redacted, ok := redactJSON([]byte(trimmed), rules); ok {
+		return string(redacted)
+	}
+	// Not plain JSON: try as a SSE stream, redacting the data of each event
+	if !strings.Contains(body, "data:") {
+		return fmt.Sprintf("<redacted %d bytes>", len(body))
+	}
+	reader := newSSEReader(strings.NewReader(body), len(body))
+	var redactedBody []byte
+	for {
+		event, err := reader.next()
+		if err != nil {
+			if err != io.EOF {
+				// Dumps may be cut in the middle of an event
+				redactedBody = append(redactedBody, "<redacted incomplete event>"...)
+			}
+			return string(redactedBody)
+		}
+		payload := bytes.TrimSpace(event.Data())
+		if len(payload) > 0 && !bytes.Equal(payload, sseDone) {
+			if redacted, ok := redactJSON(payload, rules); ok {
+				event.setData(redacted)
+			} else {
+				event.setData(fmt.Appendf(nil, "<redacted %d bytes>", len(payload)))
+			}
+		}
+		redactedBody = event.appendTo(redactedBody)
+	}
+}
+
+// redactJSON applies the rules on a JSON document. ok is false if the payload is not JSON.
+func redactJSON(payload []byte, rules []redactRule) (redacted []byte, ok bool) {
+	var data any
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, false
+	}
+	data = stripBase64Payloads(data)
+	for _, rule := range rules {
+		data = applyRedactRule(data, rule.path, rule)
+	}
+	// Do not escape HTML: redaction markers use < and > and the output is meant to be read
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(data); err != nil {
+		return nil, false
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), true
+}
+
+// applyRedactRule walks value following path and applies the rule on what it matches
+func applyRedactRule(value any, path []string, rule redactRule) any {
+	if len(path) == 0 {
+		return redactLeaves(value, rule)
+	}
+	switch typed := value.(type) {
+	case map[string]any:
+		for k, v := range typed {
+			if path[0] == "*" || path[0] == k {
+				typed[k] = applyRedactRule(v, path[1:], rule)
+			}
+		}
+	case []any:
+		for i, v := range typed {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				typed[i] = applyRedactRule(v, path[1:], rule)
+			}
+		}
+	}
+	return value
+}
+
+// redactLeaves applies the rule action on every string found within value
+func redactLeaves(value any, rule redactRule) any {
+	switch typed := value.(type) {
+	case string:
+		return redactString(typed, rule)
+	case map[string]any:
+		for k, v := range typed {
+			typed[k] = redactLeaves(v, rule)
+		}
+	case []any:
+		for i, v := range typed {
+			typed[i] = redactLeaves(v, rule)
+		}
+	}
+	return value
+}
+
+func redactString(value string, rule redactRule) string {
+	switch rule.action {
+	case redactActionTruncate:
+		runes := []rune(value)
+		if len(runes) <= rule.length {
+			return value
+		}
+		return fmt.Sprintf("%s…<truncated %d bytes>", string(runes[:rule.length]), len(value))
+	case redactActionHash:
+		sum := sha256.Sum256([]byte(value))
+		return fmt.Sprintf("<sha256:%s %d bytes>", hex.EncodeToString(sum[:8]), len(value))
+	default:
+		return "<redacted>"
+	}
+}
+
+// stripBase64Payloads replaces every base64 data URL (images, audio, files) wherever it is
+func stripBase64Payloads(value any) any {
+	switch typed := value.(type) {
+	case string:
+		if strings.HasPrefix(typed, "data:") {
+			if mediaType, _, found := strings.Cut(typed, ";base64,"); found {
+				return fmt.Sprintf("<%s;base64 stripped, %d bytes>", mediaType, len(typed))
+			}
+		}
+	case map[string]any:
+		for k, v := range typed {
+			typed[k] = stripBase64Payloads(v)
+		}
+	case []any:
+		for i, v := range typed {
+			typed[i] = stripBase64Payloads(v)
+		}
+	}
+	return value
+}
+
+// redactHandler is a slog.Handler redacting HTTP bodies and headers before they reach the
+// wrapped handler. It allows COMPLETE dumps to be used without exposing user data.
+type redactHandler struct {
+	next  slog.Handler
+	rules []redactRule
+}
+
+func newRedactHandler(next slog.Handler, rules []redactRule) *redactHandler {
+	return &redactHandler{
+		next:  next,
+		rules: rules,
+	}
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.redactAttr(attr)
+	}
+	return newRedactHandler(h.next.WithAttrs(redacted), h.rules)
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return newRedactHandler(h.next.WithGroup(name), h.rules)
+}
+
+func (h *redactHandler) redactAttr(attr slog.Attr) slog.Attr {
+	for _, key := range redactedBodyAttrs {
+		if attr.Key == key && attr.Value.Kind() == slog.KindString {
+			return slog.String(attr.Key, redactBody(attr.Value.String(), h.rules))
+		}
+	}
+	if headers, ok := attr.Value.Any().(http.Header); ok {
+		return slog.Any(attr.Key, maskHeaders(headers))
+	}
+	return attr
+}
+
+// maskHeaders returns a copy of headers with the sensitive ones masked
+func maskHeaders(headers http.Header) http.Header {
+	masked := headers.Clone()
+	for _, header := range sensitiveHeaders {
+		values := masked.Values(header)
+		for i := range values {
+			values[i] = "<redacted>"
+		}
+	}
+	return masked
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseRedactRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []redactRule
+		wantErr string
+	}{
+		{
+			name: "empty",
+			raw:  "",
+		},
+		{
+			name: "all actions",
+			raw:  "messages.*.content=truncate:64, prompt=hash,,choices.0.text=strip",
+			want: []redactRule{
+				{path: []string{"messages", "*", "content"}, action: redactActionTruncate, length: 64},
+				{path: []string{"prompt"}, action: redactActionHash},
+				{path: []string{"choices", "0", "text"}, action: redactActionStrip},
+			},
+		},
+		{
+			name: "zero length truncate",
+			raw:  "prompt=truncate:0",
+			want: []redactRule{{path: []string{"prompt"}, action: redactActionTruncate}},
+		},
+		{
+			name:    "missing action",
+			raw:     "prompt",
+			wantErr: "expected json.path=action",
+		},
+		{
+			name:    "missing path",
+			raw:     "=hash",
+			wantErr: "expected json.path=action",
+		},
+		{
+			name:    "negative truncate",
+			raw:     "prompt=truncate:-1",
+			wantErr: "non-negative length",
+		},
+		{
+			name:    "truncate without length",
+			raw:     "prompt=truncate",
+			wantErr: "non-negative length",
+		},
+		{
+			name:    "unknown action",
+			raw:     "prompt=encrypt",
+			wantErr: `unknown action "encrypt"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseRedactRules(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.EqualFunc(rules, tt.want, func(a, b redactRule) bool {
+				return slices.Equal(a.path, b.path) && a.action == b.action && a.length == b.length
+			}) {
+				t.Errorf("got %+v, want %+v", rules, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	rules, err := parseRedactRules("messages.*.content=truncate:5,messages.*.reasoning=hash,choices.*.delta.content=strip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "empty",
+			body: "",
+			want: "",
+		},
+		{
+			name: "json truncate",
+			body: `{"model":"m","messages":[{"role":"user","content":"hello world"},{"role":"user","content":"hi"}]}`,
+			want: `{"messages":[{"content":"hello…<truncated 11 bytes>","role":"user"},{"content":"hi","role":"user"}],"model":"m"}`,
+		},
+		{
+			name: "json truncate counts runes",
+			body: `{"messages":[{"content":"héllo wörld"}]}`,
+			want: `{"messages":[{"content":"héllo…<truncated 13 bytes>"}]}`,
+		},
+		{
+			name: "json hash",
+			body: `{"messages":[{"reasoning":"secret"}]}`,
+			want: `{"messages":[{"reasoning":"<sha256:2bb80d537b1da3e3 6 bytes>"}]}`,
+		},
+		{
+			name: "rule on an object applies to every string within",
+			body: `{"messages":[{"content":[{"type":"text","text":"hello world"}]}]}`,
+			want: `{"messages":[{"content":[{"text":"hello…<truncated 11 bytes>","type":"text"}]}]}`,
+		},
+		{
+			name: "numbers are kept as is",
+			body: `{"temperature":0.60,"max_tokens":12345678901234567890}`,
+			want: `{"max_tokens":12345678901234567890,"temperature":0.60}`,
+		},
+		{
+			name: "base64 payloads are stripped anywhere",
+			body: `{"image":"data:image/png;base64,iVBORw0KGgo="}`,
+			want: `{"image":"<data:image/png;base64 stripped, 34 bytes>"}`,
+		},
+		{
+			name: "not json nor sse",
+			body: "plain text body",
+			want: "<redacted 15 bytes>",
+		},
+		{
+			name: "sse events",
+			body: "data: {\"choices\":[{\"delta\":{\"content\":\"abc\"}}]}\n\n: keepalive\n\ndata: [DONE]\n\n",
+			want: "data: {\"choices\":[{\"delta\":{\"content\":\"<redacted>\"}}]}\n\n: keepalive\n\ndata: [DONE]\n\n",
+		},
+		{
+			name: "sse event that is not json",
+			body: "data: not json\n\n",
+			want: "data: <redacted 8 bytes>\n\n",
+		},
+		{
+			name: "sse dump cut within a line",
+			body: "data: {\"choices\":[]}\n\ndata: {\"cho",
+			want: "data: {\"choices\":[]}\n\n<redacted incomplete event>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactBody(tt.body, rules); got != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskHeaders(t *testing.T) {
+	headers := http.Header{
+		"Authorization": {"Bearer sk-secret"},
+		"Cookie":        {"a=1", "b=2"},
+		"Content-Type":  {"application/json"},
+	}
+	masked := maskHeaders(headers)
+	if got := masked.Get("Authorization"); got != "<redacted>" {
+		t.Errorf("Authorization not masked: %q", got)
+	}
+	if got := masked.Values("Cookie"); !slices.Equal(got, []string{"<redacted>", "<redacted>"}) {
+		t.Errorf("Cookie not masked: %q", got)
+	}
+	if got := masked.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type altered: %q", got)
+	}
+	if got := headers.Get("Authorization"); got != "Bearer sk-secret" {
+		t.Errorf("original headers altered: %q", got)
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hekmon/httplog/v3"
+)
+
+// responses handles /v1/responses (Responses API). vLLM's own Responses endpoint ignores
+// chat_template_kwargs, so requests are translated into chat completions, handled by chat
+// (the transform handler, profile logic and fixes included), and the chat completion is
+// translated back into a response, streamed or not. Completed responses are kept in store, if
+// set, so later requests can continue them.
+func responses(chat http.HandlerFunc, store *responseStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r.Context())
+		ctx := r.Context()
+		// Read request body
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		requestBody, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error("failed to read body", slog.String("error", err.Error()))
+			httpError(ctx, w, readBodyStatusCode(err))
+			return
+		}
+		// Parse request body
+		var request map[string]any
+		if err = json.Unmarshal(requestBody, &request); err != nil {
+			logger.Error("failed to parse body as JSON", slog.String("error", err.Error()))
+			httpError(ctx, w, http.StatusBadRequest)
+			return
+		}
+		// Resolve the conversation it continues, if any
+		var tenant string
+		var history []any
+		if store != nil {
+			tenant = tenantKey(r.Header)
+			history, err = store.history(tenant, request)
+		} else if request["previous_response_id"] != nil || request["conversation"] != nil {
+			err = errors.New("previous_response_id and conversation require the response store, send the whole conversation as input")
+		}
+		if err != nil {
+			logger.Error("failed to resolve the conversation history", slog.String("error", err.Error()))
+			responsesError(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		// Translate it into a chat completion request
+		input, err := responsesInputItems(request["input"])
+		if err != nil {
+			logger.Error("unsupported responses request", slog.String("error", err.Error()))
+			responsesError(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		chatRequest, err := chatCompletionRequest(request, append(history, input...))
+		if err != nil {
+			logger.Error("unsupported responses request", slog.String("error", err.Error()))
+			responsesError(ctx, w, http.StatusBadRequest, err)
+			return
+		}
+		chatBody, err := json.Marshal(chatRequest)
+		if err != nil {
+			logger.Error("failed to marshal chat completion request body", slog.Any("error", err))
+			httpError(ctx, w, http.StatusInternalServerError)
+			return
+		}
+		logger.Debug("responses request translated to chat completion", slog.String("body", string(chatBody)))
+		chatReq := r.Clone(ctx)
+		chatReq.URL.Path = "/v1/chat/completions"
+		chatReq.URL.RawPath = ""
+		chatReq.Body = io.NopCloser(bytes.NewReader(chatBody))
+		chatReq.ContentLength = int64(len(chatBody))
+		// Handle the chat completion, translating its response on the fly
+		builder := newResponseBuilder(request, store != nil && request["store"] != false)
+		rw := newResponsesWriter(ctx, w, builder, chatRequest["stream"] == true, logger)
+		withResponseController(chat)(rw, chatReq)
+		rw.finish()
+		// Keep the completed response
+		if completed := rw.completedResponse(); builder.store && completed != nil {
+			if err = store.saveResponse(tenant, request, input, completed); err != nil {
+				logger.Error("failed to update the response store", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// responsesError writes an OpenAI error describing err
+func responsesError(ctx context.Context, w http.ResponseWriter, statusCode int, err error) {
+	errorBody := openAIError(ctx, statusCode)
+	errorObject, _ := errorBody["error"].(map[string]any)
+	errorObject["message"] = fmt.Sprintf("%s (request id #%v)", err, ctx.Value(httplog.ReqIDKey))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(errorBody); err != nil {
+		logger.Error("failed to write error response", slog.Any("error", err))
+	}
+}
+
+// chatCompletionRequest translates a parsed Responses request into a chat completion request,
+// items being the whole conversation: its history and the request input
+func chatCompletionRequest(request map[string]any, items []any) (chat map[string]any, err error) {
+	if background, _ := request["background"].(bool); background {
+		return nil, errors.New("background responses are not supported")
+	}
+	chat = map[string]any{"model": request["model"]}
+	// Messages
+	messages, err := responsesInputMessages(items)
+	if err != nil {
+		return nil, err
+	}
+	if instructions, _ := request["instructions"].(string); instructions != "" {
+		// Qwen chat templates only accept a leading system message: merge them
+		first, _ := messages[0].(map[string]any)
+		if content, isText := first["content"].(string); first["role"] == "system" && isText {
+			first["content"] = instructions + "\n\n" + content
+		} else {
+			messages = append([]any{map[string]any{"role": "system", "content": instructions}}, messages...)
+		}
+	}
+	chat["messages"] = messages
+	// Tools
+	if tools, _ := request["tools"].([]any); len(tools) > 0 {
+		if chat["tools"], err = responsesTools(tools); err != nil {
+			return nil, err
+		}
+	}
+	switch toolChoice := request["tool_choice"].(type) {
+	case nil:
+	case string:
+		chat["tool_choice"] = toolChoice
+	case map[string]any:
+		if toolChoice["type"] != "function" {
+			return nil, fmt.Errorf("unsupported tool_choice type %v: only function tools are supported", toolChoice["type"])
+		}
+		chat["tool_choice"] = map[string]any{"type": "function", "function": map[string]any{"name": toolChoice["name"]}}
+	default:
+		return nil, errors.New("invalid tool_choice")
+	}
+	// Output format
+	text, _ := request["text"].(map[string]any)
+	if format, _ := text["format"].(map[string]any); format != nil {
+		switch format["type"] {
+		case "text", nil:
+		case "json_object":
+			chat["response_format"] = map[string]any{"type": "json_object"}
+		case "json_schema":
+			jsonSchema := map[string]any{"name": format["name"], "schema": format["schema"]}
+			for _, field := range []string{"description", "strict"} {
+				if value, found := format[field]; found {
+					jsonSchema[field] = value
+				}
+			}
+			chat["response_format"] = map[string]any{"type": "json_schema", "json_schema": jsonSchema}
+		default:
+			return nil, fmt.Errorf("unsupported text.format type %v", format["type"])
+		}
+	}
+	// Reasoning: thinking is driven by the profile, the effort is left to the chat template
+	reasoning, _ := request["reasoning"].(map[string]any)
+	if effort, _ := reasoning["effort"].(string); effort != "" {
+		chat["reasoning_effort"] = effort
+	}
+	// Sampling and limits
+	for _, field := range []string{"temperature", "top_p", "parallel_tool_calls", "user"} {
+		if value, found := request[field]; found && value != nil {
+			chat[field] = value
+		}
+	}
+	if maxTokens, found := request["max_output_tokens"]; found && maxTokens != nil {
+		chat["max_tokens"] = maxTokens
+	}
+	if stream, _ := request["stream"].(bool); stream {
+		chat["stream"] = true
+		chat["stream_options"] = map[string]any{"include_usage": true}
+	}
+	return chat, nil
+}
+
+// responsesInputItems returns the input items of a Responses request, a text being a user message
+func responsesInputItems(input any) ([]any, error) {
+	switch typed := input.(type) {
+	case string:
+		return []any{map[string]any{"type": "message", "role": "user", "content": typed}}, nil
+	case []any:
+		return typed, nil
+	default:
+		return nil, errors.New("missing or invalid input")
+	}
+}
+
+// responsesInputMessages translates Responses items into chat messages
+func responsesInputMessages(items []any) (messages []any, err error) {
+	var reasoning string // reasoning item, carried by the next assistant message
+	var toolCallsMessage map[string]any
+	for i, item := range items {
+		itemMap, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("input[%d]: invalid item", i)
+		}
+		itemType, _ := itemMap["type"].(string)
+		if itemType == "" && itemMap["role"] != nil {
+			itemType = "message"
+		}
+		switch itemType {
+		case "message":
+			toolCallsMessage = nil
+			message, err := responsesInputMessage(itemMap)
+			if err != nil {
+				return nil, fmt.Errorf("input[%d]: %w", i, err)
+			}
+			if message["role"] == "assistant" && reasoning != "" {
+				message["reasoning_content"], reasoning = reasoning, ""
+			}
+			messages = append(messages, message)
+		case "reasoning":
+			reasoning += reasoningItemText(itemMap)
+		case "function_call":
+			// Consecutive calls belong to the same assistant message, with the text before them
+			if toolCallsMessage == nil {
+				var last map[string]any
+				if len(messages) > 0 {
+					last, _ = messages[len(messages)-1].(map[string]any)
+				}
+				if last["role"] == "assistant" && last["tool_calls"] == nil {
+					toolCallsMessage = last
+					toolCallsMessage["tool_calls"] = []any{}
+				} else {
+					toolCallsMessage = map[string]any{"role": "assistant", "content": nil, "tool_calls": []any{}}
+					messages = append(messages, toolCallsMessage)
+				}
+				if reasoning != "" {
+					toolCallsMessage["reasoning_content"], reasoning = reasoning, ""
+				}
+			}
+			toolCallsMessage["tool_calls"] = append(toolCallsMessage["tool_calls"].([]any), map[string]any{
+				"id":   itemMap["call_id"],
+				"type": "function",
+				"function": map[string]any{
+					"name":      itemMap["name"],
+					"arguments": itemMap["arguments"],
+				},
+			})
+		case "function_call_output":
+			toolCallsMessage = nil
+			messages = append(messages, map[string]any{
+				"role":         "tool",
+				"tool_call_id": itemMap["call_id"],
+				"content":      responsesText(itemMap["output"]),
+			})
+		default:
+			return nil, fmt.Errorf("input[%d]: unsupported item type %q", i, itemType)
+		}
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("empty input")
+	}
+	return messages, nil
+}
+
+// responsesInputMessage translates a message item into a chat message
+func responsesInputMessage(item map[string]any) (message map[string]any, err error) {
+	role, _ := item["role"].(string)
+	switch role {
+	case "user", "assistant", "system":
+	case "developer":
+		role = "system"
+	default:
+		return nil, fmt.Errorf("unsupported message role %q", role)
+	}
+	message = map[string]any{"role": role}
+	parts, isList := item["content"].([]any)
+	if !isList {
+		message["content"] = responsesText(item["content"])
+		return message, nil
+	}
+	// Content parts are joined as a single text unless there are images
+	contentParts := make([]any, 0, len(parts))
+	var text strings.Builder
+	hasImages := false
+	for _, part := range parts {
+		partMap, _ := part.(map[string]any)
+		switch partMap["type"] {
+		case "input_text", "output_text", "text":
+			partText, _ := partMap["text"].(string)
+			text.WriteString(partText)
+			contentParts = append(contentParts, map[string]any{"type": "text", "text": partText})
+		case "refusal":
+			refusal, _ := partMap["refusal"].(string)
+			text.WriteString(refusal)
+			contentParts = append(contentParts, map[string]any{"type": "text", "text": refusal})
+		case "input_image":
+			imageURL, _ := partMap["image_url"].(string)
+			if imageURL == "" || role != "user" {
+				return nil, errors.New("only user images given by image_url are supported")
+			}
+			image := map[string]any{"url": imageURL}
+			if detail, found := partMap["detail"]; found {
+				image["detail"] = detail
+			}
+			contentParts = append(contentParts, map[string]any{"type": "image_url", "image_url": image})
+			hasImages = true
+		default:
+			return nil, fmt.Errorf("unsupported content part type %v", partMap["type"])
+		}
+	}
+	if hasImages {
+		message["content"] = contentParts
+	} else {
+		message["content"] = text.String()
+	}
+	return message, nil
+}
+
+// responsesText returns the text of a string or of a list of text content parts
+func responsesText(content any) string {
+	switch typed := content.(type) {
+	case string:
+		return typed
+	case []any:
+		var text strings.Builder
+		for _, part := range typed {
+			partMap, _ := part.(map[string]any)
+			partText, _ := partMap["text"].(string)
+			text.WriteString(partText)
+		}
+		return text.String()
+	case nil:
+		return ""
+	default:
+		encoded, _ := json.Marshal(typed)
+		return string(encoded)
+	}
+}
+
+// reasoningItemText returns the text of a reasoning item: its content, or its summary
+func reasoningItemText(item map[string]any) string {
+	if text := responsesText(item["content"]); text != "" {
+		return text
+	}
+	return responsesText(item["summary"])
+}
+
+// responsesTools translates the function tools of a Responses request into chat tools
+func responsesTools(tools []any) (chatTools []any, err error) {
+	chatTools = make([]any, 0, len(tools))
+	for i, tool := range tools {
+		toolMap, _ := tool.(map[string]any)
+		if toolMap["type"] != "function" {
+			return nil, fmt.Errorf("tools[%d]: unsupported tool type %v: only function tools are supported", i, toolMap["type"])
+		}
+		function := map[string]any{"name": toolMap["name"]}
+		for _, field := range []string{"description", "parameters", "strict"} {
+			if value, found := toolMap[field]; found && value != nil {
+				function[field] = value
+			}
+		}
+		chatTools = append(chatTools, map[string]any{"type": "function", "function": function})
+	}
+	return chatTools, nil
+}
+
+// responseBuilder builds the response objects of a request, echoing its parameters
+type responseBuilder struct {
+	id        string
+	createdAt int64
+	request   map[string]any
+	store     bool // the response is stored once completed
+}
+
+func newResponseBuilder(request map[string]any, store bool) *responseBuilder {
+	return &responseBuilder{
+		id:        "resp_" + rand.Text(),
+		createdAt: time.Now().Unix(),
+		request:   request,
+		store:     store,
+	}
+}
+
+// response returns the response object with the given status and output
+func (rb *responseBuilder) response(status string, output []any, usage map[string]any) map[string]any {
+	response := map[string]any{
+		"id":                   rb.id,
+		"object":               "response",
+		"created_at":           rb.createdAt,
+		"status":               status,
+		"error":                nil,
+		"incomplete_details":   nil,
+		"model":                rb.request["model"],
+		"output":               output,
+		"usage":                usage,
+		"instructions":         nil,
+		"max_output_tokens":    nil,
+		"metadata":             map[string]any{},
+		"parallel_tool_calls":  true,
+		"previous_response_id": nil,
+		"reasoning":            map[string]any{"effort": nil, "summary": nil},
+		"store":                rb.store,
+		"temperature":          nil,
+		"text":                 map[string]any{"format": map[string]any{"type": "text"}},
+		"tool_choice":          "auto",
+		"tools":                []any{},
+		"top_p":                nil,
+		"user":                 nil,
+	}
+	for _, field := range []string{"instructions", "max_output_tokens", "metadata", "parallel_tool_calls",
+		"previous_response_id", "reasoning", "temperature", "text", "tool_choice", "tools", "top_p", "user"} {
+		if value, found := rb.request[field]; found && value != nil {
+			response[field] = value
+		}
+	}
+	if conversation := requestConversation(rb.request); conversation != "" {
+		response["conversation"] = map[string]any{"id": conversation}
+	}
+	return response
+}
+
+// completedResponse returns the final response object of a choice finished for finishReason
+func (rb *responseBuilder) completedResponse(output []any, usage map[string]any, finishReason string) map[string]any {
+	switch finishReason {
+	case "length":
+		response := rb.response("incomplete", output, usage)
+		response["incomplete_details"] = map[string]any{"reason": "max_output_tokens"}
+		return response
+	case "content_filter":
+		response := rb.response("incomplete", output, usage)
+		response["incomplete_details"] = map[string]any{"reason": "content_filter"}
+		return response
+	default:
+		return rb.response("completed", output, usage)
+	}
+}
+
+// translate translates a non-streaming chat completion into a response object. Bodies that
+// are not chat completions (e.g. errors) are returned as is, without response.
+func (rb *responseBuilder) translate(chatBody []byte, logger *slog.Logger) (body []byte, response map[string]any) {
+	var completion map[string]any
+	if err := json.Unmarshal(chatBody, &completion); err != nil || completion["error"] != nil {
+		return chatBody, nil
+	}
+	choices, _ := completion["choices"].([]any)
+	var output []any
+	var finishReason string
+	if len(choices) > 0 {
+		choice, _ := choices[0].(map[string]any)
+		message, _ := choice["message"].(map[string]any)
+		output = responseOutput(message)
+		finishReason, _ = choice["finish_reason"].(string)
+	}
+	usage, _ := completion["usage"].(map[string]any)
+	response = rb.completedResponse(output, responseUsage(usage), finishReason)
+	translated, err := json.Marshal(response)
+	if err != nil {
+		logger.Error("failed to marshal response body", slog.Any("error", err))
+		return chatBody, nil
+	}
+	return translated, response
+}
+
+// responseOutput translates a chat completion message into output items
+func responseOutput(message map[string]any) (output []any) {
+	output = []any{}
+	for _, field := range reasoningFields {
+		if reasoning, _ := message[field].(string); reasoning != "" {
+			output = append(output, reasoningItem(reasoning))
+			break
+		}
+	}
+	if content, _ := message["content"].(string); content != "" {
+		output = append(output, messageItem(content, "completed"))
+	}
+	toolCalls, _ := message["tool_calls"].([]any)
+	for _, toolCall := range toolCalls {
+		toolCallMap, _ := toolCall.(map[string]any)
+		function, _ := toolCallMap["function"].(map[string]any)
+		item := functionCallItem(toolCallMap["id"], function["name"], "completed")
+		item["arguments"] = function["arguments"]
+		if validationErr, found := toolCallMap["validation_error"]; found {
+			item["validation_error"] = validationErr
+		}
+		output = append(output, item)
+	}
+	return
+}
+
+func reasoningItem(text string) map[string]any {
+	return map[string]any{
+		"type":    "reasoning",
+		"id":      "rs_" + rand.Text(),
+		"summary": []any{},
+		"content": []any{map[string]any{"type": "reasoning_text", "text": text}},
+	}
+}
+
+func messageItem(text, status string) map[string]any {
+	return map[string]any{
+		"type":    "message",
+		"id":      "msg_" + rand.Text(),
+		"status":  status,
+		"role":    "assistant",
+		"content": []any{outputTextPart(text)},
+	}
+}
+
+func outputTextPart(text string) map[string]any {
+	return map[string]any{"type": "output_text", "text": text, "annotations": []any{}}
+}
+
+func functionCallItem(callID, name any, status string) map[string]any {
+	return map[string]any{
+		"type":      "function_call",
+		"id":        "fc_" + rand.Text(),
+		"call_id":   callID,
+		"name":      name,
+		"arguments": "",
+		"status":    status,
+	}
+}
+
+// responseUsage translates the usage of a chat completion, nil if unknown
+func responseUsage(usage map[string]any) map[string]any {
+	if usage == nil {
+		return nil
+	}
+	promptDetails, _ := usage["prompt_tokens_details"].(map[string]any)
+	completionDetails, _ := usage["completion_tokens_details"].(map[string]any)
+	return map[string]any{
+		"input_tokens":          usageInt(usage, "prompt_tokens"),
+		"input_tokens_details":  map[string]any{"cached_tokens": usageInt(promptDetails, "cached_tokens")},
+		"output_tokens":         usageInt(usage, "completion_tokens"),
+		"output_tokens_details": map[string]any{"reasoning_tokens": usageInt(completionDetails, "reasoning_tokens")},
+		"total_tokens":          usageInt(usage, "total_tokens"),
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChatCompletionRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    string // chat completion request, empty if an error is expected
+	}{
+		{
+			name:    "text input",
+			request: `{"model":"qwen","input":"Hello"}`,
+			want:    `{"model":"qwen","messages":[{"role":"user","content":"Hello"}]}`,
+		},
+		{
+			name:    "instructions merged with the system message",
+			request: `{"model":"qwen","instructions":"Be brief.","input":[{"role":"developer","content":"Answer in French."},{"role":"user","content":"Hello"}]}`,
+			want:    `{"model":"qwen","messages":[{"role":"system","content":"Be brief.\n\nAnswer in French."},{"role":"user","content":"Hello"}]}`,
+		},
+		{
+			name:    "instructions as system message",
+			request: `{"model":"qwen","instructions":"Be brief.","input":"Hello"}`,
+			want:    `{"model":"qwen","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hello"}]}`,
+		},
+		{
+			name: "parameters",
+			request: `{"model":"qwen","input":"Hello","stream":true,"max_output_tokens":100,"temperature":0.5,"top_p":null,"user":"u1",` +
+				`"reasoning":{"effort":"low"},"tool_choice":{"type":"function","name":"get_weather"},` +
+				`"tools":[{"type":"function","name":"get_weather","description":"Weather","parameters":{"type":"object"},"strict":null}],` +
+				`"text":{"format":{"type":"json_schema","name":"answer","schema":{"type":"object"},"strict":true}}}`,
+			want: `{"model":"qwen","messages":[{"role":"user","content":"Hello"}],"stream":true,"stream_options":{"include_usage":true},` +
+				`"max_tokens":100,"temperature":0.5,"user":"u1","reasoning_effort":"low",` +
+				`"tool_choice":{"type":"function","function":{"name":"get_weather"}},` +
+				`"tools":[{"type":"function","function":{"name":"get_weather","description":"Weather","parameters":{"type":"object"}}}],` +
+				`"response_format":{"type":"json_schema","json_schema":{"name":"answer","schema":{"type":"object"},"strict":true}}}`,
+		},
+		{
+			name:    "json object format",
+			request: `{"model":"qwen","input":"Hello","text":{"format":{"type":"json_object"}},"tool_choice":"none"}`,
+			want:    `{"model":"qwen","messages":[{"role":"user","content":"Hello"}],"response_format":{"type":"json_object"},"tool_choice":"none"}`,
+		},
+		{name: "background", request: `{"model":"qwen","input":"Hello","background":true}`},
+		{name: "missing input", request: `{"model":"qwen"}`},
+		{name: "empty input", request: `{"model":"qwen","input":[]}`},
+		{name: "hosted tool", request: `{"model":"qwen","input":"Hello","tools":[{"type":"web_search"}]}`},
+		{name: "hosted tool choice", request: `{"model":"qwen","input":"Hello","tool_choice":{"type":"file_search"}}`},
+		{name: "unknown format", request: `{"model":"qwen","input":"Hello","text":{"format":{"type":"grammar"}}}`},
+		{name: "unknown item", request: `{"model":"qwen","input":[{"type":"web_search_call"}]}`},
+		{name: "unknown role", request: `{"model":"qwen","input":[{"role":"tool","content":"42"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := parseJSONObject(t, tt.request)
+			items, err := responsesInputItems(request["input"])
+			var chat map[string]any
+			if err == nil {
+				chat, err = chatCompletionRequest(request, items)
+			}
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want an error", encodeJSON(t, chat))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := encodeJSON(t, chat), normalizeJSON(t, []byte(tt.want)); got != want {
+				t.Errorf("got  %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+func TestResponsesInputMessages(t *testing.T) {
+	tests := []struct {
+		name  string
+		items string
+		want  string // messages, empty if an error is expected
+	}{
+		{
+			name: "content parts joined",
+			items: `[{"type":"message","role":"user","content":[{"type":"input_text","text":"Hello "},{"type":"input_text","text":"there"}]},` +
+				`{"role":"assistant","content":[{"type":"output_text","text":"Hi","annotations":[]}]}]`,
+			want: `[{"role":"user","content":"Hello there"},{"role":"assistant","content":"Hi"}]`,
+		},
+		{
+			name:  "image parts kept",
+			items: `[{"role":"user","content":[{"type":"input_text","text":"What is it?"},{"type":"input_image","image_url":"https://example.com/a.png","detail":"low"}]}]`,
+			want:  `[{"role":"user","content":[{"type":"text","text":"What is it?"},{"type":"image_url","image_url":{"url":"https://example.com/a.png","detail":"low"}}]}]`,
+		},
+		{
+			name: "reasoning carried by the next assistant message",
+			items: `[{"role":"user","content":"Hello"},` +
+				`{"type":"reasoning","summary":[],"content":[{"type":"reasoning_text","text":"Greet back."}]},` +
+				`{"role":"assistant","content":"Hi"}]`,
+			want: `[{"role":"user","content":"Hello"},{"role":"assistant","content":"Hi","reasoning_content":"Greet back."}]`,
+		},
+		{
+			name: "function calls grouped with the text before them",
+			items: `[{"role":"user","content":"Weather in Paris and Rome?"},` +
+				`{"type":"reasoning","summary":[{"type":"summary_text","text":"Call the tool twice."}]},` +
+				`{"role":"assistant","content":"Let me check."},` +
+				`{"type":"function_call","call_id":"call_1","name":"get_weather","arguments":"{\"city\":\"Paris\"}"},` +
+				`{"type":"function_call","call_id":"call_2","name":"get_weather","arguments":"{\"city\":\"Rome\"}"},` +
+				`{"type":"function_call_output","call_id":"call_1","output":"20C"},` +
+				`{"type":"function_call_output","call_id":"call_2","output":[{"type":"input_text","text":"25C"}]}]`,
+			want: `[{"role":"user","content":"Weather in Paris and Rome?"},` +
+				`{"role":"assistant","content":"Let me check.","reasoning_content":"Call the tool twice.","tool_calls":[` +
+				`{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}},` +
+				`{"id":"call_2","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Rome\"}"}}]},` +
+				`{"role":"tool","tool_call_id":"call_1","content":"20C"},` +
+				`{"role":"tool","tool_call_id":"call_2","content":"25C"}]`,
+		},
+		{
+			name: "function call without text",
+			items: `[{"role":"user","content":"Weather?"},` +
+				`{"type":"reasoning","content":[{"type":"reasoning_text","text":"Call the tool."}]},` +
+				`{"type":"function_call","call_id":"call_1","name":"get_weather","arguments":"{}"}]`,
+			want: `[{"role":"user","content":"Weather?"},` +
+				`{"role":"assistant","content":null,"reasoning_content":"Call the tool.","tool_calls":[` +
+				`{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{}"}}]}]`,
+		},
+		{
+			name:  "assistant image",
+			items: `[{"role":"assistant","content":[{"type":"input_image","image_url":"https://example.com/a.png"}]}]`,
+		},
+		{
+			name:  "image file",
+			items: `[{"role":"user","content":[{"type":"input_image","file_id":"file_1"}]}]`,
+		},
+		{
+			name:  "unknown content part",
+			items: `[{"role":"user","content":[{"type":"input_audio"}]}]`,
+		},
+		{
+			name:  "invalid item",
+			items: `["Hello"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var items []any
+			if err := json.Unmarshal([]byte(tt.items), &items); err != nil {
+				t.Fatal(err)
+			}
+			messages, err := responsesInputMessages(items)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want an error", encodeJSON(t, messages))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := encodeJSON(t, messages), normalizeJSON(t, []byte(tt.want)); got != want {
+				t.Errorf("got  %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+// outputWithoutIDs returns the canonical encoding of the output items of a response, without
+// their random IDs
+func outputWithoutIDs(t *testing.T, response map[string]any) string {
+	t.Helper()
+	output, _ := response["output"].([]any)
+	for _, item := range output {
+		itemMap, _ := item.(map[string]any)
+		id, _ := itemMap["id"].(string)
+		if !strings.Contains(id, "_") {
+			t.Errorf("invalid item id %q", id)
+		}
+		delete(itemMap, "id")
+	}
+	return encodeJSON(t, output)
+}
+
+func TestResponseBuilderTranslate(t *testing.T) {
+	tests := []struct {
+		name       string
+		chatBody   string
+		wantStatus string // empty if the body is returned as is
+		wantOutput string
+		wantUsage  string
+	}{
+		{
+			name: "reasoning and answer",
+			chatBody: `{"id":"c1","object":"chat.completion","model":"qwen","choices":[{"index":0,"finish_reason":"stop",` +
+				`"message":{"role":"assistant","reasoning_content":"Greet back.","content":"Hi"}}],` +
+				`"usage":{"prompt_tokens":5,"completion_tokens":4,"total_tokens":9,"prompt_tokens_details":{"cached_tokens":2},"completion_tokens_details":{"reasoning_tokens":3}}}`,
+			wantStatus: "completed",
+			wantOutput: `[{"type":"reasoning","summary":[],"content":[{"type":"reasoning_text","text":"Greet back."}]},` +
+				`{"type":"message","status":"completed","role":"assistant","content":[{"type":"output_text","text":"Hi","annotations":[]}]}]`,
+			wantUsage: `{"input_tokens":5,"input_tokens_details":{"cached_tokens":2},"output_tokens":4,"output_tokens_details":{"reasoning_tokens":3},"total_tokens":9}`,
+		},
+		{
+			name: "tool calls",
+			chatBody: `{"choices":[{"index":0,"finish_reason":"tool_calls","message":{"role":"assistant","reasoning":"Call it.","content":null,"tool_calls":[` +
+				`{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}},` +
+				`{"id":"call_2","type":"function","function":{"name":"get_time","arguments":"{"},"validation_error":"invalid JSON arguments"}]}}],` +
+				`"usage":{"prompt_tokens":5,"completion_tokens":4,"total_tokens":9}}`,
+			wantStatus: "completed",
+			wantOutput: `[{"type":"reasoning","summary":[],"content":[{"type":"reasoning_text","text":"Call it."}]},` +
+				`{"type":"function_call","call_id":"call_1","name":"get_weather","arguments":"{\"city\":\"Paris\"}","status":"completed"},` +
+				`{"type":"function_call","call_id":"call_2","name":"get_time","arguments":"{","status":"completed","validation_error":"invalid JSON arguments"}]`,
+			wantUsage: `{"input_tokens":5,"input_tokens_details":{"cached_tokens":0},"output_tokens":4,"output_tokens_details":{"reasoning_tokens":0},"total_tokens":9}`,
+		},
+		{
+			name:       "truncated",
+			chatBody:   `{"choices":[{"index":0,"finish_reason":"length","message":{"role":"assistant","reasoning_content":"Let me"}}]}`,
+			wantStatus: "incomplete",
+			wantOutput: `[{"type":"reasoning","summary":[],"content":[{"type":"reasoning_text","text":"Let me"}]}]`,
+			wantUsage:  `null`,
+		},
+		{
+			name:     "error",
+			chatBody: `{"error":{"message":"context too long","type":"BadRequestError","code":400}}`,
+		},
+		{
+			name:     "not JSON",
+			chatBody: `Internal Server Error`,
+		},
+	}
+	request := map[string]any{"model": "qwen", "input": "Hello", "temperature": 0.5, "metadata": map[string]any{"k": "v"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := newResponseBuilder(request, true)
+			body, response := builder.translate([]byte(tt.chatBody), slog.New(slog.DiscardHandler))
+			if tt.wantStatus == "" {
+				if response != nil || string(body) != tt.chatBody {
+					t.Errorf("got body %s, want it untouched", body)
+				}
+				return
+			}
+			if response == nil {
+				t.Fatalf("not translated: %s", body)
+			}
+			// The body is the encoding of the returned response
+			if got, want := normalizeJSON(t, body), encodeJSON(t, response); got != want {
+				t.Errorf("body %s does not match the response %s", got, want)
+			}
+			if response["id"] != builder.id || response["object"] != "response" || response["model"] != "qwen" ||
+				response["status"] != tt.wantStatus || response["store"] != true || response["temperature"] != 0.5 {
+				t.Errorf("got response %s", body)
+			}
+			if tt.wantStatus == "incomplete" {
+				if got := encodeJSON(t, response["incomplete_details"]); got != `{"reason":"max_output_tokens"}` {
+					t.Errorf("got incomplete details %s", got)
+				}
+			}
+			if got := encodeJSON(t, response["usage"]); got != normalizeJSON(t, []byte(tt.wantUsage)) {
+				t.Errorf("got usage %s, want %s", got, tt.wantUsage)
+			}
+			if got, want := outputWithoutIDs(t, response), normalizeJSON(t, []byte(tt.wantOutput)); got != want {
+				t.Errorf("got output  %s\nwant output %s", got, want)
+			}
+		})
+	}
+}
+
+// responseEvents parses a response event stream, checking the event names and sequence numbers.
+// Each event is summarized by its type and its main field.
+func responseEvents(t *testing.T, stream []byte) (summaries []string, last map[string]any) {
+	t.Helper()
+	reader := newSSEReader(bytes.NewReader(stream), 1<<20)
+	sequence := 0
+	for {
+		event, err := reader.next()
+		if err != nil {
+			break
+		}
+		if !event.hasData() {
+			summaries = append(summaries, "comment")
+			continue
+		}
+		var data map[string]any
+		if err = json.Unmarshal(event.Data(), &data); err != nil {
+			t.Fatalf("invalid event data %s: %v", event.Data(), err)
+		}
+		eventType, _ := data["type"].(string)
+		if string(event.name) != eventType {
+			t.Errorf("event %q carries a %q payload", event.name, eventType)
+		}
+		if data["sequence_number"] != float64(sequence) {
+			t.Errorf("event %s: got sequence number %v, want %d", eventType, data["sequence_number"], sequence)
+		}
+		sequence++
+		summary := eventType
+		switch {
+		case data["delta"] != nil:
+			summary += fmt.Sprintf(" %v", data["delta"])
+		case data["text"] != nil:
+			summary += fmt.Sprintf(" %v", data["text"])
+		case data["arguments"] != nil:
+			summary += fmt.Sprintf(" %v", data["arguments"])
+		case data["part"] != nil:
+			summary += fmt.Sprintf(" %v", data["part"].(map[string]any)["type"])
+		case data["item"] != nil:
+			item := data["item"].(map[string]any)
+			summary += fmt.Sprintf(" %v", item["type"])
+			if status, found := item["status"]; found {
+				summary += fmt.Sprintf(" %v", status)
+			}
+		case data["response"] != nil:
+			summary += fmt.Sprintf(" %v", data["response"].(map[string]any)["status"])
+		case data["message"] != nil:
+			summary += fmt.Sprintf(" %v", data["message"])
+		}
+		summaries = append(summaries, summary)
+		last = data
+	}
+	return
+}
+
+func TestResponsesWriterStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		stream     string
+		wantEvents []string
+		wantOutput string // output of the final response, empty if it failed
+	}{
+		{
+			name: "reasoning and answer",
+			stream: sseStream(
+				`{"choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`,
+				`{"choices":[{"index":0,"delta":{"reasoning_content":"Greet"}}]}`,
+				`{"choices":[{"index":0,"delta":{"reasoning_content":" back."}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"Hi"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":" there"},"finish_reason":"stop"}]}`,
+				`{"choices":[],"usage":{"prompt_tokens":5,"completion_tokens":4,"total_tokens":9}}`,
+				`[DONE]`,
+			) + ": keepalive\n\n",
+			wantEvents: []string{
+				"response.created in_progress",
+				"response.in_progress in_progress",
+				"response.output_item.added reasoning",
+				"response.content_part.added reasoning_text",
+				"response.reasoning_text.delta Greet",
+				"response.reasoning_text.delta  back.",
+				"response.reasoning_text.done Greet back.",
+				"response.content_part.done reasoning_text",
+				"response.output_item.done reasoning",
+				"response.output_item.added message in_progress",
+				"response.content_part.added output_text",
+				"response.output_text.delta Hi",
+				"response.output_text.delta  there",
+				"response.output_text.done Hi there",
+				"response.content_part.done output_text",
+				"response.output_item.done message completed",
+				"response.completed completed",
+				"comment",
+			},
+			wantOutput: `[{"type":"reasoning","summary":[],"content":[{"type":"reasoning_text","text":"Greet back."}]},` +
+				`{"type":"message","status":"completed","role":"assistant","content":[{"type":"output_text","text":"Hi there","annotations":[]}]}]`,
+		},
+		{
+			name: "function calls",
+			stream: sseStream(
+				`{"choices":[{"index":0,"delta":{"reasoning":"Call it."}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"get_weather","arguments":""}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_2","function":{"name":"get_time","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`,
+				`[DONE]`,
+			),
+			wantEvents: []string{
+				"response.created in_progress",
+				"response.in_progress in_progress",
+				"response.output_item.added reasoning",
+				"response.content_part.added reasoning_text",
+				"response.reasoning_text.delta Call it.",
+				"response.reasoning_text.done Call it.",
+				"response.content_part.done reasoning_text",
+				"response.output_item.done reasoning",
+				"response.output_item.added function_call in_progress",
+				`response.function_call_arguments.delta {"city":`,
+				`response.function_call_arguments.delta "Paris"}`,
+				`response.function_call_arguments.done {"city":"Paris"}`,
+				"response.output_item.done function_call completed",
+				"response.output_item.added function_call in_progress",
+				"response.function_call_arguments.delta {}",
+				"response.function_call_arguments.done {}",
+				"response.output_item.done function_call completed",
+				"response.completed completed",
+			},
+			wantOutput: `[{"type":"reasoning","summary":[],"content":[{"type":"reasoning_text","text":"Call it."}]},` +
+				`{"type":"function_call","call_id":"call_1","name":"get_weather","arguments":"{\"city\":\"Paris\"}","status":"completed"},` +
+				`{"type":"function_call","call_id":"call_2","name":"get_time","arguments":"{}","status":"completed"}]`,
+		},
+		{
+			name: "truncated",
+			stream: sseStream(
+				`{"choices":[{"index":0,"delta":{"content":"Once upon"}},{"index":1,"delta":{"content":"ignored"}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"length"}]}`,
+				`[DONE]`,
+			),
+			wantEvents: []string{
+				"response.created in_progress",
+				"response.in_progress in_progress",
+				"response.output_item.added message in_progress",
+				"response.content_part.added output_text",
+				"response.output_text.delta Once upon",
+				"response.output_text.done Once upon",
+				"response.content_part.done output_text",
+				"response.output_item.done message completed",
+				"response.incomplete incomplete",
+			},
+			wantOutput: `[{"type":"message","status":"completed","role":"assistant","content":[{"type":"output_text","text":"Once upon","annotations":[]}]}]`,
+		},
+		{
+			name: "error",
+			stream: sseStream(
+				`{"choices":[{"index":0,"delta":{"content":"Once"}}]}`,
+				`{"error":{"message":"stream stalled","type":"Gateway Timeout","code":504}}`,
+				`[DONE]`,
+			),
+			wantEvents: []string{
+				"response.created in_progress",
+				"response.in_progress in_progress",
+				"response.output_item.added message in_progress",
+				"response.content_part.added output_text",
+				"response.output_text.delta Once",
+				"error stream stalled",
+				"response.failed failed",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			builder := newResponseBuilder(map[string]any{"model": "qwen"}, false)
+			rw := newResponsesWriter(context.Background(), recorder, builder, true, slog.New(slog.DiscardHandler))
+			rw.Header().Set("Content-Type", "text/event-stream")
+			rw.Header().Set("Content-Length", "1000")
+			rw.WriteHeader(http.StatusOK)
+			// Events split across writes
+			stream := []byte(tt.stream)
+			for len(stream) > 0 {
+				size := min(len(stream), 37)
+				if n, err := rw.Write(stream[:size]); err != nil || n != size {
+					t.Fatalf("got write %d %v", n, err)
+				}
+				stream = stream[size:]
+			}
+			rw.finish()
+			if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Length") != "" {
+				t.Errorf("got HTTP %d with headers %v", recorder.Code, recorder.Header())
+			}
+			events, last := responseEvents(t, recorder.Body.Bytes())
+			if got, want := strings.Join(events, "\n"), strings.Join(tt.wantEvents, "\n"); got != want {
+				t.Errorf("got events\n%s\nwant\n%s", got, want)
+			}
+			completed := rw.completedResponse()
+			if tt.wantOutput == "" {
+				if completed != nil {
+					t.Errorf("got completed response for a failed one")
+				}
+				response, _ := last["response"].(map[string]any)
+				if got := encodeJSON(t, response["error"]); got != `{"code":"Gateway Timeout","message":"stream stalled"}` {
+					t.Errorf("got error %s", got)
+				}
+				return
+			}
+			if completed == nil {
+				t.Fatal("no completed response")
+			}
+			if got, want := outputWithoutIDs(t, completed), normalizeJSON(t, []byte(tt.wantOutput)); got != want {
+				t.Errorf("got output  %s\nwant output %s", got, want)
+			}
+		})
+	}
+}
+
+func TestResponsesWriterNonStreaming(t *testing.T) {
+	tests := []struct {
+		name       string
+		writes     []string // JSON keepalive spaces, then the body
+		status     int
+		wantStatus int
+		wantPrefix string
+		wantBody   string // untranslated body, empty if translated
+	}{
+		{
+			name:       "completion",
+			writes:     []string{`{"choices":[{"index":0,"finish_reason":"stop",`, `"message":{"role":"assistant","content":"Hi"}}]}`},
+			status:     http.StatusOK,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "completion after JSON keepalives",
+			writes:     []string{" ", " ", `{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"Hi"}}]}`},
+			status:     http.StatusOK,
+			wantStatus: http.StatusOK,
+			wantPrefix: "  ",
+		},
+		{
+			name:       "error",
+			writes:     []string{`{"error":{"message":"context too long","code":400}}`},
+			status:     http.StatusBadRequest,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"message":"context too long","code":400}}`,
+		},
+		{
+			name:       "error after JSON keepalives",
+			writes:     []string{" ", `{"error":{"message":"Bad Gateway","code":502}}`},
+			status:     http.StatusOK, // sent with the keepalives
+			wantStatus: http.StatusOK,
+			wantPrefix: " ",
+			wantBody:   `{"error":{"message":"Bad Gateway","code":502}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			builder := newResponseBuilder(map[string]any{"model": "qwen"}, false)
+			rw := newResponsesWriter(context.Background(), recorder, builder, false, slog.New(slog.DiscardHandler))
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(tt.status)
+			for _, write := range tt.writes {
+				if _, err := rw.Write([]byte(write)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rw.finish()
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("got HTTP %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			body := recorder.Body.String()
+			if !strings.HasPrefix(body, tt.wantPrefix) || strings.TrimLeft(body, " ") != body[len(tt.wantPrefix):] {
+				t.Errorf("got body %q, want the %q prefix", body, tt.wantPrefix)
+			}
+			body = body[len(tt.wantPrefix):]
+			if tt.wantBody != "" {
+				if body != tt.wantBody || rw.completedResponse() != nil {
+					t.Errorf("got body %s, want %s", body, tt.wantBody)
+				}
+				return
+			}
+			completed := rw.completedResponse()
+			if completed == nil || normalizeJSON(t, []byte(body)) != encodeJSON(t, completed) {
+				t.Fatalf("got body %s, want the completed response", body)
+			}
+			if completed["status"] != "completed" || outputWithoutIDs(t, completed) !=
+				normalizeJSON(t, []byte(`[{"type":"message","status":"completed","role":"assistant","content":[{"type":"output_text","text":"Hi","annotations":[]}]}]`)) {
+				t.Errorf("got response %s", body)
+			}
+			// The content length is only known without keepalive
+			if tt.wantPrefix == "" && recorder.Header().Get("Content-Length") != fmt.Sprint(len(body)) {
+				t.Errorf("got Content-Length %q for %d bytes", recorder.Header().Get("Content-Length"), len(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responsesWriter translates the response of the chat completion handler into a response of
+// the Responses API. Streamed chat completions are translated event by event, other bodies
+// are buffered and translated by finish. The leading whitespace of the JSON keepalive is
+// written through.
+type responsesWriter struct {
+	ctx        context.Context // request context, holding the response controller of w
+	w          http.ResponseWriter
+	header     http.Header
+	builder    *responseBuilder
+	stream     bool // streaming requested
+	logger     *slog.Logger
+	statusCode int
+	headerSent bool
+	translator *responsesStream // set once the chat completion is streamed
+	pending    []byte           // partial event stream, or buffered body
+	completed  map[string]any   // translated non-streaming response
+}
+
+func newResponsesWriter(ctx context.Context, w http.ResponseWriter, builder *responseBuilder, stream bool,
+	logger *slog.Logger) *responsesWriter {
+	return &responsesWriter{
+		ctx:     ctx,
+		w:       w,
+		header:  make(http.Header),
+		builder: builder,
+		stream:  stream,
+		logger:  logger,
+	}
+}
+
+// Header returns the headers of the chat completion response
+func (rw *responsesWriter) Header() http.Header {
+	return rw.header
+}
+
+// WriteHeader records the status of the chat completion response, streams are started right away
+func (rw *responsesWriter) WriteHeader(statusCode int) {
+	if rw.statusCode != 0 {
+		return
+	}
+	rw.statusCode = statusCode
+	if !rw.stream || statusCode < 200 || statusCode >= 300 ||
+		!strings.HasPrefix(rw.header.Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	rw.translator = newResponsesStream(rw.builder)
+	rw.header.Del("Content-Length")
+	rw.sendHeader()
+	if _, err := rw.w.Write(rw.translator.start()); err != nil {
+		rw.logger.Debug("failed to write response stream start", slog.Any("error", err))
+	}
+}
+
+func (rw *responsesWriter) sendHeader() {
+	for name, values := range rw.header {
+		rw.w.Header()[name] = values
+	}
+	rw.w.WriteHeader(rw.statusCode)
+	rw.headerSent = true
+}
+
+// Write translates the complete events of a stream, or buffers the body
+func (rw *responsesWriter) Write(payload []byte) (int, error) {
+	if rw.statusCode == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.translator == nil {
+		if len(rw.pending) == 0 && len(bytes.TrimSpace(payload)) == 0 {
+			// JSON keepalive, the status is sent with it
+			if !rw.headerSent {
+				rw.sendHeader()
+			}
+			return rw.w.Write(payload)
+		}
+		rw.pending = append(rw.pending, payload...)
+		return len(payload), nil
+	}
+	rw.pending = append(rw.pending, payload...)
+	// The chat completion handler writes events in their canonical form
+	var translated []byte
+	for {
+		end := bytes.Index(rw.pending, []byte("\n\n"))
+		if end < 0 {
+			break
+		}
+		translated = append(translated, rw.translateEvent(rw.pending[:end+1])...)
+		rw.pending = rw.pending[end+2:]
+	}
+	rw.pending = append([]byte(nil), rw.pending...)
+	if len(translated) > 0 {
+		if _, err := rw.w.Write(translated); err != nil {
+			return 0, err
+		}
+	}
+	return len(payload), nil
+}
+
+// translateEvent translates an event of the chat completion stream, comments (keepalives)
+// are forwarded as is
+func (rw *responsesWriter) translateEvent(block []byte) []byte {
+	var event sseEvent
+	for _, line := range bytes.Split(block, []byte{'\n'}) {
+		if len(line) > 0 {
+			event.processLine(line)
+		}
+	}
+	if !event.hasData() {
+		return event.appendTo(nil)
+	}
+	jsonPart := bytes.TrimSpace(event.Data())
+	if bytes.Equal(jsonPart, sseDone) {
+		return rw.translator.finish()
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal(jsonPart, &chunk); err != nil {
+		rw.logger.Warn("failed to parse chat completion chunk", slog.String("error", err.Error()))
+		return nil
+	}
+	return rw.translator.chunk(chunk)
+}
+
+// FlushError flushes the client response, used through http.ResponseController
+func (rw *responsesWriter) FlushError() error {
+	// Flushing commits the header: the translated one must be sent first
+	if !rw.headerSent {
+		if rw.statusCode == 0 {
+			return nil // nothing written yet
+		}
+		rw.sendHeader()
+	}
+	return flushResponse(rw.ctx)
+}
+
+// Unwrap returns the client response writer, used through http.ResponseController
+func (rw *responsesWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+// finish writes the translated body of non-streaming chat completions. It must be called
+// once the chat completion handler has returned.
+func (rw *responsesWriter) finish() {
+	if rw.translator != nil || rw.statusCode == 0 {
+		return
+	}
+	body := rw.pending
+	if rw.statusCode >= 200 && rw.statusCode < 300 {
+		body, rw.completed = rw.builder.translate(body, rw.logger)
+	}
+	if !rw.headerSent {
+		rw.header.Set("Content-Length", strconv.Itoa(len(body)))
+		rw.sendHeader()
+	}
+	if _, err := rw.w.Write(body); err != nil {
+		rw.logger.Error("failed to write response", slog.String("error", err.Error()))
+	}
+}
+
+// completedResponse returns the final response object, nil if the response failed
+func (rw *responsesWriter) completedResponse() map[string]any {
+	if rw.translator != nil {
+		return rw.translator.completed
+	}
+	return rw.completed
+}
+
+// responsesStream translates the chunks of a streamed chat completion into the events of a
+// streamed response. Only the first choice is translated: the Responses API has no choices.
+type responsesStream struct {
+	builder      *responseBuilder
+	sequence     int
+	output       []any
+	open         map[string]any // open output item, nil if none
+	openToolCall int            // chat index of the open function call
+	text         strings.Builder
+	usage        map[string]any
+	finishReason string
+	done         bool
+	completed    map[string]any // final response object, once completed
+}
+
+func newResponsesStream(builder *responseBuilder) *responsesStream {
+	return &responsesStream{
+		builder: builder,
+		output:  []any{},
+	}
+}
+
+// event returns a response stream event in its canonical form
+func (rs *responsesStream) event(eventType string, fields map[string]any) []byte {
+	fields["type"] = eventType
+	fields["sequence_number"] = rs.sequence
+	rs.sequence++
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		logger.Error("failed to marshal response stream event", slog.Any("error", err))
+		return nil
+	}
+	event := sseEvent{name: []byte(eventType)}
+	event.setData(payload)
+	return event.appendTo(nil)
+}
+
+// start returns the events opening the response
+func (rs *responsesStream) start() (events []byte) {
+	for _, eventType := range []string{"response.created", "response.in_progress"} {
+		events = append(events, rs.event(eventType, map[string]any{
+			"response": rs.builder.response("in_progress", []any{}, nil),
+		})...)
+	}
+	return
+}
+
+// chunk returns the events of a chat completion chunk
+func (rs *responsesStream) chunk(chunk map[string]any) (events []byte) {
+	if rs.done {
+		return nil
+	}
+	if errorObject, isError := chunk["error"].(map[string]any); isError {
+		rs.done = true
+		events = rs.event("error", map[string]any{
+			"code":    errorObject["code"],
+			"message": errorObject["message"],
+			"param":   nil,
+		})
+		response := rs.builder.response("failed", rs.output, rs.usage)
+		response["error"] = map[string]any{"code": errorObject["type"], "message": errorObject["message"]}
+		return append(events, rs.event("response.failed", map[string]any{"response": response})...)
+	}
+	if usage, ok := chunk["usage"].(map[string]any); ok {
+		rs.usage = responseUsage(usage)
+	}
+	choices, _ := chunk["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		if index, _ := choiceMap["index"].(float64); index != 0 {
+			continue
+		}
+		delta, _ := choiceMap["delta"].(map[string]any)
+		for _, field := range reasoningFields {
+			if reasoning, _ := delta[field].(string); reasoning != "" {
+				events = append(events, rs.appendText("reasoning", reasoning)...)
+				break
+			}
+		}
+		if content, _ := delta["content"].(string); content != "" {
+			events = append(events, rs.appendText("message", content)...)
+		}
+		toolCalls, _ := delta["tool_calls"].([]any)
+		for _, toolCall := range toolCalls {
+			events = append(events, rs.appendToolCall(toolCall)...)
+		}
+		if finishReason, ok := choiceMap["finish_reason"].(string); ok {
+			rs.finishReason = finishReason
+		}
+	}
+	return
+}
+
+// appendText returns the events of a reasoning or message delta, opening its item if needed
+func (rs *responsesStream) appendText(itemType, text string) (events []byte) {
+	if rs.open == nil || rs.open["type"] != itemType {
+		events = rs.closeItem()
+		var part map[string]any
+		if itemType == "reasoning" {
+			rs.open = reasoningItem("")
+			part = map[string]any{"type": "reasoning_text", "text": ""}
+		} else {
+			rs.open = messageItem("", "in_progress")
+			part = outputTextPart("")
+		}
+		rs.open["content"] = []any{}
+		events = append(events, rs.event("response.output_item.added", map[string]any{
+			"output_index": len(rs.output),
+			"item":         rs.open,
+		})...)
+		events = append(events, rs.event("response.content_part.added", map[string]any{
+			"item_id":       rs.open["id"],
+			"output_index":  len(rs.output),
+			"content_index": 0,
+			"part":          part,
+		})...)
+	}
+	rs.text.WriteString(text)
+	fields := map[string]any{
+		"item_id":       rs.open["id"],
+		"output_index":  len(rs.output),
+		"content_index": 0,
+		"delta":         text,
+	}
+	if itemType == "reasoning" {
+		return append(events, rs.event("response.reasoning_text.delta", fields)...)
+	}
+	fields["logprobs"] = []any{}
+	return append(events, rs.event("response.output_text.delta", fields)...)
+}
+
+// appendToolCall returns the events of a tool call delta, opening its item if needed
+func (rs *responsesStream) appendToolCall(toolCall any) (events []byte) {
+	toolCallMap, _ := toolCall.(map[string]any)
+	index, _ := toolCallMap["index"].(float64)
+	function, _ := toolCallMap["function"].(map[string]any)
+	if rs.open == nil || rs.open["type"] != "function_call" || rs.openToolCall != int(index) {
+		events = rs.closeItem()
+		rs.open = functionCallItem(toolCallMap["id"], function["name"], "in_progress")
+		rs.openToolCall = int(index)
+		events = append(events, rs.event("response.output_item.added", map[string]any{
+			"output_index": len(rs.output),
+			"item":         rs.open,
+		})...)
+	}
+	if validationErr, found := toolCallMap["validation_error"]; found {
+		rs.open["validation_error"] = validationErr
+	}
+	arguments, _ := function["arguments"].(string)
+	if arguments == "" {
+		return
+	}
+	rs.text.WriteString(arguments)
+	return append(events, rs.event("response.function_call_arguments.delta", map[string]any{
+		"item_id":      rs.open["id"],
+		"output_index": len(rs.output),
+		"delta":        arguments,
+	})...)
+}
+
+// closeItem returns the events completing the open item, if any
+func (rs *responsesStream) closeItem() (events []byte) {
+	if rs.open == nil {
+		return nil
+	}
+	item, text, outputIndex := rs.open, rs.text.String(), len(rs.output)
+	rs.open = nil
+	rs.text.Reset()
+	switch item["type"] {
+	case "function_call":
+		item["arguments"] = text
+		events = rs.event("response.function_call_arguments.done", map[string]any{
+			"item_id":      item["id"],
+			"output_index": outputIndex,
+			"name":         item["name"],
+			"arguments":    text,
+		})
+	case "reasoning":
+		part := map[string]any{"type": "reasoning_text", "text": text}
+		item["content"] = []any{part}
+		events = rs.event("response.reasoning_text.done", map[string]any{
+			"item_id":       item["id"],
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"text":          text,
+		})
+		events = append(events, rs.event("response.content_part.done", map[string]any{
+			"item_id":       item["id"],
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"part":          part,
+		})...)
+	default:
+		part := outputTextPart(text)
+		item["content"] = []any{part}
+		events = rs.event("response.output_text.done", map[string]any{
+			"item_id":       item["id"],
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"text":          text,
+			"logprobs":      []any{},
+		})
+		events = append(events, rs.event("response.content_part.done", map[string]any{
+			"item_id":       item["id"],
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"part":          part,
+		})...)
+	}
+	if _, found := item["status"]; found {
+		item["status"] = "completed"
+	}
+	rs.output = append(rs.output, item)
+	return append(events, rs.event("response.output_item.done", map[string]any{
+		"output_index": outputIndex,
+		"item":         item,
+	})...)
+}
+
+// finish returns the events completing the response
+func (rs *responsesStream) finish() (events []byte) {
+	if rs.done {
+		return nil
+	}
+	rs.done = true
+	events = rs.closeItem()
+	response := rs.builder.completedResponse(rs.output, rs.usage, rs.finishReason)
+	rs.completed = response
+	eventType := "response.completed"
+	if response["status"] == "incomplete" {
+		eventType = "response.incomplete"
+	}
+	return append(events, rs.event(eventType, map[string]any{"response": response})...)
+}
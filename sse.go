@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Server-sent events, as specified by the WHATWG HTML standard:
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+
+var (
+	sseFieldData  = []byte("data")
+	sseFieldEvent = []byte("event")
+	sseFieldID    = []byte("id")
+	sseFieldRetry = []byte("retry")
+	utf8BOM       = []byte("\xEF\xBB\xBF")
+)
+
+// errSSETruncated is returned when a stream ends in the middle of a line
+var errSSETruncated = errors.New("SSE stream ended in the middle of a line")
+
+// sseEvent is a parsed block of an event stream. Blocks without data (comments only, id
+// or retry only) are kept as well: a proxy must forward them even if browsers do not
+// dispatch them.
+type sseEvent struct {
+	comments []byte // comment lines without their leading colon, each terminated by LF
+	name     []byte // event type
+	id       []byte
+	hasID    bool // an empty id resets the last event ID, it must be told apart from a missing one
+	retry    []byte
+	data     []byte // data buffer: the value of each data field terminated by LF
+}
+
+func (ev *sseEvent) reset() {
+	ev.comments = ev.comments[:0]
+	ev.name = ev.name[:0]
+	ev.id = ev.id[:0]
+	ev.hasID = false
+	ev.retry = ev.retry[:0]
+	ev.data = ev.data[:0]
+}
+
+func (ev *sseEvent) empty() bool {
+	return len(ev.comments) == 0 && len(ev.name) == 0 && !ev.hasID && len(ev.retry) == 0 && len(ev.data) == 0
+}
+
+// hasData returns true if the event has at least one data field (possibly empty)
+func (ev *sseEvent) hasData() bool {
+	return len(ev.data) > 0
+}
+
+// Data returns the data of the event, data fields being joined by LF
+func (ev *sseEvent) Data() []byte {
+	if len(ev.data) == 0 {
+		return nil
+	}
+	return ev.data[:len(ev.data)-1]
+}
+
+// setData replaces the data of the event. data must not alias the event buffers.
+func (ev *sseEvent) setData(data []byte) {
+	ev.data = append(append(ev.data[:0], data...), '\n')
+}
+
+// size returns the buffered size of the event
+func (ev *sseEvent) size() int {
+	return len(ev.comments) + len(ev.name) + len(ev.id) + len(ev.retry) + len(ev.data)
+}
+
+// processLine interprets a non blank line of the stream
+func (ev *sseEvent) processLine(line []byte) {
+	if line[0] == ':' {
+		ev.comments = append(append(ev.comments, line[1:]...), '\n')
+		return
+	}
+	field, value, _ := bytes.Cut(line, []byte{':'})
+	value = bytes.TrimPrefix(value, []byte{' '})
+	switch {
+	case bytes.Equal(field, sseFieldData):
+		ev.data = append(append(ev.data, value...), '\n')
+	case bytes.Equal(field, sseFieldEvent):
+		ev.name = append(ev.name[:0], value...)
+	case bytes.Equal(field, sseFieldID):
+		if bytes.IndexByte(value, 0) < 0 {
+			ev.id = append(ev.id[:0], value...)
+			ev.hasID = true
+		}
+	case bytes.Equal(field, sseFieldRetry):
+		if isASCIIDigits(value) {
+			ev.retry = append(ev.retry[:0], value...)
+		}
+	}
+	// Other fields are ignored, as clients would
+}
+
+func isASCIIDigits(value []byte) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// appendTo appends the event in its canonical form: LF line endings, a space after
+// each field colon and one data line per line of data.
+func (ev *sseEvent) appendTo(buf []byte) []byte {
+	for rest := ev.comments; len(rest) > 0; {
+		var comment []byte
+		comment, rest, _ = bytes.Cut(rest, []byte{'\n'})
+		buf = append(append(append(buf, ':'), comment...), '\n')
+	}
+	if len(ev.name) > 0 {
+		buf = append(append(append(buf, "event: "...), ev.name...), '\n')
+	}
+	if ev.hasID {
+		buf = append(append(append(buf, "id: "...), ev.id...), '\n')
+	}
+	if len(ev.retry) > 0 {
+		buf = append(append(append(buf, "retry: "...), ev.retry...), '\n')
+	}
+	if ev.hasData() {
+		for rest := ev.Data(); ; {
+			line, next, more := bytes.Cut(rest, []byte{'\n'})
+			buf = append(append(append(buf, "data: "...), line...), '\n')
+			if !more {
+				break
+			}
+			rest = next
+		}
+	}
+	return append(buf, '\n')
+}
+
+// sseReader reads the events of a stream. Lines may end with CRLF, LF or CR.
+type sseReader struct {
+	r         io.Reader
+	maxSize   int
+	buf       []byte
+	pos       int
+	err       error
+	skipLF    bool // the last line ended with CR: a following LF belongs to the same line ending
+	bomParsed bool
+	event     sseEvent
+}
+
+// newSSEReader returns a reader failing on events larger than maxSize
+func newSSEReader(r io.Reader, maxSize int) *sseReader {
+	return &sseReader{
+		r:       r,
+		maxSize: maxSize,
+		buf:     make([]byte, 0, 4096),
+	}
+}
+
+// next returns the next event of the stream, only valid until the next call.
+// It returns io.EOF once the stream is over, errSSETruncated if it ends within a line.
+func (sr *sseReader) next() (*sseEvent, error) {
+	sr.event.reset()
+	for {
+		line, err := sr.readLine()
+		if err != nil {
+			if err == io.EOF && !sr.event.empty() {
+				// The last event misses its blank line: it is still complete, forward it
+				return &sr.event, nil
+			}
+			return nil, err
+		}
+		if len(line) == 0 {
+			if sr.event.empty() {
+				continue
+			}
+			return &sr.event, nil
+		}
+		sr.event.processLine(line)
+		if sr.event.size() > sr.maxSize {
+			return nil, fmt.Errorf("SSE event exceeded maximum size (%d bytes)", sr.maxSize)
+		}
+	}
+}
+
+// readLine returns the next line without its line ending, only valid until the next call
+func (sr *sseReader) readLine() (line []byte, err error) {
+	for {
+		if sr.skipLF && sr.pos < len(sr.buf) {
+			if sr.buf[sr.pos] == '\n' {
+				sr.pos++
+			}
+			sr.skipLF = false
+		}
+		if !sr.bomParsed {
+			// A leading byte order mark is skipped, wait until it can be told apart
+			rest := sr.buf[sr.pos:]
+			if len(rest) >= len(utf8BOM) || !bytes.HasPrefix(utf8BOM, rest) || sr.err != nil {
+				sr.pos += len(rest) - len(bytes.TrimPrefix(rest, utf8BOM))
+				sr.bomParsed = true
+			}
+		}
+		if !sr.skipLF && sr.bomParsed {
+			rest := sr.buf[sr.pos:]
+			end := bytes.IndexByte(rest, '\n')
+			search := rest
+			if end >= 0 {
+				search = rest[:end]
+			}
+			if cr := bytes.IndexByte(search, '\r'); cr >= 0 {
+				end = cr
+			}
+			if end >= 0 {
+				sr.skipLF = rest[end] == '\r'
+				sr.pos += end + 1
+				return rest[:end], nil
+			}
+			if len(rest) > sr.maxSize {
+				return nil, fmt.Errorf("SSE line exceeded maximum size (%d bytes)", sr.maxSize)
+			}
+		}
+		if sr.err != nil {
+			if sr.err == io.EOF && sr.pos < len(sr.buf) {
+				// Last line without line ending: it may have been cut
+				sr.pos = len(sr.buf)
+				return nil, errSSETruncated
+			}
+			return nil, sr.err
+		}
+		sr.fill()
+	}
+}
+
+// fill reads more data from the stream, compacting the buffer first
+func (sr *sseReader) fill() {
+	if sr.pos > 0 {
+		sr.buf = sr.buf[:copy(sr.buf, sr.buf[sr.pos:])]
+		sr.pos = 0
+	}
+	if len(sr.buf) == cap(sr.buf) {
+		sr.buf = append(sr.buf, make([]byte, cap(sr.buf))...)[:len(sr.buf)]
+	}
+	n, err := sr.r.Read(sr.buf[len(sr.buf):cap(sr.buf)])
+	sr.buf = sr.buf[:len(sr.buf)+n]
+	if err != nil {
+		sr.err = err
+	}
+}
+
+// sseKeepAliveComment is written on idle streams to keep intermediaries from cutting the connection
+var sseKeepAliveComment = []byte(": keepalive\n\n")
+
+// sseWriter writes events in their canonical form. Writes are serialized so keepalive
+// comments never interleave with an event.
+type sseWriter struct {
+	w         io.Writer
+	mu        sync.Mutex
+	buf       []byte // reused between events to avoid allocations
+	lastWrite time.Time
+}
+
+func newSSEWriter(w io.Writer) *sseWriter {
+	return &sseWriter{
+		w:         w,
+		lastWrite: time.Now(),
+	}
+}
+
+// writeEvent writes an event with a single write call
+func (sw *sseWriter) writeEvent(ev *sseEvent) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.buf = ev.appendTo(sw.buf[:0])
+	return sw.write(sw.buf)
+}
+
+// write must be called with the lock held
+func (sw *sseWriter) write(payload []byte) error {
+	sw.lastWrite = time.Now()
+	_, err := sw.w.Write(payload)
+	return err
+}
+
+// keepAlive writes a keepalive comment whenever nothing has been written for interval.
+// The returned function stops it and must be called before the underlying writer becomes invalid.
+func (sw *sseWriter) keepAlive(interval time.Duration, logger *slog.Logger) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				sw.mu.Lock()
+				idle := time.Since(sw.lastWrite)
+				var err error
+				if idle >= interval {
+					err = sw.write(sseKeepAliveComment)
+					idle = 0
+				}
+				sw.mu.Unlock()
+				if err != nil {
+					logger.Debug("failed to write SSE keepalive comment", slog.Any("error", err))
+					return
+				}
+				timer.Reset(interval - idle)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
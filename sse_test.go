@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// readSSEEvents reads every event of a stream in their canonical form, along with the final error
+func readSSEEvents(r io.Reader, maxSize int) (events []string, err error) {
+	reader := newSSEReader(r, maxSize)
+	for {
+		event, err := reader.next()
+		if err != nil {
+			return events, err
+		}
+		events = append(events, string(event.appendTo(nil)))
+	}
+}
+
+func TestSSEReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		maxSize int // defaults to 1024
+		want    []string
+		wantErr error // defaults to io.EOF
+	}{
+		{
+			name:   "empty",
+			stream: "",
+		},
+		{
+			name:   "LF",
+			stream: "data: a\n\ndata: b\n\n",
+			want:   []string{"data: a\n\n", "data: b\n\n"},
+		},
+		{
+			name:   "CRLF",
+			stream: "data: a\r\n\r\ndata: b\r\n\r\n",
+			want:   []string{"data: a\n\n", "data: b\n\n"},
+		},
+		{
+			name:   "CR",
+			stream: "data: a\r\rdata: b\r\r",
+			want:   []string{"data: a\n\n", "data: b\n\n"},
+		},
+		{
+			name:   "mixed line endings",
+			stream: "data: a\r\ndata: b\rdata: c\n\r\n",
+			want:   []string{"data: a\ndata: b\ndata: c\n\n"},
+		},
+		{
+			name:   "no space after colon",
+			stream: "data:a\n\ndata:  b\n\n",
+			want:   []string{"data: a\n\n", "data:  b\n\n"},
+		},
+		{
+			name:   "multiline data",
+			stream: "data: {\"a\":\ndata: 1}\n\n",
+			want:   []string{"data: {\"a\":\ndata: 1}\n\n"},
+		},
+		{
+			name:   "empty data",
+			stream: "data\n\ndata:\n\n",
+			want:   []string{"data: \n\n", "data: \n\n"},
+		},
+		{
+			name:   "leading blank lines",
+			stream: "\n\n\ndata: a\n\n",
+			want:   []string{"data: a\n\n"},
+		},
+		{
+			name:   "comments",
+			stream: ": keepalive\n\n:a\ndata: b\n\n",
+			want:   []string{": keepalive\n\n", ":a\ndata: b\n\n"},
+		},
+		{
+			name:   "fields",
+			stream: "event: error\nid: 1\nretry: 3000\ndata: a\n\n",
+			want:   []string{"event: error\nid: 1\nretry: 3000\ndata: a\n\n"},
+		},
+		{
+			name:   "empty id",
+			stream: "id\n\n",
+			want:   []string{"id: \n\n"},
+		},
+		{
+			name:   "invalid fields",
+			stream: "retry: 1s\nid: a\x00b\nfoo: bar\ndata: a\n\n",
+			want:   []string{"data: a\n\n"},
+		},
+		{
+			name:   "byte order mark",
+			stream: "\xEF\xBB\xBFdata: a\n\n",
+			want:   []string{"data: a\n\n"},
+		},
+		{
+			name:   "last event without blank line",
+			stream: "data: a\n\ndata: [DONE]\n",
+			want:   []string{"data: a\n\n", "data: [DONE]\n\n"},
+		},
+		{
+			name:   "last event ending with CR",
+			stream: "data: a\r",
+			want:   []string{"data: a\n\n"},
+		},
+		{
+			name:    "cut within a line",
+			stream:  "data: a\n\ndata: {\"cho",
+			want:    []string{"data: a\n\n"},
+			wantErr: errSSETruncated,
+		},
+		{
+			name:    "cut within a line of an event",
+			stream:  "data: a\ndata: b",
+			wantErr: errSSETruncated,
+		},
+		{
+			name:    "oversized line",
+			stream:  "data: " + strings.Repeat("a", 64), // never buffered whole
+			maxSize: 32,
+			wantErr: errors.New("SSE line exceeded maximum size (32 bytes)"),
+		},
+		{
+			name:    "oversized event",
+			stream:  strings.Repeat("data: aaaaaaaaaa\n", 4) + "\n",
+			maxSize: 32,
+			wantErr: errors.New("SSE event exceeded maximum size (32 bytes)"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxSize := tt.maxSize
+			if maxSize == 0 {
+				maxSize = 1024
+			}
+			wantErr := tt.wantErr
+			if wantErr == nil {
+				wantErr = io.EOF
+			}
+			// Byte by byte reads split line endings and the byte order mark across reads
+			readers := map[string]io.Reader{
+				"whole":        strings.NewReader(tt.stream),
+				"byte by byte": iotest.OneByteReader(strings.NewReader(tt.stream)),
+			}
+			for mode, r := range readers {
+				events, err := readSSEEvents(r, maxSize)
+				if err == nil || err.Error() != wantErr.Error() {
+					t.Errorf("%s: got error %v, want %v", mode, err, wantErr)
+				}
+				if strings.Join(events, "|") != strings.Join(tt.want, "|") {
+					t.Errorf("%s: got events %q, want %q", mode, events, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSSEReaderReadError(t *testing.T) {
+	readErr := errors.New("connection reset")
+	r := io.MultiReader(strings.NewReader("data: a\n\ndata: b"), iotest.ErrReader(readErr))
+	events, err := readSSEEvents(r, 1024)
+	if !errors.Is(err, readErr) {
+		t.Errorf("got error %v, want %v", err, readErr)
+	}
+	if len(events) != 1 || events[0] != "data: a\n\n" {
+		t.Errorf("got events %q", events)
+	}
+}
+
+func TestSSEEventSetData(t *testing.T) {
+	reader := newSSEReader(strings.NewReader(": c\nid: 7\ndata: a\ndata: b\n\n"), 1024)
+	event, err := reader.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !event.hasData() || string(event.Data()) != "a\nb" {
+		t.Fatalf("got data %q", event.Data())
+	}
+	event.setData([]byte("x\ny"))
+	if got, want := string(event.appendTo(nil)), ": c\nid: 7\ndata: x\ndata: y\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	event.data = event.data[:0]
+	if event.hasData() || event.empty() {
+		t.Errorf("event without data should not be empty: it has a comment and an id")
+	}
+}
+
+// recordingWriter records each write call
+type recordingWriter struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.writes = append(rw.writes, string(p))
+	return len(p), nil
+}
+
+func (rw *recordingWriter) get() []string {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return append([]string(nil), rw.writes...)
+}
+
+func TestSSEWriter(t *testing.T) {
+	reader := newSSEReader(strings.NewReader("event: a\r\ndata:1\r\ndata:2\r\n\r\n"), 1024)
+	event, err := reader.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingWriter{}
+	writer := newSSEWriter(recorder)
+	if err = writer.writeEvent(event); err != nil {
+		t.Fatal(err)
+	}
+	// The event is written with a single call, so it is never interleaved with keepalives
+	if got := recorder.get(); len(got) != 1 || got[0] != "event: a\ndata: 1\ndata: 2\n\n" {
+		t.Errorf("got writes %q", got)
+	}
+}
+
+func TestSSEWriterKeepAlive(t *testing.T) {
+	recorder := &recordingWriter{}
+	writer := newSSEWriter(recorder)
+	stop := writer.keepAlive(10*time.Millisecond, slog.New(slog.DiscardHandler))
+	time.Sleep(35 * time.Millisecond)
+	stop()
+	writes := recorder.get()
+	if len(writes) == 0 {
+		t.Fatal("no keepalive written on an idle stream")
+	}
+	for _, write := range writes {
+		if !bytes.Equal([]byte(write), sseKeepAliveComment) {
+			t.Errorf("unexpected write %q", write)
+		}
+	}
+	// Nothing is written once stopped
+	time.Sleep(20 * time.Millisecond)
+	if got := recorder.get(); len(got) != len(writes) {
+		t.Errorf("keepalive written after stop: %q", got[len(writes):])
+	}
+}
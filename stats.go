@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hekmon/httplog/v3"
+)
+
+// version is set at build time with -ldflags "-X main.version=vX.Y.Z"
+var version = "dev"
+
+var (
+	startTime        = time.Now()
+	inFlightRequests atomic.Int64
+	lastBackendError atomic.Pointer[backendError]
+	// Stats metrics
+	requestErrorsMetric = newMetric("qwen35rp_request_errors_total", "counter",
+		"Total number of chat completion requests that failed per profile", "profile")
+	inFlightMetric = newMetric("qwen35rp_inflight_requests", "gauge",
+		"Number of proxified requests currently being handled")
+	clientAbortsMetric = newMetric("qwen35rp_client_aborted_requests_total", "counter",
+		"Total number of chat completion requests aborted by the client per profile", "profile")
+	clientAbortedTokensMetric = newMetric("qwen35rp_client_aborted_tokens_total", "counter",
+		"Total number of tokens generated for chat completion requests aborted by the client per profile", "profile")
+)
+
+// backendError is the last error encountered while talking to the backend
+type backendError struct {
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"`
+	Message string    `json:"message"`
+}
+
+// recordBackendError keeps track of the last backend error for the stats
+func recordBackendError(path, message string) {
+	lastBackendError.Store(&backendError{
+		Time:    time.Now(),
+		Path:    path,
+		Message: message,
+	})
+}
+
+// recordClientAbort accounts a chat completion request aborted by the client.
+// generatedTokens is the number of tokens generated so far, negative if unknown.
+func recordClientAbort(profile string, generatedTokens int, logger *slog.Logger) {
+	clientAbortsMetric.Add(1, profile)
+	attrs := []any{slog.String("outcome", "client_aborted")}
+	if generatedTokens >= 0 {
+		clientAbortedTokensMetric.Add(float64(generatedTokens), profile)
+		attrs = append(attrs, slog.Int("generated_tokens", generatedTokens))
+	}
+	logger.Info("client aborted the request, backend request cancelled", attrs...)
+}
+
+// trackInFlight counts the requests currently handled by next
+func trackInFlight(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlightMetric.Set(float64(inFlightRequests.Add(1)))
+		defer func() {
+			inFlightMetric.Set(float64(inFlightRequests.Add(-1)))
+		}()
+		next(w, r)
+	}
+}
+
+// proxyStats is a snapshot of the proxy state
+type proxyStats struct {
+	StartedAt        time.Time               `json:"started_at"`
+	Uptime           string                  `json:"uptime"`
+	Build            buildStats              `json:"build"`
+	Config           configStats             `json:"config"`
+	TotalRequests    uint64                  `json:"total_requests"`
+	ModifiedRequests int64                   `json:"modified_requests"`
+	InFlightRequests int64                   `json:"inflight_requests"`
+	Profiles         map[string]profileStats `json:"profiles"`
+	LastBackendError *backendError           `json:"last_backend_error"`
+}
+
+type buildStats struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+type profileStats struct {
+	Requests     int64 `json:"requests"`
+	Errors       int64 `json:"errors"`
+	ClientAborts int64 `json:"client_aborts"`
+}
+
+// collectStats returns a snapshot of the proxy state
+func collectStats(cfg Config, httplogger *httplog.Logger) (stats proxyStats) {
+	stats = proxyStats{
+		StartedAt: startTime,
+		Uptime:    time.Since(startTime).Truncate(time.Second).String(),
+		Build: buildStats{
+			Version:   version,
+			GoVersion: runtime.Version(),
+		},
+		Config:           newConfigStats(cfg),
+		TotalRequests:    httplogger.TotalRequests(),
+		ModifiedRequests: modifiedRequests.Load(),
+		InFlightRequests: inFlightRequests.Load(),
+		Profiles:         make(map[string]profileStats, len(profiles)),
+		LastBackendError: lastBackendError.Load(),
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				stats.Build.Revision = setting.Value
+			case "vcs.time":
+				stats.Build.Time = setting.Value
+			case "vcs.modified":
+				stats.Build.Modified = setting.Value == "true"
+			}
+		}
+	}
+	for _, profile := range profiles {
+		stats.Profiles[profile] = profileStats{
+			Requests:     int64(requestsMetric.Get(profile)),
+			Errors:       int64(requestErrorsMetric.Get(profile)),
+			ClientAborts: int64(clientAbortsMetric.Get(profile)),
+		}
+	}
+	return
+}
+
+// statusLine returns a one line summary of the stats, used as systemd status
+func (ps proxyStats) statusLine() string {
+	var errors int64
+	for _, profile := range ps.Profiles {
+		errors += profile.Errors
+	}
+	return fmt.Sprintf("Modified %d requests on the %d proxified (%d in flight, %d failed)",
+		ps.ModifiedRequests,
+		ps.TotalRequests,
+		ps.InFlightRequests,
+		errors,
+	)
+}
+
+// statsHandler exposes the proxy stats as JSON
+func statsHandler(cfg Config, httplogger *httplog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(collectStats(cfg, httplogger)); err != nil {
+			logger.Error("failed to write stats response", slog.Any("error", err))
+		}
+	}
+}
+
+// configStats is the effective configuration as exposed by the stats, named after the flags.
+// Secrets are never exposed: they are masked or only reported as set.
+type configStats struct {
+	Listen                     string            `json:"listen"`
+	Port                       int               `json:"port"`
+	Target                     string            `json:"target"`
+	LogLevel                   string            `json:"loglevel"`
+	ServedModel                string            `json:"served_model"`
+	Models                     map[string]string `json:"models"` // virtual model name per profile
+	EnforceSamplingParams      bool              `json:"enforce_sampling_params"`
+	RedactDumps                bool              `json:"redact_dumps"`
+	RedactRules                string            `json:"redact_rules"`
+	CountReasoningTokens       bool              `json:"count_reasoning_tokens"`
+	SSEKeepAlive               string            `json:"sse_keepalive"`
+	JSONKeepAlive              string            `json:"json_keepalive"`
+	UpstreamStreaming          bool              `json:"upstream_streaming"`
+	StallTimeout               string            `json:"stall_timeout"`
+	StripReasoning             string            `json:"strip_reasoning"`
+	ThinkTags                  string            `json:"think_tags"`
+	ReasoningField             string            `json:"reasoning_field"`
+	ReasoningFieldRules        string            `json:"reasoning_field_rules"`
+	ToolCallValidation         string            `json:"tool_call_validation"`
+	StructuredOutput           bool              `json:"structured_output"`
+	StructuredOutputRetries    int               `json:"structured_output_retries"`
+	CompletionsSamplingParams  bool              `json:"completions_sampling_params"`
+	CompletionsDisableThinking bool              `json:"completions_disable_thinking"`
+	ResponseStoreTTL           string            `json:"response_store_ttl"`
+	ResponseStoreDir           string            `json:"response_store_dir"`
+	ResponseStoreReasoning     bool              `json:"response_store_reasoning"`
+	ReadyCheckInterval         string            `json:"ready_check_interval"`
+	BackendAuth                bool              `json:"backend_auth"` // a backend API key is set
+	WatchdogRequireReady       bool              `json:"watchdog_require_ready"`
+	AdminListen                string            `json:"admin_listen"`
+	AdminPort                  int               `json:"admin_port"`
+	AdminAuth                  bool              `json:"admin_auth"` // an admin token is set
+	LogLevelRevert             string            `json:"loglevel_revert"`
+	DebugLogTrustedCIDRs       string            `json:"debug_log_trusted_cidrs"`
+}
+
+// newConfigStats returns the exposed view of a configuration
+func newConfigStats(c Config) configStats {
+	target := c.Target
+	if targetURL, err := url.Parse(c.Target); err == nil {
+		target = targetURL.Redacted()
+	}
+	return configStats{
+		Listen:      c.Listen,
+		Port:        c.Port,
+		Target:      target,
+		LogLevel:    c.LogLevel,
+		ServedModel: c.ServedModelName,
+		Models: map[string]string{
+			profileThinkingGeneral:   c.ThinkingGeneralModel,
+			profileThinkingCoding:    c.ThinkingCodingModel,
+			profileInstructGeneral:   c.InstructGeneralModel,
+			profileInstructReasoning: c.InstructReasoningModel,
+		},
+		EnforceSamplingParams:      c.EnforceSamplingParams,
+		RedactDumps:                c.RedactDumps,
+		RedactRules:                c.RedactRules,
+		CountReasoningTokens:       c.CountReasoningTokens,
+		SSEKeepAlive:               c.SSEKeepAlive.String(),
+		JSONKeepAlive:              c.JSONKeepAlive.String(),
+		UpstreamStreaming:          c.UpstreamStreaming,
+		StallTimeout:               c.StallTimeout.String(),
+		StripReasoning:             c.StripReasoning,
+		ThinkTags:                  c.ThinkTags,
+		ReasoningField:             c.ReasoningField,
+		ReasoningFieldRules:        redactReasoningFieldRules(c.ReasoningFieldRules),
+		ToolCallValidation:         c.ToolCallValidation,
+		StructuredOutput:           c.StructuredOutput,
+		StructuredOutputRetries:    c.StructuredOutputRetry,
+		CompletionsSamplingParams:  c.CompletionsSamplingParams,
+		CompletionsDisableThinking: c.CompletionsDisableThinking,
+		ResponseStoreTTL:           c.ResponseStoreTTL.String(),
+		ResponseStoreDir:           c.ResponseStoreDir,
+		ResponseStoreReasoning:     c.ResponseStoreReasoning,
+		ReadyCheckInterval:         c.ReadyCheckInterval.String(),
+		BackendAuth:                c.BackendAPIKey != "",
+		WatchdogRequireReady:       c.WatchdogRequireReady,
+		AdminListen:                c.AdminListen,
+		AdminPort:                  c.AdminPort,
+		AdminAuth:                  c.AdminToken != "",
+		LogLevelRevert:             c.LogLevelRevert.String(),
+		DebugLogTrustedCIDRs:       c.DebugLogTrustedCIDRs,
+	}
+}
+
+// redactReasoningFieldRules masks the API keys of the key:<api key>=field reasoning field rules
+func redactReasoningFieldRules(raw string) string {
+	items := strings.Split(raw, ",")
+	for i, item := range items {
+		item = strings.TrimSpace(item)
+		separator := strings.LastIndexByte(item, '=')
+		if strings.HasPrefix(item, "key:") && separator >= 0 {
+			items[i] = "key:xxxxx" + item[separator:]
+		}
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errStoredNotFound is returned for records that do not exist, expired or belong to another tenant
+var errStoredNotFound = errors.New("not found")
+
+// storedRecord is a stored response or conversation
+type storedRecord struct {
+	ID        string         `json:"id"`
+	Tenant    string         `json:"tenant"`             // hash of the API key that created the record
+	Previous  string         `json:"previous,omitempty"` // previous response of a response
+	Items     []any          `json:"items"`              // input and output items of a response, items of a conversation
+	Object    map[string]any `json:"object"`             // response or conversation object
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+// responseStore keeps the completed responses and the conversations of the Responses API, so
+// requests can reference them (previous_response_id, conversation) instead of resending the
+// whole history. Records belong to the tenant (API key) that created them and expire once
+// unused for ttl. They are kept in memory, and mirrored in dir when set to survive restarts.
+// Files are written without mu held, so disk latency never blocks the other requests.
+type responseStore struct {
+	ttl       time.Duration
+	dir       string
+	reasoning bool // keep the reasoning items of the responses
+	mu        sync.Mutex
+	records   map[string]*storedRecord // by id
+	fileMu    sync.Mutex               // serializes the file writes, taken before mu
+}
+
+// newResponseStore returns a store, loading the unexpired records of dir if set
+func newResponseStore(ttl time.Duration, dir string, reasoning bool) (*responseStore, error) {
+	rs := &responseStore{
+		ttl:       ttl,
+		dir:       dir,
+		reasoning: reasoning,
+		records:   make(map[string]*storedRecord),
+	}
+	if dir == "" {
+		return rs, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the response store directory: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, path := range paths {
+		payload, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stored record: %w", err)
+		}
+		var record storedRecord
+		if err = json.Unmarshal(payload, &record); err != nil || record.ID+".json" != filepath.Base(path) {
+			logger.Warn("skipping invalid stored record", slog.String("path", path))
+			continue
+		}
+		if now.After(record.ExpiresAt) {
+			rs.removeFile(record.ID)
+			continue
+		}
+		rs.records[record.ID] = &record
+	}
+	logger.Info("response store loaded",
+		slog.String("dir", dir),
+		slog.Int("records", len(rs.records)),
+	)
+	return rs, nil
+}
+
+// run removes the expired records periodically, until ctx is done
+func (rs *responseStore) run(ctx context.Context) {
+	ticker := time.NewTicker(min(rs.ttl, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var expired []string
+			rs.mu.Lock()
+			now := time.Now()
+			for id, record := range rs.records {
+				if now.After(record.ExpiresAt) {
+					delete(rs.records, id)
+					expired = append(expired, id)
+				}
+			}
+			rs.mu.Unlock()
+			if err := rs.persist(expired...); err != nil {
+				logger.Warn("failed to remove expired stored records", slog.Any("error", err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tenantKey returns the tenant of a request: a hash of its API key, never stored in clear.
+// Requests without API key all share the tenant of the empty key.
+func tenantKey(header http.Header) string {
+	apiKey, _ := strings.CutPrefix(header.Get("Authorization"), "Bearer ")
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns a record of a tenant. Must be called with the lock held.
+func (rs *responseStore) get(tenant, id string) (*storedRecord, error) {
+	record, found := rs.records[id]
+	if !found || record.Tenant != tenant || time.Now().After(record.ExpiresAt) {
+		return nil, fmt.Errorf("%q %w", id, errStoredNotFound)
+	}
+	return record, nil
+}
+
+// touch extends the lifetime of a used record, to be persisted once the lock is released.
+// Must be called with the lock held.
+func (rs *responseStore) touch(record *storedRecord) {
+	record.ExpiresAt = time.Now().Add(rs.ttl)
+}
+
+// persistTouched persists the records whose lifetime has been extended, failures being logged
+func (rs *responseStore) persistTouched(ids ...string) {
+	if err := rs.persist(ids...); err != nil {
+		logger.Warn("failed to persist stored record", slog.Any("error", err))
+	}
+}
+
+// object returns the response or conversation object of a record
+func (rs *responseStore) object(tenant, id string) (map[string]any, error) {
+	rs.mu.Lock()
+	record, err := rs.get(tenant, id)
+	if err != nil {
+		rs.mu.Unlock()
+		return nil, err
+	}
+	rs.touch(record)
+	object := record.Object
+	rs.mu.Unlock()
+	rs.persistTouched(id)
+	return object, nil
+}
+
+// items returns the items of a conversation
+func (rs *responseStore) items(tenant, id string) ([]any, error) {
+	rs.mu.Lock()
+	record, err := rs.get(tenant, id)
+	if err != nil {
+		rs.mu.Unlock()
+		return nil, err
+	}
+	rs.touch(record)
+	items := slices.Clone(record.Items)
+	rs.mu.Unlock()
+	rs.persistTouched(id)
+	return items, nil
+}
+
+// delete deletes a record
+func (rs *responseStore) delete(tenant, id string) error {
+	rs.mu.Lock()
+	if _, err := rs.get(tenant, id); err != nil {
+		rs.mu.Unlock()
+		return err
+	}
+	delete(rs.records, id)
+	rs.mu.Unlock()
+	return rs.persist(id)
+}
+
+// history returns the items of the conversation a Responses request continues, if any: the
+// previous responses chain, or the items of a conversation
+func (rs *responseStore) history(tenant string, request map[string]any) ([]any, error) {
+	previousID, _ := request["previous_response_id"].(string)
+	conversationID := requestConversation(request)
+	if previousID != "" && conversationID != "" {
+		return nil, errors.New("previous_response_id and conversation cannot be used together")
+	}
+	var touched []string
+	defer func() { rs.persistTouched(touched...) }() // once the lock is released
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if conversationID != "" {
+		conversation, err := rs.get(tenant, conversationID)
+		if err != nil {
+			return nil, fmt.Errorf("conversation %w", err)
+		}
+		rs.touch(conversation)
+		touched = append(touched, conversationID)
+		return slices.Clone(conversation.Items), nil
+	}
+	// Walk the chain back to its first response, the whole chain is kept alive
+	var chain [][]any
+	for id := previousID; id != ""; {
+		response, err := rs.get(tenant, id)
+		if err != nil {
+			return nil, fmt.Errorf("previous response %w", err)
+		}
+		rs.touch(response)
+		touched = append(touched, id)
+		chain = append(chain, response.Items)
+		id = response.Previous
+	}
+	var items []any
+	for _, turn := range slices.Backward(chain) {
+		items = append(items, turn...)
+	}
+	return items, nil
+}
+
+// saveResponse stores a completed response along with its input items, appending them to its
+// conversation if any. The response is stored even if its conversation cannot be updated, e.g.
+// expired meanwhile: the returned error then describes the conversation failure.
+func (rs *responseStore) saveResponse(tenant string, request map[string]any, input []any, response map[string]any) error {
+	id, _ := response["id"].(string)
+	output, _ := response["output"].([]any)
+	if !rs.reasoning {
+		output = slices.DeleteFunc(slices.Clone(output), func(item any) bool {
+			itemMap, _ := item.(map[string]any)
+			return itemMap["type"] == "reasoning"
+		})
+		response["output"] = output
+	}
+	for _, item := range input {
+		if itemMap, ok := item.(map[string]any); ok && itemMap["id"] == nil {
+			itemMap["id"] = storedItemID(itemMap)
+		}
+	}
+	previousID, _ := request["previous_response_id"].(string)
+	record := &storedRecord{
+		ID:        id,
+		Tenant:    tenant,
+		Previous:  previousID,
+		Items:     append(slices.Clone(input), output...),
+		Object:    response,
+		ExpiresAt: time.Now().Add(rs.ttl),
+	}
+	ids := []string{id}
+	var conversationErr error
+	rs.mu.Lock()
+	rs.records[id] = record
+	if conversationID := requestConversation(request); conversationID != "" {
+		if conversation, err := rs.get(tenant, conversationID); err != nil {
+			conversationErr = fmt.Errorf("response not appended to its conversation: conversation %w", err)
+		} else {
+			conversation.Items = append(conversation.Items, record.Items...)
+			rs.touch(conversation)
+			ids = append(ids, conversationID)
+		}
+	}
+	rs.mu.Unlock()
+	return errors.Join(conversationErr, rs.persist(ids...))
+}
+
+// createConversation stores a new conversation
+func (rs *responseStore) createConversation(tenant string, items []any, metadata map[string]any) (map[string]any, error) {
+	for _, item := range items {
+		if itemMap, ok := item.(map[string]any); ok && itemMap["id"] == nil {
+			itemMap["id"] = storedItemID(itemMap)
+		}
+	}
+	if metadata == nil {
+		metadata = map[string]any{}
+	}
+	conversation := map[string]any{
+		"id":         "conv_" + rand.Text(),
+		"object":     "conversation",
+		"created_at": time.Now().Unix(),
+		"metadata":   metadata,
+	}
+	record := &storedRecord{
+		ID:        conversation["id"].(string),
+		Tenant:    tenant,
+		Items:     items,
+		Object:    conversation,
+		ExpiresAt: time.Now().Add(rs.ttl),
+	}
+	rs.mu.Lock()
+	rs.records[record.ID] = record
+	rs.mu.Unlock()
+	return conversation, rs.persist(record.ID)
+}
+
+// persist mirrors the current state of records in the store directory, if any: the files of
+// the deleted ones are removed. Must be called without the lock held. Files are written in
+// turn, each with the state of its record at the time of the write, so an older state never
+// overwrites a newer one.
+func (rs *responseStore) persist(ids ...string) error {
+	if rs.dir == "" || len(ids) == 0 {
+		return nil
+	}
+	rs.fileMu.Lock()
+	defer rs.fileMu.Unlock()
+	var errs []error
+	for _, id := range ids {
+		rs.mu.Lock()
+		record, found := rs.records[id]
+		var payload []byte
+		var err error
+		if found {
+			payload, err = json.Marshal(record)
+		}
+		rs.mu.Unlock()
+		switch {
+		case !found:
+			rs.removeFile(id)
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		default:
+			// Write then rename, so a crash never leaves a partial record
+			path := filepath.Join(rs.dir, id+".json")
+			if err = os.WriteFile(path+".tmp", payload, 0o600); err == nil {
+				err = os.Rename(path+".tmp", path)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeFile removes the file of a record, if any
+func (rs *responseStore) removeFile(id string) {
+	if rs.dir == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(rs.dir, id+".json")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warn("failed to remove stored record", slog.String("id", id), slog.Any("error", err))
+	}
+}
+
+// requestConversation returns the conversation id of a Responses request, empty if none
+func requestConversation(request map[string]any) string {
+	switch conversation := request["conversation"].(type) {
+	case string:
+		return conversation
+	case map[string]any:
+		id, _ := conversation["id"].(string)
+		return id
+	default:
+		return ""
+	}
+}
+
+// storedItemID returns an id for an input item, following the prefixes of the output items
+func storedItemID(item map[string]any) string {
+	switch item["type"] {
+	case "function_call":
+		return "fc_" + rand.Text()
+	case "function_call_output":
+		return "fco_" + rand.Text()
+	case "reasoning":
+		return "rs_" + rand.Text()
+	default:
+		return "msg_" + rand.Text()
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStore returns a store mirrored in dir
+func newTestStore(t *testing.T, dir string) *responseStore {
+	t.Helper()
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	store, err := newResponseStore(time.Hour, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// testResponse returns a completed response with a single message
+func testResponse(id, text string) map[string]any {
+	return map[string]any{
+		"id":     id,
+		"object": "response",
+		"output": []any{
+			map[string]any{"type": "reasoning", "id": "rs_1"},
+			map[string]any{"type": "message", "id": "msg_" + id, "role": "assistant", "content": text},
+		},
+	}
+}
+
+func TestResponseStore(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+	tenant, other := tenantKey(nil), "other"
+	conversation, err := store.createConversation(tenant, []any{map[string]any{"type": "message", "role": "system"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversationID := conversation["id"].(string)
+	input := []any{map[string]any{"type": "message", "role": "user", "content": "hi"}}
+	request := map[string]any{"conversation": conversationID}
+	if err = store.saveResponse(tenant, request, input, testResponse("resp_1", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	// Items are appended to the conversation, reasoning being dropped
+	items, err := store.items(tenant, conversationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 || items[1].(map[string]any)["id"] == nil || items[2].(map[string]any)["id"] != "msg_resp_1" {
+		t.Errorf("got conversation items %v", items)
+	}
+	// Records are isolated by tenant
+	if _, err = store.object(other, "resp_1"); !errors.Is(err, errStoredNotFound) {
+		t.Errorf("got %v for another tenant", err)
+	}
+	// Records survive a restart
+	reloaded := newTestStore(t, dir)
+	if _, err = reloaded.object(tenant, "resp_1"); err != nil {
+		t.Errorf("response not reloaded: %v", err)
+	}
+	if items, err = reloaded.items(tenant, conversationID); err != nil || len(items) != 3 {
+		t.Errorf("conversation not reloaded: %v %v", items, err)
+	}
+	// Deleted records are removed from the directory
+	if err = reloaded.delete(tenant, "resp_1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "resp_1.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file of the deleted record kept: %v", err)
+	}
+	if _, err = newTestStore(t, dir).object(tenant, "resp_1"); !errors.Is(err, errStoredNotFound) {
+		t.Errorf("deleted record reloaded: %v", err)
+	}
+}
+
+func TestResponseStoreHistory(t *testing.T) {
+	store := newTestStore(t, "")
+	tenant := tenantKey(nil)
+	for i, id := range []string{"resp_1", "resp_2"} {
+		request := map[string]any{}
+		if i > 0 {
+			request["previous_response_id"] = "resp_1"
+		}
+		input := []any{map[string]any{"type": "message", "role": "user", "content": id}}
+		if err := store.saveResponse(tenant, request, input, testResponse(id, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := store.history(tenant, map[string]any{"previous_response_id": "resp_2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, item := range items {
+		content, _ := item.(map[string]any)["content"].(string)
+		contents = append(contents, content)
+	}
+	if got := strings.Join(contents, ","); got != "resp_1,resp_1,resp_2,resp_2" {
+		t.Errorf("got history %s", got)
+	}
+	if _, err = store.history(tenant, map[string]any{"previous_response_id": "resp_1", "conversation": "conv_1"}); err == nil {
+		t.Error("expected an error for previous_response_id and conversation together")
+	}
+}
+
+func TestSaveResponseMissingConversation(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+	tenant := tenantKey(nil)
+	err := store.saveResponse(tenant, map[string]any{"conversation": "conv_expired"}, nil, testResponse("resp_1", "hello"))
+	if !errors.Is(err, errStoredNotFound) {
+		t.Errorf("got error %v, want the conversation error", err)
+	}
+	// The response is stored anyway
+	if _, err = store.object(tenant, "resp_1"); err != nil {
+		t.Errorf("response not stored: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "resp_1.json")); err != nil {
+		t.Errorf("response not persisted: %v", err)
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	sseDone                 = []byte("[DONE]")
+	quotedReasoningContent  = []byte(`"reasoning_content"`)
+	quotedReasoning         = []byte(`"reasoning"`)
+	quotedContent           = []byte(`"content"`)
+	quotedArguments         = []byte(`"arguments"`)
+	quotedText              = []byte(`"text"`)
+	quotedToolCalls         = []byte(`"tool_calls"`)
+	unquotedReasoningPrefix = []byte(`"reasoning`)
+)
+
+// errClientAborted is returned when the client went away before the end of the response
+var errClientAborted = errors.New("client aborted the request")
+
+// streamFixer holds the settings and the state of a proxied stream
+type streamFixer struct {
+	virtualModel        string
+	quotedModel         []byte // virtualModel as a JSON string
+	think               bool
+	fillReasoningTokens bool
+	output              reasoningOutput
+	tools               toolSchemas // tools of the request, their calls are parsed from the content if needed
+	toolValidation      *toolValidation
+	logger              *slog.Logger
+	// state
+	stats          completionStats
+	firstChunkAt   time.Time // reception time of the first chunk
+	deltas         int       // number of generated deltas, an estimation of the generated tokens
+	modelFixed     bool
+	reasoningFixes map[int]int            // number of reasoning deltas moved to content, per choice index
+	suppressed     int                    // number of chunks suppressed as they only carried stripped reasoning
+	thinkTags      map[int]thinkTagsState // inlined think tags state, per choice index
+	tagsOpen       bool                   // a choice has inlined think tags not closed yet
+	thinkLeaks     map[int]*thinkLeakRecoverer
+	leaksSettled   bool // no choice may have a think block leaked in its content anymore
+	toolsActive    bool // a choice holds tool call content, or tool calls its finish depends on
+	toolCalls      map[int]*toolCallRecoverer
+	heldToolCalls  map[int]*aggregatedChoice // tool calls held until validated, per choice index
+	toolOutcomes   toolCallOutcomes
+	dataBuf        []byte // reused between events to avoid allocations
+}
+
+func newStreamFixer(virtualModel string, think, fillReasoningTokens bool, output reasoningOutput, tools toolSchemas,
+	toolValidation *toolValidation, logger *slog.Logger) *streamFixer {
+	quotedModel, _ := json.Marshal(virtualModel)
+	return &streamFixer{
+		virtualModel:        virtualModel,
+		quotedModel:         quotedModel,
+		think:               think,
+		fillReasoningTokens: fillReasoningTokens,
+		output:              output,
+		tools:               tools,
+		toolValidation:      toolValidation,
+		logger:              logger,
+		reasoningFixes:      make(map[int]int),
+		thinkTags:           make(map[int]thinkTagsState),
+		thinkLeaks:          make(map[int]*thinkLeakRecoverer),
+		toolCalls:           make(map[int]*toolCallRecoverer),
+		heldToolCalls:       make(map[int]*aggregatedChoice),
+		toolOutcomes:        make(toolCallOutcomes),
+	}
+}
+
+// streamResponse streams SSE events from backend to client, fixing every event with fixer.
+// Note: no explicit Flush() call is needed here — the httplog middleware wraps the ResponseWriter
+// and auto-flushes on every Write() when Content-Type is a streamable type (e.g. text/event-stream).
+// If keepAlive is positive, a keepalive comment is sent whenever the stream has been idle that long.
+func streamResponse(w http.ResponseWriter, backendBody io.ReadCloser, fixer *streamFixer, keepAlive time.Duration) error {
+	defer fixer.logFixes()
+	reader := newSSEReader(backendBody, maxSSEEventSize)
+	writer := newSSEWriter(w)
+	if keepAlive > 0 {
+		defer writer.keepAlive(keepAlive, fixer.logger)()
+	}
+	for {
+		event, err := reader.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Fix ALL data events (backend includes model in every chunk)
+		if !fixer.fixEvent(event) {
+			continue
+		}
+		if err = writer.writeEvent(event); err != nil {
+			return fmt.Errorf("%w: %w", errClientAborted, err)
+		}
+	}
+}
+
+// fixEvent fixes the JSON chunk carried by the data of an SSE event, other fields
+// (id, event, retry, comments) are preserved. Returns false if the event must not be sent.
+func (sf *streamFixer) fixEvent(event *sseEvent) (keep bool) {
+	jsonPart := bytes.TrimSpace(event.Data())
+	// Skip [DONE] or empty data
+	if len(jsonPart) == 0 || bytes.Equal(jsonPart, sseDone) {
+		return true
+	}
+	if sf.firstChunkAt.IsZero() {
+		sf.firstChunkAt = time.Now()
+	}
+	fixed, modified := sf.fixData(jsonPart)
+	switch {
+	case !modified:
+	case fixed == nil:
+		// Nothing left to deliver: drop the data, other fields are still forwarded
+		event.data = event.data[:0]
+		return !event.empty()
+	default:
+		event.setData(fixed)
+	}
+	return true
+}
+
+// fixData fixes the JSON chunk of a data line. The model name is spliced in place without
+// decoding the chunk: the chunk is only fully parsed when another fix may be needed.
+// The returned slice is only valid until the next call, it is nil if the chunk must be suppressed.
+func (sf *streamFixer) fixData(jsonPart []byte) (fixed []byte, modified bool) {
+	sf.deltas += countRawDeltas(jsonPart)
+	if sf.needsParsing(jsonPart) {
+		var data map[string]any
+		if err := json.Unmarshal(jsonPart, &data); err != nil {
+			return jsonPart, false
+		}
+		modified, suppressed := sf.fixChunk(data)
+		if suppressed {
+			sf.suppressed++
+			return nil, true
+		}
+		if !modified {
+			return jsonPart, false
+		}
+		fixedJSON, err := json.Marshal(data)
+		if err != nil {
+			sf.logger.Error("failed to marshal streaming event", slog.Any("error", err))
+			return jsonPart, false
+		}
+		return fixedJSON, true
+	}
+	// Fast path
+	if sf.fillReasoningTokens {
+		sf.stats.reasoningTokens += countRawReasoningDeltas(jsonPart)
+	}
+	start, end, found := findTopLevelValue(jsonPart, "model")
+	if !found || jsonPart[start] != '"' {
+		return jsonPart, false
+	}
+	sf.logModelFix(jsonPart[start:end])
+	fixed = append(sf.dataBuf[:0], jsonPart[:start]...)
+	fixed = append(fixed, sf.quotedModel...)
+	fixed = append(fixed, jsonPart[end:]...)
+	sf.dataBuf = fixed
+	return fixed, true
+}
+
+// needsParsing returns true if the chunk may need more than a model name fix
+func (sf *streamFixer) needsParsing(jsonPart []byte) bool {
+	// Content deltas that may be a leaked think block
+	if sf.think && !sf.leaksSettled {
+		return true
+	}
+	// Tool calls to recover from the content, to account or to hold until validated
+	if sf.tools != nil && (sf.toolsActive || bytes.Contains(jsonPart, quotedToolCalls) || mayOpenToolCall(jsonPart)) {
+		return true
+	}
+	// Reasoning deltas to move to content, to inline or to strip
+	if (!sf.think || sf.output.strip || sf.output.thinkTags) && bytes.Contains(jsonPart, unquotedReasoningPrefix) {
+		return true
+	}
+	// Think tags to close
+	if sf.tagsOpen {
+		return true
+	}
+	// Reasoning field convention
+	if !sf.output.strip && needsReasoningField(jsonPart, sf.output.field) {
+		return true
+	}
+	// Usage to account and complete
+	if start, _, found := findTopLevelValue(jsonPart, "usage"); found && jsonPart[start] == '{' {
+		return true
+	}
+	return false
+}
+
+// logModelFix logs the model name fix once per stream
+func (sf *streamFixer) logModelFix(original []byte) {
+	if sf.modelFixed {
+		return
+	}
+	sf.modelFixed = true
+	sf.logger.Debug("fixing model name in streaming events",
+		slog.String("original", string(original)),
+		slog.String("replacement", sf.virtualModel),
+	)
+}
+
+// fixChunk fixes a parsed streaming chunk in place. suppressed is true if the chunk has
+// nothing left to deliver once fixed.
+func (sf *streamFixer) fixChunk(data map[string]any) (modified, suppressed bool) {
+	if modelStr, ok := data["model"].(string); ok {
+		sf.logModelFix([]byte(strconv.Quote(modelStr)))
+		data["model"] = sf.virtualModel
+		modified = true
+	}
+
+	// Fix vLLM bug: non-thinking deltas incorrectly placed in reasoning_content/reasoning
+	if !sf.think && sf.fixReasoningDeltas(data) {
+		modified = true
+	}
+	// Recover think blocks leaked in the content by the backend
+	if sf.think && !sf.leaksSettled && sf.recoverThinkLeaks(data) {
+		modified = true
+	}
+	// Parse tool calls left in the content by the backend
+	if sf.tools != nil && sf.recoverToolCalls(data) {
+		modified = true
+	}
+
+	// Account reasoning: vLLM does not fill reasoning_tokens for Qwen
+	if sf.fillReasoningTokens {
+		sf.stats.reasoningTokens += countReasoningDeltas(data)
+	}
+	if usage, ok := data["usage"].(map[string]any); ok {
+		sf.stats.completionTokens = usageInt(usage, "completion_tokens")
+		if reasoningTokens, reported := usageReasoningTokens(usage); reported {
+			sf.stats.reasoningTokens = reasoningTokens
+		} else if sf.fillReasoningTokens {
+			setUsageReasoningTokens(usage, sf.stats.reasoningTokens)
+			modified = true
+		}
+	}
+
+	// Strip reasoning or apply its field convention once accounted
+	if sf.output.strip {
+		stripped, emptied := stripDeltaReasoning(data)
+		if emptied {
+			return true, true
+		}
+		modified = modified || stripped
+	} else if sf.output.thinkTags {
+		modified = sf.inlineReasoning(data) || modified
+	} else if sf.output.field != "" && setDeltaReasoningField(data, sf.output.field) {
+		modified = true
+	}
+
+	// Validate tool calls, they are held until complete
+	if sf.tools != nil && sf.toolValidation != nil {
+		held, emptied := sf.holdToolCalls(data)
+		if emptied {
+			return true, true
+		}
+		modified = modified || held
+	}
+	return
+}
+
+// toolCallsActive returns true if a choice holds tool call content, tool calls to validate,
+// or recovered tool calls whose finish reason is still to fix
+func (sf *streamFixer) toolCallsActive() bool {
+	for _, recoverer := range sf.toolCalls {
+		if recoverer.inCall || recoverer.pending != "" || recoverer.recovered > 0 {
+			return true
+		}
+	}
+	for _, held := range sf.heldToolCalls {
+		if len(held.toolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// holdToolCalls holds the tool call deltas of every choice of a chunk until the choice finishes:
+// the complete tool calls are then validated and sent along with the finish reason. Arguments
+// already sent cannot be re-issued, the retry action falls back to repair. Choices left without
+// anything to deliver are removed, emptied is true when the chunk must be suppressed.
+func (sf *streamFixer) holdToolCalls(data map[string]any) (modified, emptied bool) {
+	choices, _ := data["choices"].([]any)
+	kept := choices[:0]
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		delta, ok := choiceMap["delta"].(map[string]any)
+		if !ok {
+			kept = append(kept, choice)
+			continue
+		}
+		index, _ := choiceMap["index"].(float64)
+		held, ok := sf.heldToolCalls[int(index)]
+		if !ok {
+			held = &aggregatedChoice{toolCalls: make(map[int]*aggregatedToolCall)}
+			sf.heldToolCalls[int(index)] = held
+		}
+		if toolCalls, found := delta["tool_calls"].([]any); found {
+			for _, toolCall := range toolCalls {
+				held.addToolCall(toolCall)
+			}
+			delete(delta, "tool_calls")
+			modified = true
+		}
+		if choiceMap["finish_reason"] != nil && len(held.toolCalls) > 0 {
+			toolCalls := held.toolCallList(true)
+			repair := sf.toolValidation.action != toolValidationAnnotate
+			for outcome, count := range sf.tools.checkToolCalls(toolCalls, repair, true, sf.logger) {
+				sf.toolOutcomes[outcome] += count
+			}
+			delta["tool_calls"] = toolCalls
+			clear(held.toolCalls)
+			modified = true
+		}
+		if len(delta) > 0 || choiceMap["finish_reason"] != nil {
+			kept = append(kept, choice)
+		}
+	}
+	sf.toolsActive = sf.toolCallsActive()
+	if !modified {
+		return false, false
+	}
+	data["choices"] = kept
+	return true, len(kept) == 0 && data["usage"] == nil
+}
+
+// inlineReasoning inlines the reasoning deltas of a chunk in the content. Once opened, the think
+// tags must be closed by the first delta of the answer: chunks carrying it must be parsed as well.
+func (sf *streamFixer) inlineReasoning(data map[string]any) (modified bool) {
+	modified = inlineDeltaReasoning(data, sf.thinkTags)
+	for _, state := range sf.thinkTags {
+		if state == thinkTagsOpen {
+			sf.tagsOpen = true
+			return
+		}
+	}
+	sf.tagsOpen = false
+	return
+}
+
+// recoverThinkLeaks is the streaming counterpart of recoverThinkLeaks: it moves the content
+// deltas of leaked think blocks to reasoning_content for every choice of a chunk.
+func (sf *streamFixer) recoverThinkLeaks(data map[string]any) (fixed bool) {
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		delta, ok := choiceMap["delta"].(map[string]any)
+		if !ok {
+			continue
+		}
+		index, _ := choiceMap["index"].(float64)
+		recoverer, ok := sf.thinkLeaks[int(index)]
+		if !ok {
+			recoverer = new(thinkLeakRecoverer)
+			sf.thinkLeaks[int(index)] = recoverer
+		}
+		// The backend reasoning parser is at work: the content is an answer
+		if (recoverer.state == thinkLeakStart && recoverer.pending == "") || recoverer.state == thinkLeakUnopened {
+			for _, field := range reasoningFields {
+				if reasoning, _ := delta[field].(string); reasoning != "" {
+					recoverer.state = thinkLeakAnswer
+				}
+			}
+		}
+		content, hasContent := delta["content"].(string)
+		var reasoning, answer string
+		if hasContent {
+			reasoning, answer = recoverer.feed(content)
+		}
+		if choiceMap["finish_reason"] != nil {
+			flushedReasoning, flushedAnswer := recoverer.flush()
+			reasoning += flushedReasoning
+			answer += flushedAnswer
+		}
+		if reasoning == "" && answer == content {
+			continue
+		}
+		if reasoning != "" {
+			previous, _ := delta[reasoningFieldContent].(string)
+			delta[reasoningFieldContent] = previous + reasoning
+			recoverer.recovered++
+		}
+		if answer != "" || (hasContent && reasoning == "") {
+			delta["content"] = answer
+		} else {
+			delete(delta, "content")
+		}
+		fixed = true
+	}
+	sf.leaksSettled = len(sf.thinkLeaks) > 0
+	for _, recoverer := range sf.thinkLeaks {
+		sf.leaksSettled = sf.leaksSettled && recoverer.settled()
+	}
+	return
+}
+
+// recoverToolCalls is the streaming counterpart of toolSchemas.recoverToolCalls: it converts the
+// Qwen3 tool calls of the content deltas into tool call deltas for every choice of a chunk.
+func (sf *streamFixer) recoverToolCalls(data map[string]any) (fixed bool) {
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		delta, ok := choiceMap["delta"].(map[string]any)
+		if !ok {
+			continue
+		}
+		index, _ := choiceMap["index"].(float64)
+		recoverer, ok := sf.toolCalls[int(index)]
+		if !ok {
+			recoverer = new(toolCallRecoverer)
+			sf.toolCalls[int(index)] = recoverer
+		}
+		backendToolCalls, _ := delta["tool_calls"].([]any)
+		recoverer.observe(backendToolCalls)
+		content, hasContent := delta["content"].(string)
+		var text string
+		var toolCalls []any
+		if hasContent {
+			text, toolCalls = recoverer.feed(content, sf.tools)
+		}
+		if finishReason := choiceMap["finish_reason"]; finishReason != nil {
+			flushedText, flushedToolCalls := recoverer.flush(sf.tools)
+			text += flushedText
+			toolCalls = append(toolCalls, flushedToolCalls...)
+			if recoverer.recovered > 0 && finishReason == "stop" {
+				choiceMap["finish_reason"] = "tool_calls"
+				fixed = true
+			}
+		}
+		if text == content && len(toolCalls) == 0 {
+			continue
+		}
+		if text != "" || (hasContent && len(toolCalls) == 0) {
+			delta["content"] = text
+		} else {
+			delete(delta, "content")
+		}
+		if len(toolCalls) > 0 {
+			delta["tool_calls"] = append(backendToolCalls, toolCalls...)
+		}
+		fixed = true
+	}
+	sf.toolsActive = sf.toolCallsActive()
+	return
+}
+
+// fixReasoningDeltas is the streaming counterpart of fixReasoningContentBug: it moves
+// reasoning_content/reasoning deltas to content for every choice of a chunk.
+func (sf *streamFixer) fixReasoningDeltas(data map[string]any) (fixed bool) {
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		delta, ok := choiceMap["delta"].(map[string]any)
+		if !ok {
+			continue
+		}
+		var reasoningText string
+		for _, field := range reasoningFields {
+			if reasoning, _ := delta[field].(string); reasoning != "" && reasoningText == "" {
+				reasoningText = reasoning
+			}
+			delete(delta, field)
+		}
+		if reasoningText == "" {
+			continue
+		}
+		content, _ := delta["content"].(string)
+		delta["content"] = reasoningText + content
+		index, _ := choiceMap["index"].(float64)
+		sf.reasoningFixes[int(index)]++
+		fixed = true
+	}
+	return
+}
+
+// logFixes reports the fixes applied during the stream
+func (sf *streamFixer) logFixes() {
+	if sf.suppressed > 0 {
+		sf.logger.Debug("reasoning stripped from streaming response",
+			slog.Int("suppressed_chunks", sf.suppressed),
+		)
+	}
+	for index, recoverer := range sf.thinkLeaks {
+		if recoverer.recovered > 0 {
+			sf.logger.Info("vLLM streaming response fixed: moved leaked think block to reasoning_content field",
+				slog.Int("choice_index", index),
+				slog.Int("fixed_deltas", recoverer.recovered),
+			)
+		}
+	}
+	for index, recoverer := range sf.toolCalls {
+		if recoverer.recovered > 0 {
+			sf.logger.Info("vLLM streaming response fixed: parsed tool calls left in content",
+				slog.Int("choice_index", index),
+				slog.Int("tool_calls", recoverer.recovered),
+			)
+		}
+	}
+	for index, count := range sf.reasoningFixes {
+		sf.logger.Info("vLLM streaming response fixed: moved reasoning deltas to content field",
+			slog.Int("choice_index", index),
+			slog.Int("fixed_deltas", count),
+		)
+	}
+}
+
+// countReasoningDeltas returns the number of choices carrying a reasoning delta in a streaming chunk.
+// vLLM emits reasoning token by token, this gives a close approximation of the reasoning tokens.
+func countReasoningDeltas(data map[string]any) (count int) {
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		delta, _ := choiceMap["delta"].(map[string]any)
+		if reasoning, _ := delta["reasoning_content"].(string); reasoning != "" {
+			count++
+		} else if reasoning, _ := delta["reasoning"].(string); reasoning != "" {
+			count++
+		}
+	}
+	return
+}
+
+// generatedTokens returns the number of tokens generated so far: the figure reported by the
+// backend if any, the number of streamed deltas otherwise.
+func (sf *streamFixer) generatedTokens() int {
+	if sf.stats.completionTokens > 0 {
+		return sf.stats.completionTokens
+	}
+	return sf.deltas
+}
+
+// countRawDeltas returns the number of content, reasoning and tool call arguments deltas of a raw
+// chunk, or of text deltas for legacy completions
+func countRawDeltas(jsonPart []byte) int {
+	return countStringFields(jsonPart, quotedContent) + countRawReasoningDeltas(jsonPart) +
+		countStringFields(jsonPart, quotedArguments) + countStringFields(jsonPart, quotedText)
+}
+
+// countRawReasoningDeltas is countReasoningDeltas working on the raw JSON chunk
+func countRawReasoningDeltas(jsonPart []byte) int {
+	if count := countStringFields(jsonPart, quotedReasoningContent); count > 0 {
+		return count
+	}
+	return countStringFields(jsonPart, quotedReasoning)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+func TestFixReasoningDeltas(t *testing.T) {
+	// Instruct stream with two choices (n=2) whose deltas are interleaved, vLLM
+	// wrongly placing their content in reasoning_content or reasoning
+	chunks := []struct {
+		chunk string
+		want  string
+	}{
+		{
+			chunk: `{"model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":""}},{"index":1,"delta":{"role":"assistant","content":""}}]}`,
+			want:  `{"model":"qwen","choices":[{"index":0,"delta":{"role":"assistant","content":""}},{"index":1,"delta":{"role":"assistant","content":""}}]}`,
+		},
+		{
+			chunk: `{"model":"m","choices":[{"index":1,"delta":{"reasoning_content":"Bon"}}]}`,
+			want:  `{"model":"qwen","choices":[{"index":1,"delta":{"content":"Bon"}}]}`,
+		},
+		{
+			chunk: `{"model":"m","choices":[{"index":0,"delta":{"reasoning":"Hel"}}]}`,
+			want:  `{"model":"qwen","choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+		},
+		{
+			// Both fields carrying the same delta: it is only moved once
+			chunk: `{"model":"m","choices":[{"index":1,"delta":{"reasoning_content":"jour","reasoning":"jour"}},{"index":0,"delta":{"reasoning_content":"lo"}}]}`,
+			want:  `{"model":"qwen","choices":[{"index":1,"delta":{"content":"jour"}},{"index":0,"delta":{"content":"lo"}}]}`,
+		},
+		{
+			// Reasoning moved ahead of the content of the same delta
+			chunk: `{"model":"m","choices":[{"index":0,"delta":{"reasoning":" wor","content":"ld"}}]}`,
+			want:  `{"model":"qwen","choices":[{"index":0,"delta":{"content":" world"}}]}`,
+		},
+		{
+			// Genuine content is left untouched
+			chunk: `{"model":"m","choices":[{"index":1,"delta":{"content":" !"}}]}`,
+			want:  `{"model":"qwen","choices":[{"index":1,"delta":{"content":" !"}}]}`,
+		},
+		{
+			chunk: `{"model":"m","choices":[{"index":0,"delta":{"reasoning_content":""},"finish_reason":"stop"},{"index":1,"delta":{},"finish_reason":"stop"}]}`,
+			want:  `{"model":"qwen","choices":[{"index":0,"delta":{},"finish_reason":"stop"},{"index":1,"delta":{},"finish_reason":"stop"}]}`,
+		},
+	}
+	output := new(logBuffer)
+	fixer := newStreamFixer("qwen", false, false, reasoningOutput{}, nil, nil,
+		slog.New(slog.NewTextHandler(output, nil)))
+	for i, tc := range chunks {
+		fixed, _ := fixer.fixData([]byte(tc.chunk))
+		if got, want := normalizeJSON(t, fixed), normalizeJSON(t, []byte(tc.want)); got != want {
+			t.Errorf("chunk %d: got %s, want %s", i, got, want)
+		}
+	}
+	if got, want := fmt.Sprint(fixer.reasoningFixes), "map[0:3 1:2]"; got != want {
+		t.Errorf("got fixes per choice %s, want %s", got, want)
+	}
+	// One log line per fixed choice, with its own count
+	fixer.logFixes()
+	var logged []string
+	for _, match := range regexp.MustCompile(`moved reasoning deltas to content field" choice_index=(\d+) fixed_deltas=(\d+)`).FindAllStringSubmatch(output.String(), -1) {
+		logged = append(logged, match[1]+":"+match[2])
+	}
+	sort.Strings(logged)
+	if got, want := fmt.Sprint(logged), "[0:3 1:2]"; got != want {
+		t.Errorf("got logged fixes %s, want %s in:\n%s", got, want, output)
+	}
+}
+
+func TestFixReasoningDeltasThinking(t *testing.T) {
+	// Reasoning deltas of thinking profiles are genuine and must be kept
+	fixer := newStreamFixer("qwen", true, false, reasoningOutput{}, nil, nil, slog.New(slog.DiscardHandler))
+	chunk := `{"model":"m","choices":[{"index":0,"delta":{"reasoning_content":"Let me think"}},{"index":1,"delta":{"reasoning":"Hmm"}}]}`
+	fixed, _ := fixer.fixData([]byte(chunk))
+	want := `{"model":"qwen","choices":[{"index":0,"delta":{"reasoning_content":"Let me think"}},{"index":1,"delta":{"reasoning":"Hmm"}}]}`
+	if got := normalizeJSON(t, fixed); got != normalizeJSON(t, []byte(want)) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if len(fixer.reasoningFixes) != 0 {
+		t.Errorf("got fixes %v", fixer.reasoningFixes)
+	}
+}
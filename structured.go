@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/hekmon/httplog/v3"
+)
+
+// Structured output validation outcomes, as exported to the metrics
+const (
+	structuredOutputValid   = "valid"
+	structuredOutputFixed   = "fixed" // valid once the Markdown code fences are stripped
+	structuredOutputRetried = "retried"
+	structuredOutputInvalid = "invalid"
+)
+
+// responseFormat is the structured output requested by the response_format of a request
+type responseFormat struct {
+	schema map[string]any // nil for json_object, or for a json_schema without schema
+}
+
+// newResponseFormat returns the structured output requested by a parsed chat completion request,
+// nil if the request expects text
+func newResponseFormat(request map[string]any) *responseFormat {
+	format, _ := request["response_format"].(map[string]any)
+	switch format["type"] {
+	case "json_object":
+		return &responseFormat{}
+	case "json_schema":
+		jsonSchema, _ := format["json_schema"].(map[string]any)
+		schema, _ := jsonSchema["schema"].(map[string]any)
+		return &responseFormat{schema: schema}
+	default:
+		return nil
+	}
+}
+
+// validate validates a content against the response format, once stripped of Markdown code fences
+func (rf *responseFormat) validate(content string) (stripped string, err error) {
+	stripped = stripCodeFences(content)
+	var value any
+	if err = json.Unmarshal([]byte(stripped), &value); err != nil {
+		return stripped, fmt.Errorf("content is not valid JSON: %w", err)
+	}
+	if rf.schema == nil {
+		if _, isObject := value.(map[string]any); !isObject {
+			return stripped, fmt.Errorf("content: expected object, got %s", jsonTypeName(value))
+		}
+		return stripped, nil
+	}
+	return stripped, validateSchema(value, rf.schema, "content")
+}
+
+// checkResponse validates the content of every choice of a non-streaming response, the stray
+// Markdown code fences being stripped. The reasoning inlined in think tags is kept but not
+// validated. invalidContent (without reasoning) and err describe the first invalid choice.
+func (rf *responseFormat) checkResponse(responseBody []byte, logger *slog.Logger) (checkedBody []byte,
+	invalidContent string, fixed bool, err error) {
+	var data map[string]any
+	if err = json.Unmarshal(responseBody, &data); err != nil {
+		return responseBody, "", false, fmt.Errorf("failed to parse response: %w", err)
+	}
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		message, _ := choiceMap["message"].(map[string]any)
+		content, isText := message["content"].(string)
+		if !isText {
+			// e.g. tool calls
+			continue
+		}
+		// The reasoning inlined in think tags is not part of the answer
+		thinkBlock, answer := splitInlinedReasoning(content)
+		stripped, validationErr := rf.validate(answer)
+		if validationErr != nil {
+			if err == nil {
+				invalidContent, err = answer, validationErr
+			}
+			continue
+		}
+		if stripped != answer {
+			message["content"] = thinkBlock + stripped
+			fixed = true
+		}
+	}
+	if !fixed {
+		return responseBody, invalidContent, false, err
+	}
+	checkedBody, marshalErr := json.Marshal(data)
+	if marshalErr != nil {
+		logger.Error("failed to marshal checked response body", slog.Any("error", marshalErr))
+		return responseBody, invalidContent, false, err
+	}
+	return checkedBody, invalidContent, true, err
+}
+
+// enforceStructuredOutput validates a non-streaming response against the response format of its
+// request. Invalid responses are retried up to retries times with complete, the validation error
+// being appended as a user message. err is set if the last response is still invalid.
+func (rf *responseFormat) enforceStructuredOutput(responseBody []byte, request map[string]any, retries int,
+	logger *slog.Logger, complete func(body []byte) ([]byte, error)) (checkedBody []byte, outcome string, err error) {
+	checkedBody, invalidContent, fixed, err := rf.checkResponse(responseBody, logger)
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		logger.Info("re-issuing the request for invalid structured output",
+			slog.Int("attempt", attempt),
+			slog.Int("max_attempts", retries),
+			slog.String("error", err.Error()),
+		)
+		retryBody, marshalErr := json.Marshal(structuredOutputRetryRequest(request, invalidContent, err))
+		if marshalErr != nil {
+			logger.Error("failed to marshal retry request body", slog.Any("error", marshalErr))
+			break
+		}
+		retriedBody, completeErr := complete(retryBody)
+		if completeErr != nil {
+			logger.Warn("failed to re-issue the request for invalid structured output", slog.Any("error", completeErr))
+			break
+		}
+		if checkedBody, invalidContent, _, err = rf.checkResponse(retriedBody, logger); err == nil {
+			return checkedBody, structuredOutputRetried, nil
+		}
+	}
+	switch {
+	case err != nil:
+		logger.Warn("response does not match the requested response format", slog.String("error", err.Error()))
+		return checkedBody, structuredOutputInvalid, err
+	case fixed:
+		return checkedBody, structuredOutputFixed, nil
+	default:
+		return checkedBody, structuredOutputValid, nil
+	}
+}
+
+// structuredOutputRetryRequest returns a copy of a request asking the model to fix its invalid answer
+func structuredOutputRetryRequest(request map[string]any, invalidContent string, validationErr error) map[string]any {
+	retry := maps.Clone(request)
+	messages, _ := request["messages"].([]any)
+	retry["messages"] = append(slices.Clone(messages),
+		map[string]any{"role": "assistant", "content": invalidContent},
+		map[string]any{"role": "user", "content": fmt.Sprintf(
+			"Your answer does not match the requested JSON format: %s. Answer again with only the corrected JSON document.",
+			validationErr)},
+	)
+	return retry
+}
+
+// structuredOutputError returns the OpenAI error body of a response that does not match its format
+func structuredOutputError(ctx context.Context, validationErr error) []byte {
+	errorBody := openAIError(ctx, http.StatusUnprocessableEntity)
+	errorObject, _ := errorBody["error"].(map[string]any)
+	errorObject["message"] = fmt.Sprintf("the model response does not match the requested response_format: %s (request id #%v)",
+		validationErr, ctx.Value(httplog.ReqIDKey))
+	payload, _ := json.Marshal(errorBody)
+	return payload
+}
+
+// splitInlinedReasoning splits a content starting with the reasoning inlined in think tags into
+// the think block and the answer. The answer is the whole content if there is no think block.
+func splitInlinedReasoning(content string) (thinkBlock, answer string) {
+	if !strings.HasPrefix(content, thinkOpenTag) {
+		return "", content
+	}
+	// JSON answers cannot hold the raw closing tag, the reasoning may mention it
+	end := strings.LastIndex(content, thinkCloseTag)
+	if end < 0 {
+		return "", content
+	}
+	end += len(thinkCloseTag)
+	return content[:end], content[end:]
+}
+
+// stripCodeFences removes the Markdown code fences wrapping a content, e.g. ```json ... ```
+func stripCodeFences(content string) string {
+	trimmed := strings.TrimSpace(content)
+	rest, fenced := strings.CutPrefix(trimmed, "```")
+	if !fenced {
+		return content
+	}
+	// Opening fence line, with an optional language
+	_, rest, found := strings.Cut(rest, "\n")
+	if !found {
+		return content
+	}
+	rest, closed := strings.CutSuffix(strings.TrimSpace(rest), "```")
+	if !closed {
+		return content
+	}
+	return strings.TrimSpace(rest)
+}
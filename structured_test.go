@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestCheckResponse(t *testing.T) {
+	format := &responseFormat{schema: map[string]any{
+		"type":     "object",
+		"required": []any{"name"},
+	}}
+	tests := []struct {
+		name        string
+		content     string
+		wantContent string // content once checked, empty if untouched
+		wantInvalid string // invalid content to send back, empty if valid
+	}{
+		{
+			name:    "valid",
+			content: `{"name":"x"}`,
+		},
+		{
+			name:        "code fences",
+			content:     "```json\n{\"name\":\"x\"}\n```",
+			wantContent: `{"name":"x"}`,
+		},
+		{
+			name:    "inlined reasoning",
+			content: "<think>\nThe user wants a name, not </think> tags.\n</think>\n\n{\"name\":\"x\"}",
+		},
+		{
+			name:        "inlined reasoning and code fences",
+			content:     "<think>\nLet me think.\n</think>\n\n```json\n{\"name\":\"x\"}\n```",
+			wantContent: "<think>\nLet me think.\n</think>\n\n{\"name\":\"x\"}",
+		},
+		{
+			name:        "inlined reasoning and invalid answer",
+			content:     "<think>\nLet me think.\n</think>\n\n{\"age\":1}",
+			wantInvalid: `{"age":1}`,
+		},
+		{
+			name:        "truncated reasoning",
+			content:     "<think>\nLet me",
+			wantInvalid: "<think>\nLet me",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responseBody, err := json.Marshal(map[string]any{"choices": []any{
+				map[string]any{"index": 0, "message": map[string]any{"role": "assistant", "content": tt.content}},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkedBody, invalidContent, fixed, err := format.checkResponse(responseBody, slog.New(slog.DiscardHandler))
+			if (err != nil) != (tt.wantInvalid != "") || invalidContent != tt.wantInvalid {
+				t.Fatalf("got invalid content %q (%v), want %q", invalidContent, err, tt.wantInvalid)
+			}
+			wantContent := tt.wantContent
+			if wantContent == "" {
+				wantContent = tt.content
+			}
+			var checked struct {
+				Choices []struct{ Message struct{ Content string } }
+			}
+			if err = json.Unmarshal(checkedBody, &checked); err != nil {
+				t.Fatal(err)
+			}
+			if got := checked.Choices[0].Message.Content; got != wantContent || fixed != (tt.wantContent != "") {
+				t.Errorf("got content %q (fixed=%v), want %q", got, fixed, wantContent)
+			}
+		})
+	}
+}
+
+func TestStructuredOutputRetryRequest(t *testing.T) {
+	request := map[string]any{
+		"model":    "qwen",
+		"messages": []any{map[string]any{"role": "user", "content": "hi"}},
+	}
+	retry := structuredOutputRetryRequest(request, `{"age":1}`, errors.New(`content: missing required property "name"`))
+	messages, _ := retry["messages"].([]any)
+	if len(messages) != 3 {
+		t.Fatalf("got %d messages, want 3", len(messages))
+	}
+	if answer := messages[1].(map[string]any); answer["role"] != "assistant" || answer["content"] != `{"age":1}` {
+		t.Errorf("got answer %v", answer)
+	}
+	if len(request["messages"].([]any)) != 1 {
+		t.Error("original request altered")
+	}
+}
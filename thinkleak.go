@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// Tags delimiting the reasoning leaked in the content when the backend runs without reasoning
+// parser, or when the parser misses the boundary (e.g. truncated output)
+const (
+	leakedThinkOpen  = "<think>"
+	leakedThinkClose = "</think>"
+)
+
+// recoverThinkLeaks is the opposite of fixReasoningContentBug: it moves think blocks leaked in
+// the content of thinking responses to the reasoning field. As in streams, only think blocks
+// opened at the start of the content are recovered, and only when the backend reasoning parser
+// extracted nothing: otherwise think tags are part of the answer. Handled contents are:
+//   - "<think>reasoning</think>answer"
+//   - "<think>reasoning": the output has been truncated before the end of the think block
+//   - "reasoning</think>answer": the chat template opened the think block within the prompt
+//
+// Operates in-place on a parsed Chat Completions response map. Returns true if any fix was applied.
+func recoverThinkLeaks(data map[string]any, logger *slog.Logger) (fixed bool) {
+	choices, _ := data["choices"].([]any)
+	for i, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		message, ok := choiceMap["message"].(map[string]any)
+		if !ok {
+			continue
+		}
+		if slices.ContainsFunc(reasoningFields, func(field string) bool {
+			text, _ := message[field].(string)
+			return text != ""
+		}) {
+			continue
+		}
+		content, _ := message["content"].(string)
+		reasoning, answer, found := splitThinkLeak(content)
+		if !found {
+			continue
+		}
+		field := reasoningFieldContent
+		message[field] = reasoning
+		message["content"] = nil
+		if answer != "" {
+			message["content"] = answer
+		}
+		fixed = true
+		logger.Info("vLLM response fixed: moved leaked think block to reasoning field",
+			slog.String("target_field", field),
+			slog.Int("choice_index", i),
+		)
+	}
+	return
+}
+
+// splitThinkLeak splits a content starting with a leaked think block into reasoning and answer.
+// Without opening tag, the content is split on its first closing tag, unless an opening tag
+// comes first: the think block is then part of the answer.
+func splitThinkLeak(content string) (reasoning, answer string, found bool) {
+	trimmed := strings.TrimLeft(content, " \t\r\n")
+	if rest, opened := strings.CutPrefix(trimmed, leakedThinkOpen); opened {
+		reasoning, answer, _ = strings.Cut(rest, leakedThinkClose)
+	} else if reasoning, answer, found = strings.Cut(trimmed, leakedThinkClose); !found ||
+		strings.Contains(reasoning, leakedThinkOpen) {
+		return "", content, false
+	}
+	return strings.Trim(reasoning, "\n"), strings.TrimLeft(answer, "\n"), true
+}
+
+// thinkLeakState is the state of the think block recovery of a streamed choice
+type thinkLeakState int
+
+const (
+	thinkLeakStart       thinkLeakState = iota // no content yet, a think block may open
+	thinkLeakUnopened                          // content without opening tag, held until a closing tag
+	thinkLeakReasoning                         // within a leaked think block
+	thinkLeakAnswerStart                       // think block closed, newlines before the answer are dropped
+	thinkLeakAnswer                            // no (more) think block
+)
+
+// thinkLeakHoldLimit is the size of the content held waiting for a closing tag when the think block
+// has been opened within the prompt. Longer contents are released as an answer.
+const thinkLeakHoldLimit = 64 << 10
+
+// thinkLeakRecoverer is the streaming counterpart of recoverThinkLeaks for a single choice. Only
+// think blocks opened at the start of the content are recovered. Text that may be the beginning of
+// a tag is held until the next delta. Content starting without opening tag is held until a closing
+// tag shows up (the think block was opened within the prompt) or thinkLeakHoldLimit is reached.
+type thinkLeakRecoverer struct {
+	state            thinkLeakState
+	pending          string
+	reasoningStarted bool
+	recovered        int // number of content deltas moved to reasoning
+}
+
+// feed processes a content delta, returning the reasoning and the answer to send instead
+func (tr *thinkLeakRecoverer) feed(content string) (reasoning, answer string) {
+	text := tr.pending + content
+	searched := len(tr.pending) // held text already searched for tags
+	tr.pending = ""
+	for text != "" {
+		switch tr.state {
+		case thinkLeakStart:
+			trimmed := strings.TrimLeft(text, " \t\r\n")
+			switch {
+			case strings.HasPrefix(trimmed, leakedThinkOpen):
+				tr.state = thinkLeakReasoning
+				text = trimmed[len(leakedThinkOpen):]
+			case strings.HasPrefix(leakedThinkOpen, trimmed):
+				// Whitespace or beginning of the opening tag: wait for more
+				tr.pending = text
+				return
+			default:
+				tr.state = thinkLeakUnopened
+			}
+		case thinkLeakUnopened:
+			// Only search the new text, and the end of the held one for tags split across deltas
+			from := max(0, searched-len(leakedThinkClose)+1)
+			openAt := strings.Index(text[from:], leakedThinkOpen)
+			closeAt := strings.Index(text[from:], leakedThinkClose)
+			switch {
+			case openAt >= 0 && (closeAt < 0 || openAt < closeAt):
+				// Think block within an answer
+				tr.state = thinkLeakAnswer
+			case closeAt >= 0:
+				reasoning += tr.reasoning(strings.TrimRight(text[:from+closeAt], "\n"))
+				tr.state = thinkLeakAnswerStart
+				text = text[from+closeAt+len(leakedThinkClose):]
+			case len(text) > thinkLeakHoldLimit:
+				tr.state = thinkLeakAnswer
+			default:
+				tr.pending = text
+				return
+			}
+		case thinkLeakReasoning:
+			before, after, closed := strings.Cut(text, leakedThinkClose)
+			if closed {
+				reasoning += tr.reasoning(strings.TrimRight(before, "\n"))
+				tr.state = thinkLeakAnswerStart
+				text = after
+				continue
+			}
+			held := heldTagSuffix(text, leakedThinkClose)
+			reasoning += tr.reasoning(text[:len(text)-held])
+			tr.pending = text[len(text)-held:]
+			return
+		case thinkLeakAnswerStart:
+			if text = strings.TrimLeft(text, "\n"); text != "" {
+				tr.state = thinkLeakAnswer
+			}
+		case thinkLeakAnswer:
+			answer += text
+			text = ""
+		}
+	}
+	return
+}
+
+// reasoning returns a piece of the reasoning, dropping the newlines opening the think block
+func (tr *thinkLeakRecoverer) reasoning(text string) string {
+	if !tr.reasoningStarted {
+		if text = strings.TrimLeft(text, "\n"); text == "" {
+			return ""
+		}
+		tr.reasoningStarted = true
+	}
+	return text
+}
+
+// flush returns the held text at the end of the choice
+func (tr *thinkLeakRecoverer) flush() (reasoning, answer string) {
+	pending := tr.pending
+	tr.pending = ""
+	switch tr.state {
+	case thinkLeakStart, thinkLeakUnopened, thinkLeakAnswer:
+		return "", pending
+	case thinkLeakReasoning:
+		return tr.reasoning(pending), ""
+	default:
+		return "", ""
+	}
+}
+
+// settled returns true once the choice content can only be an answer
+func (tr *thinkLeakRecoverer) settled() bool {
+	return tr.state == thinkLeakAnswer && tr.pending == ""
+}
+
+// heldTagSuffix returns the length of the end of text that may be followed by tag: a beginning
+// of the tag and the newlines before it.
+func heldTagSuffix(text, tag string) int {
+	tagPrefix := 0
+	for i := min(len(text), len(tag)-1); i > 0; i-- {
+		if strings.HasSuffix(text, tag[:i]) {
+			tagPrefix = i
+			break
+		}
+	}
+	return len(text) - len(strings.TrimRight(text[:len(text)-tagPrefix], "\n"))
+}
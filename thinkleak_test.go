@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRecoverThinkLeaks(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string // message once recovered, empty if untouched
+	}{
+		{
+			name:    "leaked think block",
+			message: `{"content":"<think>\nLet me think.\n</think>\n\nThe answer.","reasoning_content":null}`,
+			want:    `{"content":"The answer.","reasoning_content":"Let me think."}`,
+		},
+		{
+			name:    "leading whitespace",
+			message: `{"content":"\n <think>reasoning</think>answer"}`,
+			want:    `{"content":"answer","reasoning_content":"reasoning"}`,
+		},
+		{
+			name:    "truncated think block",
+			message: `{"content":"<think>\nLet me","reasoning_content":null}`,
+			want:    `{"content":null,"reasoning_content":"Let me"}`,
+		},
+		{
+			name:    "missing opening tag",
+			message: `{"content":"Let me think.\n</think>\n\nThe answer.","reasoning_content":null}`,
+			want:    `{"content":"The answer.","reasoning_content":"Let me think."}`,
+		},
+		{
+			name:    "missing opening tag without answer",
+			message: `{"content":"Let me think.\n</think>\n\n","reasoning_content":null}`,
+			want:    `{"content":null,"reasoning_content":"Let me think."}`,
+		},
+		{
+			name:    "missing opening tag, closing tag in the answer",
+			message: `{"content":"Let me think.</think>The answer uses </think>."}`,
+			want:    `{"content":"The answer uses </think>.","reasoning_content":"Let me think."}`,
+		},
+		{
+			name:    "no closing tag",
+			message: `{"content":"The answer.","reasoning_content":null}`,
+		},
+		{
+			name:    "think block before the closing tag",
+			message: `{"content":"Tags: <think>a</think>b","reasoning_content":null}`,
+		},
+		{
+			name:    "think block within the answer",
+			message: `{"content":"Example: <think>a</think>b","reasoning_content":null}`,
+		},
+		{
+			name:    "reasoning already parsed",
+			message: `{"content":"<think>x</think> is the tag pair","reasoning_content":"Let me think."}`,
+		},
+		{
+			name:    "reasoning already parsed as reasoning",
+			message: `{"content":"<think>x</think> is the tag pair","reasoning":"Let me think."}`,
+		},
+		{
+			name:    "no content",
+			message: `{"content":null,"tool_calls":[]}`,
+		},
+	}
+	logger := slog.New(slog.DiscardHandler)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var message map[string]any
+			if err := json.Unmarshal([]byte(tt.message), &message); err != nil {
+				t.Fatal(err)
+			}
+			data := map[string]any{"choices": []any{map[string]any{"index": 0.0, "message": message}}}
+			fixed := recoverThinkLeaks(data, logger)
+			want := tt.want
+			if want == "" {
+				want = tt.message
+			}
+			if fixed != (tt.want != "") {
+				t.Errorf("got fixed=%v", fixed)
+			}
+			got, err := json.Marshal(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if normalized := normalizeJSON(t, []byte(want)); string(got) != normalized {
+				t.Errorf("got  %s\nwant %s", got, normalized)
+			}
+		})
+	}
+}
+
+func TestThinkLeakRecoverer(t *testing.T) {
+	tests := []struct {
+		name          string
+		deltas        []string
+		wantReasoning string
+		wantAnswer    string
+	}{
+		{
+			name:          "tags split across deltas",
+			deltas:        []string{"<thi", "nk>\nI think ", "hard</th", "ink>\n\nAnswer", " here."},
+			wantReasoning: "I think hard",
+			wantAnswer:    "Answer here.",
+		},
+		{
+			name:       "no think block",
+			deltas:     []string{"Hello", " world"},
+			wantAnswer: "Hello world",
+		},
+		{
+			name:          "missing opening tag",
+			deltas:        []string{"Let me", " think.\n</th", "ink>\n", "\nThe", " answer </think>."},
+			wantReasoning: "Let me think.",
+			wantAnswer:    "The answer </think>.",
+		},
+		{
+			name:          "missing opening tag, closing tag in a single delta",
+			deltas:        []string{"\nLet me think.", "\n</think>\n\nThe answer."},
+			wantReasoning: "Let me think.",
+			wantAnswer:    "The answer.",
+		},
+		{
+			name:       "think block before the closing tag",
+			deltas:     []string{"Tags: <thi", "nk>a</think>b"},
+			wantAnswer: "Tags: <think>a</think>b",
+		},
+		{
+			name:       "beginning of a tag that is not one",
+			deltas:     []string{"<th", "ing>"},
+			wantAnswer: "<thing>",
+		},
+		{
+			name:          "truncated think block",
+			deltas:        []string{"<think>", "Let me", "</thi"},
+			wantReasoning: "Let me</thi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var recoverer thinkLeakRecoverer
+			var reasoning, answer string
+			for _, delta := range tt.deltas {
+				r, a := recoverer.feed(delta)
+				reasoning, answer = reasoning+r, answer+a
+			}
+			r, a := recoverer.flush()
+			reasoning, answer = reasoning+r, answer+a
+			if reasoning != tt.wantReasoning || answer != tt.wantAnswer {
+				t.Errorf("got reasoning %q and answer %q, want %q and %q", reasoning, answer, tt.wantReasoning, tt.wantAnswer)
+			}
+		})
+	}
+}
+
+func TestThinkLeakRecovererHoldLimit(t *testing.T) {
+	var recoverer thinkLeakRecoverer
+	// Content without opening tag is held waiting for the closing tag
+	delta := strings.Repeat("a", thinkLeakHoldLimit/2)
+	if reasoning, answer := recoverer.feed(delta); reasoning != "" || answer != "" {
+		t.Fatalf("got reasoning %q and answer %q, want the content held", reasoning, answer)
+	}
+	// Then released as an answer once too long
+	reasoning, answer := recoverer.feed(delta + "b")
+	if reasoning != "" || answer != delta+delta+"b" {
+		t.Errorf("got reasoning %q and answer of %d bytes, want the content released", reasoning, len(answer))
+	}
+	if !recoverer.settled() {
+		t.Error("not settled once released")
+	}
+	if _, answer = recoverer.feed("c</think>d"); answer != "c</think>d" {
+		t.Errorf("got answer %q once released", answer)
+	}
+}
+
+func TestStreamThinkLeaks(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		chunks        []string
+		wantReasoning string
+		wantContent   string
+	}{
+		{
+			name: "missing opening tag",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"Let me"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":" think.\n</think>\n\n"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"The answer."}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			},
+			wantReasoning: "Let me think.",
+			wantContent:   "The answer.",
+		},
+		{
+			name: "missing opening tag and closing tag",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"content":"The"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":" answer."}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			},
+			wantContent: "The answer.",
+		},
+		{
+			name: "reasoning parser at work",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"reasoning_content":"Let me think."}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"The </think>"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":" tag."},"finish_reason":"stop"}]}`,
+			},
+			wantReasoning: "Let me think.",
+			wantContent:   "The </think> tag.",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fixer := newStreamFixer("qwen", true, false, reasoningOutput{}, nil, nil, slog.New(slog.DiscardHandler))
+			var reasoning, content string
+			for _, chunk := range tc.chunks {
+				fixed, _ := fixer.fixData([]byte(chunk))
+				var data struct {
+					Choices []struct {
+						Delta struct {
+							ReasoningContent string `json:"reasoning_content"`
+							Content          string
+						}
+					}
+				}
+				if err := json.Unmarshal(fixed, &data); err != nil {
+					t.Fatalf("invalid chunk %s: %v", fixed, err)
+				}
+				for _, choice := range data.Choices {
+					reasoning += choice.Delta.ReasoningContent
+					content += choice.Delta.Content
+				}
+			}
+			if reasoning != tc.wantReasoning || content != tc.wantContent {
+				t.Errorf("got reasoning %q and content %q, want %q and %q", reasoning, content, tc.wantReasoning, tc.wantContent)
+			}
+		})
+	}
+}
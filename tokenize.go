@@ -2,21 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"path"
 	"syscall"
-
-	"github.com/hekmon/httplog/v3"
 )
 
 func tokenize(httpCli *http.Client, target *url.URL,
 	servedModel, thinkingGeneral, thinkingCoding, instructGeneral, instructReasoning string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger := logger.With(httplog.GetReqIDSLogAttr(r.Context()))
+		logger := requestLogger(r.Context())
 		ctx := r.Context()
 
 		// Read request body
@@ -78,6 +79,7 @@ func tokenize(httpCli *http.Client, target *url.URL,
 		outResp, err := httpCli.Do(outreq)
 		if err != nil {
 			logger.Error("failed to send upstream request", slog.Any("error", err))
+			recordBackendError(r.URL.Path, err.Error())
 			switch {
 			case errors.Is(err, syscall.ECONNREFUSED):
 				httpError(ctx, w, http.StatusBadGateway)
@@ -97,3 +99,44 @@ func tokenize(httpCli *http.Client, target *url.URL,
 		}
 	}
 }
+
+// countTokens asks the backend /tokenize endpoint for the number of tokens of a raw text.
+// Special tokens are not added: the text is a fragment of a completion, not a full prompt.
+// authorization is the Authorization header of the client request, needed by a backend started
+// with --api-key.
+func countTokens(ctx context.Context, httpCli *http.Client, target *url.URL, servedModel, authorization,
+	text string) (int, error) {
+	requestBody, err := json.Marshal(map[string]any{
+		"model":              servedModel,
+		"prompt":             text,
+		"add_special_tokens": false,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal tokenize request: %w", err)
+	}
+	tokenizeURL := *target
+	tokenizeURL.Path = path.Join(target.Path, "/tokenize")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenizeURL.String(), bytes.NewReader(requestBody))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create tokenize request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := httpCli.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send tokenize request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("backend tokenize returned HTTP %d", resp.StatusCode)
+	}
+	var tokenized struct {
+		Count int `json:"count"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokenized); err != nil {
+		return 0, fmt.Errorf("failed to parse tokenize response: %w", err)
+	}
+	return tokenized.Count, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCountTokens(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tokenize" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer sk-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var request map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if request["model"] != "Qwen/Test" || request["add_special_tokens"] != false {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		prompt, _ := request["prompt"].(string)
+		json.NewEncoder(w).Encode(map[string]any{"count": len(prompt)})
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	count, err := countTokens(context.Background(), backend.Client(), target, "Qwen/Test", "Bearer sk-test", "abcd")
+	if err != nil || count != 4 {
+		t.Errorf("got %d, %v", count, err)
+	}
+	if _, err = countTokens(context.Background(), backend.Client(), target, "Qwen/Test", "", "abcd"); err == nil {
+		t.Error("expected an error without the client authorization")
+	}
+}
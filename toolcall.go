@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Qwen3 tool call syntax, parsed when the backend tool call parser is missing or fails:
+//
+//	<tool_call>
+//	<function=get_weather>
+//	<parameter=city>
+//	Paris
+//	</parameter>
+//	</function>
+//	</tool_call>
+const (
+	toolCallOpen       = "<tool_call>"
+	toolCallClose      = "</tool_call>"
+	toolFunctionPrefix = "<function="
+	toolFunctionClose  = "</function>"
+	toolParamPrefix    = "<parameter="
+	toolParamClose     = "</parameter>"
+)
+
+// toolSchemas holds the parameters JSON schema of every function tool of a request, by name.
+// A nil toolSchemas means the request has no tools to call.
+type toolSchemas map[string]map[string]any
+
+// newToolSchemas returns the tool schemas of a parsed chat completion request
+func newToolSchemas(request map[string]any) toolSchemas {
+	tools, _ := request["tools"].([]any)
+	if len(tools) == 0 || request["tool_choice"] == "none" {
+		return nil
+	}
+	schemas := make(toolSchemas, len(tools))
+	for _, tool := range tools {
+		toolMap, _ := tool.(map[string]any)
+		function, _ := toolMap["function"].(map[string]any)
+		if name, _ := function["name"].(string); name != "" {
+			schemas[name], _ = function["parameters"].(map[string]any)
+		}
+	}
+	return schemas
+}
+
+// parameterType returns the JSON schema type of a function parameter, empty if unknown
+func (ts toolSchemas) parameterType(function, parameter string) string {
+	properties, _ := ts[function]["properties"].(map[string]any)
+	property, _ := properties[parameter].(map[string]any)
+	switch typ := property["type"].(type) {
+	case string:
+		return typ
+	case []any:
+		// e.g. ["integer", "null"]: the first non null type
+		for _, item := range typ {
+			if name, _ := item.(string); name != "" && name != "null" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// parseToolCall parses the inside of a <tool_call> block into an OpenAI tool call
+func (ts toolSchemas) parseToolCall(block string) (toolCall map[string]any, ok bool) {
+	rest, found := strings.CutPrefix(strings.TrimSpace(block), toolFunctionPrefix)
+	if !found {
+		return nil, false
+	}
+	name, rest, found := strings.Cut(rest, ">")
+	if name = strings.TrimSpace(name); !found || name == "" {
+		return nil, false
+	}
+	rest, _, _ = strings.Cut(rest, toolFunctionClose)
+	parameters := strings.Split(rest, toolParamPrefix)
+	if strings.TrimSpace(parameters[0]) != "" {
+		return nil, false
+	}
+	arguments := make(map[string]any, len(parameters)-1)
+	for _, parameter := range parameters[1:] {
+		parameterName, value, found := strings.Cut(parameter, ">")
+		if parameterName = strings.TrimSpace(parameterName); !found || parameterName == "" {
+			return nil, false
+		}
+		// The closing tag is sometimes omitted by the model
+		value, _, _ = strings.Cut(value, toolParamClose)
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "\n"), "\n")
+		arguments[parameterName] = toolParameterValue(value, ts.parameterType(name, parameterName))
+	}
+	// Do not escape HTML: arguments often hold code
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(arguments); err != nil {
+		return nil, false
+	}
+	return map[string]any{
+		"id":   "call_" + rand.Text(),
+		"type": "function",
+		"function": map[string]any{
+			"name":      name,
+			"arguments": strings.TrimSuffix(encoded.String(), "\n"),
+		},
+	}, true
+}
+
+// toolParameterValue converts the raw value of a parameter to the JSON type of its schema.
+// Values that do not match their type, or without known type, are kept as strings.
+func toolParameterValue(raw, schemaType string) any {
+	trimmed := strings.TrimSpace(raw)
+	switch schemaType {
+	case "integer":
+		if value, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+			return value
+		}
+	case "number":
+		if value, err := strconv.ParseFloat(trimmed, 64); err == nil {
+			return value
+		}
+	case "boolean":
+		if value, err := strconv.ParseBool(strings.ToLower(trimmed)); err == nil {
+			return value
+		}
+	case "object", "array", "null":
+		var value any
+		if err := json.Unmarshal([]byte(trimmed), &value); err == nil {
+			return value
+		}
+	}
+	return raw
+}
+
+// splitToolCalls extracts the tool call blocks of a content. ok is false if the content has
+// no tool call or one of them cannot be parsed.
+func (ts toolSchemas) splitToolCalls(content string) (text string, toolCalls []any, ok bool) {
+	before, rest, found := strings.Cut(content, toolCallOpen)
+	if !found {
+		return content, nil, false
+	}
+	text = strings.TrimSpace(before)
+	for found {
+		var block string
+		// The last closing tag is sometimes omitted by the model
+		block, rest, _ = strings.Cut(rest, toolCallClose)
+		toolCall, parsed := ts.parseToolCall(block)
+		if !parsed {
+			return content, nil, false
+		}
+		toolCalls = append(toolCalls, toolCall)
+		var between string
+		between, rest, found = strings.Cut(rest, toolCallOpen)
+		if trailing := strings.TrimSpace(between); trailing != "" {
+			text = strings.TrimSpace(text + "\n\n" + trailing)
+		}
+	}
+	return text, toolCalls, true
+}
+
+// recoverToolCalls converts the Qwen3 tool calls left in the content of every choice of a parsed
+// non-streaming response into OpenAI tool calls, and sets the finish reason accordingly unless
+// the generation did not stop by itself (e.g. length). Returns true if any fix was applied.
+func (ts toolSchemas) recoverToolCalls(data map[string]any, logger *slog.Logger) (fixed bool) {
+	choices, _ := data["choices"].([]any)
+	for i, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		message, ok := choiceMap["message"].(map[string]any)
+		if !ok {
+			continue
+		}
+		content, _ := message["content"].(string)
+		text, toolCalls, ok := ts.splitToolCalls(content)
+		if !ok {
+			continue
+		}
+		message["content"] = nil
+		if text != "" {
+			message["content"] = text
+		}
+		existing, _ := message["tool_calls"].([]any)
+		message["tool_calls"] = append(existing, toolCalls...)
+		if finishReason := choiceMap["finish_reason"]; finishReason == nil || finishReason == "stop" {
+			choiceMap["finish_reason"] = "tool_calls"
+		}
+		fixed = true
+		logger.Info("vLLM response fixed: parsed tool calls left in content",
+			slog.Int("choice_index", i),
+			slog.Int("tool_calls", len(toolCalls)),
+		)
+	}
+	return
+}
+
+// mayOpenToolCall returns true if a raw streaming chunk may hold the beginning of a tool call
+// block: its opening tag, or a string ending with a prefix of it or with newlines, both being
+// held by the toolCallRecoverer until the next delta. False positives only cost a parsing.
+func mayOpenToolCall(jsonPart []byte) bool {
+	if bytes.Contains(jsonPart, escapedNewlineEnd) {
+		return true
+	}
+	name := toolCallOpen[1 : len(toolCallOpen)-1]
+	for _, lessThan := range jsonLessThans {
+		for rest := jsonPart; ; {
+			i := bytes.Index(rest, lessThan)
+			if i < 0 {
+				break
+			}
+			rest = rest[i+len(lessThan):]
+			n := 0
+			for n < len(name) && n < len(rest) && rest[n] == name[n] {
+				n++
+			}
+			if n == len(name) || (n < len(rest) && rest[n] == '"') {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	// escapedNewlineEnd is a JSON string ending with a newline
+	escapedNewlineEnd = []byte(`\n"`)
+	// jsonLessThans are the encodings of < within a JSON string
+	jsonLessThans = [][]byte{[]byte("<"), []byte(`\u003c`)}
+)
+
+// toolCallRecoverer is the streaming counterpart of recoverToolCalls for a single choice: content
+// is sent as is until a tool call block opens, the block is then held and sent as a tool call
+// delta once closed. Text that may be the beginning of a block is held until the next delta.
+type toolCallRecoverer struct {
+	inCall    bool
+	pending   string
+	recovered int // number of tool calls parsed from the content
+	nextIndex int // index of the next tool call of the choice
+}
+
+// feed processes a content delta, returning the content and the tool call deltas to send instead
+func (tr *toolCallRecoverer) feed(content string, schemas toolSchemas) (text string, toolCalls []any) {
+	buffer := tr.pending + content
+	tr.pending = ""
+	for buffer != "" {
+		if tr.inCall {
+			block, rest, closed := strings.Cut(buffer, toolCallClose)
+			if !closed {
+				tr.pending = buffer
+				return
+			}
+			tr.inCall = false
+			buffer = rest
+			if toolCall, ok := tr.toolCall(block, schemas); ok {
+				toolCalls = append(toolCalls, toolCall)
+			} else {
+				text += toolCallOpen + block + toolCallClose
+			}
+			continue
+		}
+		before, rest, opened := strings.Cut(buffer, toolCallOpen)
+		if !opened {
+			held := heldTagSuffix(buffer, toolCallOpen)
+			text += buffer[:len(buffer)-held]
+			tr.pending = buffer[len(buffer)-held:]
+			return
+		}
+		// Whitespace around the blocks is dropped
+		text += strings.TrimRight(before, " \t\r\n")
+		tr.inCall = true
+		buffer = rest
+	}
+	return
+}
+
+// flush returns the held content, or the tool call whose closing tag is missing, at the end of the choice
+func (tr *toolCallRecoverer) flush(schemas toolSchemas) (text string, toolCalls []any) {
+	pending := tr.pending
+	tr.pending = ""
+	switch {
+	case tr.inCall:
+		tr.inCall = false
+		if toolCall, ok := tr.toolCall(pending, schemas); ok {
+			return "", []any{toolCall}
+		}
+		return toolCallOpen + pending, nil
+	case tr.recovered > 0 && strings.TrimSpace(pending) == "":
+		return "", nil
+	default:
+		return pending, nil
+	}
+}
+
+// toolCall parses a tool call block into a tool call delta
+func (tr *toolCallRecoverer) toolCall(block string, schemas toolSchemas) (toolCall map[string]any, ok bool) {
+	if toolCall, ok = schemas.parseToolCall(block); !ok {
+		return nil, false
+	}
+	toolCall["index"] = tr.nextIndex
+	tr.nextIndex++
+	tr.recovered++
+	return toolCall, true
+}
+
+// observe accounts the tool call deltas sent by the backend, the recovered ones following them
+func (tr *toolCallRecoverer) observe(toolCalls []any) {
+	for _, toolCall := range toolCalls {
+		toolCallMap, _ := toolCall.(map[string]any)
+		if index, ok := toolCallMap["index"].(float64); ok && int(index) >= tr.nextIndex {
+			tr.nextIndex = int(index) + 1
+		}
+	}
+}
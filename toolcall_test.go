@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// testToolSchemas are the tools of the tests
+var testToolSchemas = toolSchemas{
+	"get_weather": {
+		"type": "object",
+		"properties": map[string]any{
+			"city":  map[string]any{"type": "string"},
+			"days":  map[string]any{"type": []any{"null", "integer"}},
+			"hot":   map[string]any{"type": "boolean"},
+			"temp":  map[string]any{"type": "number"},
+			"units": map[string]any{"type": "array"},
+		},
+	},
+	"get_time": nil,
+}
+
+// toolCallSummary returns the name and arguments of tool calls, their random ids left out
+func toolCallSummary(toolCalls []any) string {
+	var calls []string
+	for _, toolCall := range toolCalls {
+		toolCallMap, _ := toolCall.(map[string]any)
+		function, _ := toolCallMap["function"].(map[string]any)
+		name, _ := function["name"].(string)
+		arguments, _ := function["arguments"].(string)
+		calls = append(calls, name+arguments)
+	}
+	return strings.Join(calls, "|")
+}
+
+func TestToolParameterValue(t *testing.T) {
+	tests := []struct {
+		raw        string
+		schemaType string
+		want       any
+	}{
+		{"Paris", "string", "Paris"},
+		{" 42\n", "integer", int64(42)},
+		{"4.2", "integer", "4.2"},
+		{"-1.5e2", "number", -150.0},
+		{"many", "number", "many"},
+		{"True", "boolean", true},
+		{"yes", "boolean", "yes"},
+		{`["c", "f"]`, "array", []any{"c", "f"}},
+		{`{"a":1}`, "object", map[string]any{"a": 1.0}},
+		{"[unclosed", "array", "[unclosed"},
+		{"null", "null", nil},
+		{" 42 ", "", " 42 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schemaType+" "+tt.raw, func(t *testing.T) {
+			got := toolParameterValue(tt.raw, tt.schemaType)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitToolCalls(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		wantText  string
+		wantCalls string // name and arguments of the calls, empty if not ok
+	}{
+		{
+			name:      "single call",
+			content:   "<tool_call>\n<function=get_weather>\n<parameter=city>\nParis\n</parameter>\n<parameter=days>\n3\n</parameter>\n</function>\n</tool_call>",
+			wantCalls: `get_weather{"city":"Paris","days":3}`,
+		},
+		{
+			name:      "text around calls",
+			content:   "Let me check.\n\n<tool_call>\n<function=get_time>\n</function>\n</tool_call>\nDone.",
+			wantText:  "Let me check.\n\nDone.",
+			wantCalls: `get_time{}`,
+		},
+		{
+			name:      "several calls",
+			content:   "<tool_call><function=get_time></function></tool_call>\n<tool_call><function=get_weather><parameter=hot>false</parameter></function></tool_call>",
+			wantCalls: `get_time{}|get_weather{"hot":false}`,
+		},
+		{
+			name:      "multiline value and html",
+			content:   "<tool_call>\n<function=get_weather>\n<parameter=city>\n<b>New\nYork</b>\n</parameter>\n</function>\n</tool_call>",
+			wantCalls: `get_weather{"city":"<b>New\nYork</b>"}`,
+		},
+		{
+			name:      "closing tags omitted",
+			content:   "<tool_call>\n<function=get_weather>\n<parameter=city>\nParis\n<parameter=temp>\n21.5\n</function>",
+			wantCalls: `get_weather{"city":"Paris","temp":21.5}`,
+		},
+		{
+			name:      "unknown function keeps string values",
+			content:   "<tool_call><function=search><parameter=limit>10</parameter></function></tool_call>",
+			wantCalls: `search{"limit":"10"}`,
+		},
+		{
+			name:    "no tool call",
+			content: "The <function=x> syntax is not a call.",
+		},
+		{
+			name:    "missing function",
+			content: "<tool_call>\n{\"name\": \"get_time\"}\n</tool_call>",
+		},
+		{
+			name:    "text before the parameters",
+			content: "<tool_call><function=get_time>now<parameter=a>1</parameter></function></tool_call>",
+		},
+		{
+			name:    "unnamed parameter",
+			content: "<tool_call><function=get_time><parameter=>1</parameter></function></tool_call>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, toolCalls, ok := testToolSchemas.splitToolCalls(tt.content)
+			if tt.wantCalls == "" {
+				if ok || text != tt.content || toolCalls != nil {
+					t.Fatalf("expected the content untouched, got %q and %s", text, toolCallSummary(toolCalls))
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("tool calls not parsed")
+			}
+			if text != tt.wantText {
+				t.Errorf("got text %q, want %q", text, tt.wantText)
+			}
+			if got := toolCallSummary(toolCalls); got != tt.wantCalls {
+				t.Errorf("got calls %s, want %s", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRecoverToolCallsFinishReason(t *testing.T) {
+	content := "<tool_call><function=get_time></function></tool_call>"
+	tests := []struct {
+		finishReason any
+		want         any
+	}{
+		{"stop", "tool_calls"},
+		{nil, "tool_calls"},
+		{"length", "length"},
+		{"tool_calls", "tool_calls"},
+	}
+	for _, tt := range tests {
+		choice := map[string]any{"index": 0.0, "finish_reason": tt.finishReason, "message": map[string]any{"content": content}}
+		data := map[string]any{"choices": []any{choice}}
+		if !testToolSchemas.recoverToolCalls(data, slog.New(slog.DiscardHandler)) {
+			t.Fatalf("%v: tool call not recovered", tt.finishReason)
+		}
+		if choice["finish_reason"] != tt.want {
+			t.Errorf("%v: got finish reason %v, want %v", tt.finishReason, choice["finish_reason"], tt.want)
+		}
+	}
+}
+
+func TestToolCallRecoverer(t *testing.T) {
+	tests := []struct {
+		name      string
+		deltas    []string
+		observed  int // index of a tool call sent by the backend before the deltas, -1 if none
+		wantText  string
+		wantCalls string
+	}{
+		{
+			name:      "tags split across deltas",
+			deltas:    []string{"Let me check.\n", "<tool", "_call>\n<function=get_weather>\n<param", "eter=days>\n2\n</parameter>\n</function>\n</tool_", "call>"},
+			observed:  -1,
+			wantText:  "Let me check.",
+			wantCalls: `get_weather{"days":2}`,
+		},
+		{
+			name:     "beginning of a tag that is not one",
+			deltas:   []string{"a <tool", "box> b\n", "c"},
+			observed: -1,
+			wantText: "a <toolbox> b\nc",
+		},
+		{
+			name:      "closing tag omitted",
+			deltas:    []string{"<tool_call>\n<function=get_time>\n</function>\n"},
+			observed:  -1,
+			wantCalls: `get_time{}`,
+		},
+		{
+			name:     "block that cannot be parsed",
+			deltas:   []string{"<tool_call>\n", "{\"name\": \"x\"}\n", "</tool_call>"},
+			observed: -1,
+			wantText: "<tool_call>\n{\"name\": \"x\"}\n</tool_call>",
+		},
+		{
+			name:      "after the backend tool calls",
+			deltas:    []string{"<tool_call><function=get_time></function></tool_call>"},
+			observed:  1,
+			wantCalls: `get_time{}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var recoverer toolCallRecoverer
+			if tt.observed >= 0 {
+				recoverer.observe([]any{map[string]any{"index": float64(tt.observed)}})
+			}
+			var text string
+			var toolCalls []any
+			for _, delta := range tt.deltas {
+				deltaText, deltaToolCalls := recoverer.feed(delta, testToolSchemas)
+				text += deltaText
+				toolCalls = append(toolCalls, deltaToolCalls...)
+			}
+			flushedText, flushedToolCalls := recoverer.flush(testToolSchemas)
+			text += flushedText
+			toolCalls = append(toolCalls, flushedToolCalls...)
+			if text != tt.wantText {
+				t.Errorf("got text %q, want %q", text, tt.wantText)
+			}
+			if got := toolCallSummary(toolCalls); got != tt.wantCalls {
+				t.Errorf("got calls %s, want %s", got, tt.wantCalls)
+			}
+			for i, toolCall := range toolCalls {
+				if index := toolCall.(map[string]any)["index"]; index != tt.observed+1+i {
+					t.Errorf("got index %v for call %d", index, i)
+				}
+			}
+		})
+	}
+}
+
+func TestMayOpenToolCall(t *testing.T) {
+	tests := []struct {
+		chunk string
+		want  bool
+	}{
+		{`{"choices":[{"delta":{"content":"Hello"}}]}`, false},
+		{`{"choices":[{"delta":{"content":"a < b"}}]}`, false},
+		{`{"choices":[{"delta":{"content":"<toolbox>"}}]}`, false},
+		{`{"choices":[{"delta":{"content":"<tool_call>\n<function=f>"}}]}`, true},
+		{`{"choices":[{"delta":{"content":"<tool_call>"}}]}`, true},
+		{`{"choices":[{"delta":{"content":"check.\n<tool"}}]}`, true},
+		{`{"choices":[{"delta":{"content":"check.<t"}}]}`, true},
+		{`{"choices":[{"delta":{"content":"a <"}}]}`, true},
+		{`{"choices":[{"delta":{"content":"Let me check.\n"}}]}`, true},
+	}
+	for _, tt := range tests {
+		if got := mayOpenToolCall([]byte(tt.chunk)); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.chunk, got, tt.want)
+		}
+	}
+}
+
+func TestStreamFixerToolCalls(t *testing.T) {
+	tests := []struct {
+		name             string
+		chunks           []string
+		wantCalls        string
+		wantFinishReason string
+	}{
+		{
+			name: "recovered",
+			chunks: []string{
+				`{"model":"m","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":null}]}`,
+				`{"model":"m","choices":[{"index":0,"delta":{"content":"<tool_call>\n<function=get_time>\n"},"finish_reason":null}]}`,
+				`{"model":"m","choices":[{"index":0,"delta":{"content":"</function>\n"},"finish_reason":null}]}`,
+				`{"model":"m","choices":[{"index":0,"delta":{"content":"</tool_call>"},"finish_reason":null}]}`,
+				`{"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			},
+			wantCalls:        `get_time{}`,
+			wantFinishReason: "tool_calls",
+		},
+		{
+			name: "cut by the length limit",
+			chunks: []string{
+				`{"model":"m","choices":[{"index":0,"delta":{"content":"<tool_call><function=get_weather><parameter=days>"},"finish_reason":null}]}`,
+				`{"model":"m","choices":[{"index":0,"delta":{"content":"1"},"finish_reason":"length"}]}`,
+			},
+			wantCalls:        `get_weather{"days":1}`,
+			wantFinishReason: "length",
+		},
+		{
+			name: "no tool call",
+			chunks: []string{
+				`{"model":"m","choices":[{"index":0,"delta":{"content":"Hello"},"finish_reason":null}]}`,
+				`{"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			},
+			wantFinishReason: "stop",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixer := newStreamFixer("qwen", false, false, reasoningOutput{}, testToolSchemas, nil, slog.New(slog.DiscardHandler))
+			var toolCalls []any
+			var finishReason string
+			for _, chunk := range tt.chunks {
+				fixed, _ := fixer.fixData([]byte(chunk))
+				if fixed == nil {
+					continue
+				}
+				var data struct {
+					Model   string
+					Choices []struct {
+						Delta struct {
+							ToolCalls []any `json:"tool_calls"`
+						}
+						FinishReason *string `json:"finish_reason"`
+					}
+				}
+				if err := json.Unmarshal(fixed, &data); err != nil {
+					t.Fatalf("invalid fixed chunk %s: %v", fixed, err)
+				}
+				if data.Model != "qwen" {
+					t.Errorf("model not fixed: %s", fixed)
+				}
+				for _, choice := range data.Choices {
+					toolCalls = append(toolCalls, choice.Delta.ToolCalls...)
+					if choice.FinishReason != nil {
+						finishReason = *choice.FinishReason
+					}
+				}
+			}
+			if got := toolCallSummary(toolCalls); got != tt.wantCalls {
+				t.Errorf("got calls %s, want %s", got, tt.wantCalls)
+			}
+			if finishReason != tt.wantFinishReason {
+				t.Errorf("got finish reason %q, want %q", finishReason, tt.wantFinishReason)
+			}
+		})
+	}
+}
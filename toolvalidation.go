@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Tool call validation actions, applied when the arguments of a tool call do not validate
+const (
+	toolValidationAnnotate = "annotate" // the tool call gets a validation_error field
+	toolValidationRepair   = "repair"   // light repair, annotated if it fails
+	toolValidationRetry    = "retry"    // request re-issued, the last attempt being annotated if it fails
+)
+
+// Tool call validation outcomes, as exported to the metrics
+const (
+	toolCallValid    = "valid"
+	toolCallRepaired = "repaired"
+	toolCallRetried  = "retried"
+	toolCallInvalid  = "invalid"
+)
+
+// toolValidation is the tool call validation of a profile
+type toolValidation struct {
+	action  string
+	retries int // maximum number of re-issued requests for the retry action
+}
+
+// parseToolValidationRules parses a comma separated list of "profile=action" rules, action being
+// annotate, repair or retry:N
+func parseToolValidationRules(raw string) (validations map[string]toolValidation, err error) {
+	validations = make(map[string]toolValidation)
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		profile, action, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid tool call validation rule %q: expected profile=action", item)
+		}
+		if !slices.Contains(profiles, profile) {
+			return nil, fmt.Errorf("invalid tool call validation rule %q: unknown profile %q", item, profile)
+		}
+		var validation toolValidation
+		action, param, _ := strings.Cut(action, ":")
+		switch action {
+		case toolValidationRetry:
+			if validation.retries, err = strconv.Atoi(param); err != nil || validation.retries < 1 {
+				return nil, fmt.Errorf("invalid tool call validation rule %q: retry requires a positive count", item)
+			}
+		case toolValidationAnnotate, toolValidationRepair:
+		default:
+			return nil, fmt.Errorf("invalid tool call validation rule %q: unknown action %q", item, action)
+		}
+		validation.action = action
+		validations[profile] = validation
+	}
+	return validations, nil
+}
+
+// toolCallOutcomes counts the validated tool calls by outcome
+type toolCallOutcomes map[string]int
+
+// record exports the outcomes to the metrics
+func (tco toolCallOutcomes) record(profile string) {
+	for outcome, count := range tco {
+		toolCallValidationsMetric.Add(float64(count), profile, outcome)
+	}
+}
+
+// validateArguments validates the arguments of a tool call against the schema of its function
+func (ts toolSchemas) validateArguments(name, arguments string) error {
+	schema, known := ts[name]
+	if !known {
+		return fmt.Errorf("unknown function %q", name)
+	}
+	var value any
+	if err := json.Unmarshal([]byte(arguments), &value); err != nil {
+		return fmt.Errorf("arguments are not valid JSON: %w", err)
+	}
+	return validateSchema(value, schema, "arguments")
+}
+
+// repairArguments attempts a light repair of the arguments of a tool call: trailing commas are
+// removed and strings are coerced to the numbers and booleans expected by the schema.
+func (ts toolSchemas) repairArguments(name, arguments string) (repaired string, ok bool) {
+	schema, known := ts[name]
+	if !known {
+		return "", false
+	}
+	var value any
+	if err := json.Unmarshal(removeTrailingCommas([]byte(arguments)), &value); err != nil {
+		return "", false
+	}
+	value = coerceToSchema(value, schema)
+	if validateSchema(value, schema, "arguments") != nil {
+		return "", false
+	}
+	// Do not escape HTML: arguments often hold code
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(encoded.String(), "\n"), true
+}
+
+// checkToolCalls validates a list of tool calls in place. Invalid ones are repaired if repair is
+// set, and annotated with a validation_error field if annotate is set.
+func (ts toolSchemas) checkToolCalls(toolCalls []any, repair, annotate bool, logger *slog.Logger) (outcomes toolCallOutcomes) {
+	outcomes = make(toolCallOutcomes)
+	for _, toolCall := range toolCalls {
+		toolCallMap, _ := toolCall.(map[string]any)
+		function, ok := toolCallMap["function"].(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _ := function["name"].(string)
+		arguments, _ := function["arguments"].(string)
+		err := ts.validateArguments(name, arguments)
+		if err == nil {
+			outcomes[toolCallValid]++
+			continue
+		}
+		if repair {
+			if repaired, ok := ts.repairArguments(name, arguments); ok {
+				logger.Info("tool call arguments repaired",
+					slog.String("function", name),
+					slog.String("error", err.Error()),
+				)
+				function["arguments"] = repaired
+				outcomes[toolCallRepaired]++
+				continue
+			}
+		}
+		outcomes[toolCallInvalid]++
+		if annotate {
+			logger.Warn("tool call arguments do not validate against the tool schema",
+				slog.String("function", name),
+				slog.String("error", err.Error()),
+			)
+			toolCallMap["validation_error"] = err.Error()
+		}
+	}
+	return
+}
+
+// checkResponseToolCalls validates the tool calls of every choice of a non-streaming response,
+// see checkToolCalls. The body is left untouched if there is nothing to change.
+func (ts toolSchemas) checkResponseToolCalls(responseBody []byte, repair, annotate bool,
+	logger *slog.Logger) (checkedBody []byte, outcomes toolCallOutcomes) {
+	outcomes = make(toolCallOutcomes)
+	var data map[string]any
+	if err := json.Unmarshal(responseBody, &data); err != nil {
+		return responseBody, outcomes
+	}
+	choices, _ := data["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		message, _ := choiceMap["message"].(map[string]any)
+		toolCalls, _ := message["tool_calls"].([]any)
+		for outcome, count := range ts.checkToolCalls(toolCalls, repair, annotate, logger) {
+			outcomes[outcome] += count
+		}
+	}
+	if outcomes[toolCallRepaired] == 0 && (outcomes[toolCallInvalid] == 0 || !annotate) {
+		return responseBody, outcomes
+	}
+	checkedBody, err := json.Marshal(data)
+	if err != nil {
+		logger.Error("failed to marshal checked response body", slog.Any("error", err))
+		return responseBody, outcomes
+	}
+	return checkedBody, outcomes
+}
+
+// checkToolCallsWithRetries validates the tool calls of a non-streaming response following the
+// validation of its profile. The retry action re-issues requestBody with complete until the tool
+// calls validate or the retries are exhausted, the last response being annotated.
+func checkToolCallsWithRetries(responseBody, requestBody []byte, tools toolSchemas, validation toolValidation,
+	logger *slog.Logger, complete func(body []byte) ([]byte, error)) ([]byte, toolCallOutcomes) {
+	repair := validation.action == toolValidationRepair
+	checkedBody, outcomes := tools.checkResponseToolCalls(responseBody, repair, true, logger)
+	for attempt := 1; outcomes[toolCallInvalid] > 0 && attempt <= validation.retries; attempt++ {
+		logger.Info("re-issuing the request for invalid tool calls",
+			slog.Int("attempt", attempt),
+			slog.Int("max_attempts", validation.retries),
+		)
+		retriedBody, err := complete(requestBody)
+		if err != nil {
+			logger.Warn("failed to re-issue the request for invalid tool calls", slog.Any("error", err))
+			break
+		}
+		checkedBody, outcomes = tools.checkResponseToolCalls(retriedBody, false, true, logger)
+		if outcomes[toolCallInvalid] == 0 {
+			outcomes[toolCallRetried] = outcomes[toolCallValid]
+			delete(outcomes, toolCallValid)
+		}
+	}
+	return checkedBody, outcomes
+}
+
+// removeTrailingCommas removes the commas directly followed by the end of an object or an array
+func removeTrailingCommas(payload []byte) []byte {
+	repaired := make([]byte, 0, len(payload))
+	inString, escaped := false, false
+	for i, c := range payload {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			repaired = append(repaired, c)
+			continue
+		}
+		if c == '"' {
+			inString = true
+		} else if c == ',' {
+			next := skipJSONSpaces(payload, i+1)
+			if next < len(payload) && (payload[next] == '}' || payload[next] == ']') {
+				continue
+			}
+		}
+		repaired = append(repaired, c)
+	}
+	return repaired
+}
+
+// coerceToSchema converts the strings of a decoded JSON value to the numbers and booleans its
+// schema expects
+func coerceToSchema(value any, schema map[string]any) any {
+	switch typed := value.(type) {
+	case string:
+		types := schemaTypes(schema)
+		if slices.Contains(types, "string") {
+			return value
+		}
+		trimmed := strings.TrimSpace(typed)
+		for _, typ := range types {
+			switch typ {
+			case "integer", "number":
+				if number, err := strconv.ParseFloat(trimmed, 64); err == nil && matchesType(number, typ) {
+					return number
+				}
+			case "boolean":
+				if boolean, err := strconv.ParseBool(strings.ToLower(trimmed)); err == nil {
+					return boolean
+				}
+			}
+		}
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		for key, item := range typed {
+			if property, ok := properties[key].(map[string]any); ok {
+				typed[key] = coerceToSchema(item, property)
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range typed {
+				typed[i] = coerceToSchema(item, items)
+			}
+		}
+	}
+	return value
+}
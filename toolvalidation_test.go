@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestRemoveTrailingCommas(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"a":1,}`, `{"a":1}`},
+		{`{"a":[1,2,],}`, `{"a":[1,2]}`},
+		{"{\"a\":1 ,\n }", "{\"a\":1 \n }"},
+		{`{"a":",}","b":"\",]"}`, `{"a":",}","b":"\",]"}`},
+		{`{"a":1,"b":2}`, `{"a":1,"b":2}`},
+		{`[1,`, `[1,`},
+	}
+	for _, tt := range tests {
+		if got := string(removeTrailingCommas([]byte(tt.payload))); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestRepairArguments(t *testing.T) {
+	schemas := toolSchemas{
+		"get_weather": {
+			"type":     "object",
+			"required": []any{"city"},
+			"properties": map[string]any{
+				"city":   map[string]any{"type": "string"},
+				"days":   map[string]any{"type": "integer"},
+				"temp":   map[string]any{"type": []any{"number", "null"}},
+				"hourly": map[string]any{"type": "boolean"},
+				"hours":  map[string]any{"type": "array", "items": map[string]any{"type": "integer"}},
+			},
+		},
+	}
+	tests := []struct {
+		name      string
+		function  string
+		arguments string
+		want      string // empty if the arguments cannot be repaired
+	}{
+		{"trailing comma", "get_weather", `{"city": "Paris", "days": 3,}`, `{"city":"Paris","days":3}`},
+		{"coerced integer", "get_weather", `{"city":"Paris","days":" 3 "}`, `{"city":"Paris","days":3}`},
+		{"coerced number", "get_weather", `{"city":"Paris","temp":"21.5"}`, `{"city":"Paris","temp":21.5}`},
+		{"coerced boolean", "get_weather", `{"city":"Paris","hourly":"True"}`, `{"city":"Paris","hourly":true}`},
+		{"coerced items", "get_weather", `{"city":"Paris","hours":["6","18",]}`, `{"city":"Paris","hours":[6,18]}`},
+		{"strings are kept", "get_weather", `{"city":"75"}`, `{"city":"75"}`},
+		{"html is not escaped", "get_weather", `{"city":"<Paris>",}`, `{"city":"<Paris>"}`},
+		{"not an integer", "get_weather", `{"city":"Paris","days":"3.5"}`, ""},
+		{"missing required property", "get_weather", `{"days":3}`, ""},
+		{"invalid JSON", "get_weather", `{"city":"Paris"`, ""},
+		{"unknown function", "get_time", `{}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repaired, ok := schemas.repairArguments(tt.function, tt.arguments)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("expected no repair, got %s", repaired)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("arguments not repaired")
+			}
+			if repaired != tt.want {
+				t.Errorf("got %s, want %s", repaired, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckToolCalls(t *testing.T) {
+	schemas := toolSchemas{
+		"get_time": {"type": "object", "properties": map[string]any{"utc": map[string]any{"type": "boolean"}}},
+	}
+	toolCall := func(arguments string) map[string]any {
+		return map[string]any{"function": map[string]any{"name": "get_time", "arguments": arguments}}
+	}
+	valid, repairable, invalid := toolCall(`{"utc":true}`), toolCall(`{"utc":"false"}`), toolCall(`{"utc":1}`)
+	outcomes := schemas.checkToolCalls([]any{valid, repairable, invalid}, true, true, slog.New(slog.DiscardHandler))
+	if outcomes[toolCallValid] != 1 || outcomes[toolCallRepaired] != 1 || outcomes[toolCallInvalid] != 1 {
+		t.Errorf("got outcomes %v", outcomes)
+	}
+	if got := repairable["function"].(map[string]any)["arguments"]; got != `{"utc":false}` {
+		t.Errorf("got repaired arguments %v", got)
+	}
+	if _, found := valid["validation_error"]; found {
+		t.Error("valid tool call annotated")
+	}
+	if got := invalid["validation_error"]; got != "arguments.utc: expected boolean, got number" {
+		t.Errorf("got validation error %v", got)
+	}
+}
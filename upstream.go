@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errUpstreamStalled is the cause of upstream requests aborted by the stall detection
+var errUpstreamStalled = errors.New("backend stream stalled")
+
+// stallWatcher is a backend body aborting the upstream request when no data is received
+// for timeout. Stalls are only detected once data started to flow: prefill and queueing
+// can legitimately take minutes before the first token.
+type stallWatcher struct {
+	io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+	mu      sync.Mutex
+	timer   *time.Timer
+}
+
+func newStallWatcher(body io.ReadCloser, timeout time.Duration, cancel context.CancelCauseFunc) *stallWatcher {
+	return &stallWatcher{
+		ReadCloser: body,
+		timeout:    timeout,
+		cancel:     cancel,
+	}
+}
+
+func (sw *stallWatcher) Read(p []byte) (n int, err error) {
+	n, err = sw.ReadCloser.Read(p)
+	if n > 0 {
+		sw.mu.Lock()
+		if sw.timer == nil {
+			sw.timer = time.AfterFunc(sw.timeout, func() {
+				sw.cancel(errUpstreamStalled)
+			})
+		} else {
+			sw.timer.Reset(sw.timeout)
+		}
+		sw.mu.Unlock()
+	}
+	return
+}
+
+func (sw *stallWatcher) Close() error {
+	sw.mu.Lock()
+	if sw.timer != nil {
+		sw.timer.Stop()
+	}
+	sw.mu.Unlock()
+	return sw.ReadCloser.Close()
+}
+
+// upstreamError is an error object sent by the backend within a stream
+type upstreamError struct {
+	statusCode int
+	body       []byte
+}
+
+func (ue *upstreamError) Error() string {
+	return fmt.Sprintf("backend sent an error in the stream (HTTP %d): %s", ue.statusCode, ue.body)
+}
+
+// newUpstreamError builds an upstreamError from the error object of a chunk
+func newUpstreamError(chunk []byte, errorObject map[string]any) *upstreamError {
+	statusCode := http.StatusInternalServerError
+	if code, ok := errorObject["code"].(float64); ok && code >= 400 && code < 600 {
+		statusCode = int(code)
+	}
+	return &upstreamError{
+		statusCode: statusCode,
+		body:       bytes.Clone(chunk),
+	}
+}
+
+// chatCompletionAggregator assembles the chunks of a streamed chat completion into the
+// chat.completion object the backend would have returned for a non-streaming request.
+type chatCompletionAggregator struct {
+	fields  map[string]any // top level fields of the chunks (id, created, model, etc.)
+	choices map[int]*aggregatedChoice
+	usage   any
+	// firstChunkAt is the reception time of the first chunk
+	firstChunkAt time.Time
+	// deltas is the number of generated deltas, an estimation of the generated tokens
+	deltas int
+}
+
+type aggregatedChoice struct {
+	role           string
+	content        strings.Builder
+	reasoning      strings.Builder
+	reasoningField string // reasoning_content or reasoning, as sent by the backend
+	toolCalls      map[int]*aggregatedToolCall
+	logprobs       []any
+	hasLogprobs    bool
+	finishReason   any
+	stopReason     any
+}
+
+type aggregatedToolCall struct {
+	id        string
+	callType  string
+	name      string
+	arguments strings.Builder
+}
+
+func newChatCompletionAggregator() *chatCompletionAggregator {
+	return &chatCompletionAggregator{
+		fields:  make(map[string]any),
+		choices: make(map[int]*aggregatedChoice),
+	}
+}
+
+// resend sends a non-streaming request again with body, for retries. It returns the response body,
+// aggregated if the request streams from the backend. Backend errors are returned as errors.
+func resend(httpCli *http.Client, outreq *http.Request, body []byte, aggregate bool,
+	stallTimeout time.Duration, cancel context.CancelCauseFunc) ([]byte, error) {
+	req := outreq.Clone(outreq.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	resp, err := httpCli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if aggregate && stallTimeout > 0 {
+		resp.Body = newStallWatcher(resp.Body, stallTimeout, cancel)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("backend returned HTTP %d", resp.StatusCode)
+	}
+	if aggregate {
+		return newChatCompletionAggregator().aggregate(resp.Body)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// aggregate reads a streamed chat completion and returns the corresponding chat.completion body
+func (cca *chatCompletionAggregator) aggregate(body io.Reader) (completion []byte, err error) {
+	if err = cca.readStream(body); err != nil {
+		return nil, err
+	}
+	return json.Marshal(cca.completion())
+}
+
+// generatedTokens returns the number of tokens generated so far: the figure reported by the
+// backend if any, the number of received deltas otherwise.
+func (cca *chatCompletionAggregator) generatedTokens() int {
+	usage, _ := cca.usage.(map[string]any)
+	if completionTokens := usageInt(usage, "completion_tokens"); completionTokens > 0 {
+		return completionTokens
+	}
+	return cca.deltas
+}
+
+// readStream aggregates every chunk of an SSE stream
+func (cca *chatCompletionAggregator) readStream(body io.Reader) error {
+	reader := newSSEReader(body, maxSSEEventSize)
+	for {
+		event, err := reader.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		jsonPart := bytes.TrimSpace(event.Data())
+		if len(jsonPart) == 0 {
+			continue
+		}
+		if bytes.Equal(jsonPart, sseDone) {
+			return nil
+		}
+		if cca.firstChunkAt.IsZero() {
+			cca.firstChunkAt = time.Now()
+		}
+		cca.deltas += countRawDeltas(jsonPart)
+		var chunk map[string]any
+		if err = json.Unmarshal(jsonPart, &chunk); err != nil {
+			return fmt.Errorf("failed to parse streamed chunk: %w", err)
+		}
+		if errorObject, isError := chunk["error"].(map[string]any); isError {
+			return newUpstreamError(jsonPart, errorObject)
+		}
+		cca.addChunk(chunk)
+	}
+}
+
+// addChunk aggregates a parsed chat.completion.chunk
+func (cca *chatCompletionAggregator) addChunk(chunk map[string]any) {
+	for key, value := range chunk {
+		switch key {
+		case "choices", "object":
+		case "usage":
+			if value != nil {
+				cca.usage = value
+			}
+		default:
+			if _, seen := cca.fields[key]; !seen {
+				cca.fields[key] = value
+			}
+		}
+	}
+	choices, _ := chunk["choices"].([]any)
+	for _, choice := range choices {
+		choiceMap, _ := choice.(map[string]any)
+		index, _ := choiceMap["index"].(float64)
+		aggregated, ok := cca.choices[int(index)]
+		if !ok {
+			aggregated = &aggregatedChoice{toolCalls: make(map[int]*aggregatedToolCall)}
+			cca.choices[int(index)] = aggregated
+		}
+		aggregated.add(choiceMap)
+	}
+}
+
+func (ac *aggregatedChoice) add(choice map[string]any) {
+	if delta, ok := choice["delta"].(map[string]any); ok {
+		if role, _ := delta["role"].(string); role != "" {
+			ac.role = role
+		}
+		if content, _ := delta["content"].(string); content != "" {
+			ac.content.WriteString(content)
+		}
+		for _, field := range []string{"reasoning_content", "reasoning"} {
+			if reasoning, _ := delta[field].(string); reasoning != "" {
+				ac.reasoning.WriteString(reasoning)
+				if ac.reasoningField == "" {
+					ac.reasoningField = field
+				}
+				break
+			}
+		}
+		toolCalls, _ := delta["tool_calls"].([]any)
+		for _, toolCall := range toolCalls {
+			ac.addToolCall(toolCall)
+		}
+	}
+	if logprobs, ok := choice["logprobs"].(map[string]any); ok {
+		ac.hasLogprobs = true
+		content, _ := logprobs["content"].([]any)
+		ac.logprobs = append(ac.logprobs, content...)
+	}
+	if finishReason := choice["finish_reason"]; finishReason != nil {
+		ac.finishReason = finishReason
+	}
+	if stopReason := choice["stop_reason"]; stopReason != nil {
+		ac.stopReason = stopReason
+	}
+}
+
+// addToolCall aggregates a tool call delta: the first delta of a call carries its id, type and
+// name, the following ones carry pieces of its arguments.
+func (ac *aggregatedChoice) addToolCall(toolCall any) {
+	toolCallMap, _ := toolCall.(map[string]any)
+	index, _ := toolCallMap["index"].(float64)
+	aggregated, ok := ac.toolCalls[int(index)]
+	if !ok {
+		aggregated = &aggregatedToolCall{callType: "function"}
+		ac.toolCalls[int(index)] = aggregated
+	}
+	if id, _ := toolCallMap["id"].(string); id != "" {
+		aggregated.id = id
+	}
+	if callType, _ := toolCallMap["type"].(string); callType != "" {
+		aggregated.callType = callType
+	}
+	function, _ := toolCallMap["function"].(map[string]any)
+	if name, _ := function["name"].(string); name != "" {
+		aggregated.name = name
+	}
+	if arguments, _ := function["arguments"].(string); arguments != "" {
+		aggregated.arguments.WriteString(arguments)
+	}
+}
+
+// completion returns the aggregated chat.completion object
+func (cca *chatCompletionAggregator) completion() map[string]any {
+	completion := make(map[string]any, len(cca.fields)+3)
+	for key, value := range cca.fields {
+		completion[key] = value
+	}
+	completion["object"] = "chat.completion"
+	indexes := make([]int, 0, len(cca.choices))
+	for index := range cca.choices {
+		indexes = append(indexes, index)
+	}
+	slices.Sort(indexes)
+	choices := make([]any, 0, len(indexes))
+	for _, index := range indexes {
+		choices = append(choices, cca.choices[index].message(index))
+	}
+	completion["choices"] = choices
+	completion["usage"] = cca.usage
+	return completion
+}
+
+// toolCallList returns the aggregated tool calls sorted by index, with their index if withIndex is set
+func (ac *aggregatedChoice) toolCallList(withIndex bool) []any {
+	toolCallIndexes := make([]int, 0, len(ac.toolCalls))
+	for toolCallIndex := range ac.toolCalls {
+		toolCallIndexes = append(toolCallIndexes, toolCallIndex)
+	}
+	slices.Sort(toolCallIndexes)
+	toolCalls := make([]any, 0, len(toolCallIndexes))
+	for _, toolCallIndex := range toolCallIndexes {
+		toolCall := ac.toolCalls[toolCallIndex]
+		toolCallMap := map[string]any{
+			"id":   toolCall.id,
+			"type": toolCall.callType,
+			"function": map[string]any{
+				"name":      toolCall.name,
+				"arguments": toolCall.arguments.String(),
+			},
+		}
+		if withIndex {
+			toolCallMap["index"] = toolCallIndex
+		}
+		toolCalls = append(toolCalls, toolCallMap)
+	}
+	return toolCalls
+}
+
+// message returns the aggregated choice in its non-streaming form
+func (ac *aggregatedChoice) message(index int) map[string]any {
+	role := ac.role
+	if role == "" {
+		role = "assistant"
+	}
+	message := map[string]any{
+		"role":    role,
+		"content": nil,
+	}
+	if ac.content.Len() > 0 {
+		message["content"] = ac.content.String()
+	}
+	reasoningField := ac.reasoningField
+	if reasoningField == "" {
+		reasoningField = "reasoning_content"
+	}
+	message[reasoningField] = nil
+	if ac.reasoning.Len() > 0 {
+		message[reasoningField] = ac.reasoning.String()
+	}
+	message["tool_calls"] = ac.toolCallList(false)
+	choice := map[string]any{
+		"index":         index,
+		"message":       message,
+		"logprobs":      nil,
+		"finish_reason": ac.finishReason,
+	}
+	if ac.hasLogprobs {
+		choice["logprobs"] = map[string]any{"content": ac.logprobs}
+	}
+	if ac.stopReason != nil {
+		choice["stop_reason"] = ac.stopReason
+	}
+	return choice
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseStream returns an SSE stream made of the given data payloads
+func sseStream(payloads ...string) string {
+	var stream strings.Builder
+	for _, payload := range payloads {
+		stream.WriteString("data: " + payload + "\n\n")
+	}
+	return stream.String()
+}
+
+// normalizeJSON returns the canonical encoding of a JSON document, keys being sorted
+func normalizeJSON(t *testing.T, payload []byte) string {
+	t.Helper()
+	var value any
+	if err := json.Unmarshal(payload, &value); err != nil {
+		t.Fatalf("invalid JSON %s: %v", payload, err)
+	}
+	normalized, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(normalized)
+}
+
+func TestChatCompletionAggregator(t *testing.T) {
+	tests := []struct {
+		name       string
+		stream     string
+		want       string
+		wantTokens int
+	}{
+		{
+			name: "content",
+			stream: sseStream(
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"Hello"},"finish_reason":null}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":" world"},"finish_reason":null}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop","stop_reason":null}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"m","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+				`[DONE]`,
+			),
+			want: `{"id":"c1","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,"logprobs":null,"finish_reason":"stop",` +
+				`"message":{"role":"assistant","content":"Hello world","reasoning_content":null,"tool_calls":[]}}],` +
+				`"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+			wantTokens: 2,
+		},
+		{
+			name: "reasoning field as sent by the backend",
+			stream: sseStream(
+				`{"id":"c1","choices":[{"index":0,"delta":{"reasoning":"Let me"}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{"reasoning":" think."}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{"content":"42"},"finish_reason":"stop"}]}`,
+			),
+			want: `{"id":"c1","object":"chat.completion","usage":null,"choices":[{"index":0,"logprobs":null,"finish_reason":"stop",` +
+				`"message":{"role":"assistant","content":"42","reasoning":"Let me think.","tool_calls":[]}}]}`,
+			wantTokens: 3,
+		},
+		{
+			name: "several choices out of order",
+			stream: sseStream(
+				`{"id":"c1","choices":[{"index":1,"delta":{"content":"b"}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{"content":"a"}}]}`,
+				`{"id":"c1","choices":[{"index":1,"delta":{},"finish_reason":"length"},{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			),
+			want: `{"id":"c1","object":"chat.completion","usage":null,"choices":[` +
+				`{"index":0,"logprobs":null,"finish_reason":"stop","message":{"role":"assistant","content":"a","reasoning_content":null,"tool_calls":[]}},` +
+				`{"index":1,"logprobs":null,"finish_reason":"length","message":{"role":"assistant","content":"b","reasoning_content":null,"tool_calls":[]}}]}`,
+			wantTokens: 2,
+		},
+		{
+			name: "tool calls",
+			stream: sseStream(
+				`{"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_2","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":" \"Paris\"}"}}]}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			),
+			want: `{"id":"c1","object":"chat.completion","usage":null,"choices":[{"index":0,"logprobs":null,"finish_reason":"tool_calls",` +
+				`"message":{"role":"assistant","content":null,"reasoning_content":null,"tool_calls":[` +
+				`{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\": \"Paris\"}"}},` +
+				`{"id":"call_2","type":"function","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+			wantTokens: 3, // argument deltas
+		},
+		{
+			name: "logprobs and stop reason",
+			stream: sseStream(
+				`{"id":"c1","choices":[{"index":0,"delta":{"content":"a"},"logprobs":{"content":[{"token":"a","logprob":-0.1}]}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{"content":"b"},"logprobs":{"content":[{"token":"b","logprob":-0.2}]}}]}`,
+				`{"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"stop","stop_reason":"</end>"}]}`,
+			),
+			want: `{"id":"c1","object":"chat.completion","usage":null,"choices":[{"index":0,"finish_reason":"stop","stop_reason":"</end>",` +
+				`"logprobs":{"content":[{"token":"a","logprob":-0.1},{"token":"b","logprob":-0.2}]},` +
+				`"message":{"role":"assistant","content":"ab","reasoning_content":null,"tool_calls":[]}}]}`,
+			wantTokens: 2,
+		},
+		{
+			name: "comments, empty events and chunks after DONE are ignored",
+			stream: ": keepalive\n\ndata:\n\n" + sseStream(
+				`{"id":"c1","choices":[{"index":0,"delta":{"content":"a"},"finish_reason":"stop"}]}`,
+				`[DONE]`,
+				`{"id":"c2","choices":[{"index":0,"delta":{"content":"b"}}]}`,
+			),
+			want: `{"id":"c1","object":"chat.completion","usage":null,"choices":[{"index":0,"logprobs":null,"finish_reason":"stop",` +
+				`"message":{"role":"assistant","content":"a","reasoning_content":null,"tool_calls":[]}}]}`,
+			wantTokens: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregator := newChatCompletionAggregator()
+			completion, err := aggregator.aggregate(strings.NewReader(tt.stream))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, want := normalizeJSON(t, completion), normalizeJSON(t, []byte(tt.want)); got != want {
+				t.Errorf("got  %s\nwant %s", got, want)
+			}
+			if got := aggregator.generatedTokens(); got != tt.wantTokens {
+				t.Errorf("got %d generated tokens, want %d", got, tt.wantTokens)
+			}
+			if aggregator.firstChunkAt.IsZero() {
+				t.Error("first chunk time not recorded")
+			}
+		})
+	}
+}
+
+func TestChatCompletionAggregatorErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		stream         string
+		wantStatusCode int // of the upstream error, 0 for other errors
+		wantErr        string
+	}{
+		{
+			name: "error chunk",
+			stream: sseStream(
+				`{"id":"c1","choices":[{"index":0,"delta":{"content":"a"}}]}`,
+				`{"error":{"message":"overloaded","type":"ServiceUnavailableError","code":503}}`,
+			),
+			wantStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:           "error chunk without valid code",
+			stream:         sseStream(`{"error":{"message":"boom","code":"internal"}}`),
+			wantStatusCode: http.StatusInternalServerError,
+		},
+		{
+			name:    "invalid chunk",
+			stream:  sseStream(`{"id":`),
+			wantErr: "failed to parse streamed chunk",
+		},
+		{
+			name:    "stream cut within a line",
+			stream:  sseStream(`{"id":"c1","choices":[]}`) + `data: {"id":"c1","cho`,
+			wantErr: errSSETruncated.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newChatCompletionAggregator().aggregate(strings.NewReader(tt.stream))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			var upstreamErr *upstreamError
+			if tt.wantStatusCode != 0 {
+				if !errors.As(err, &upstreamErr) {
+					t.Fatalf("expected an upstream error, got %v", err)
+				}
+				if upstreamErr.statusCode != tt.wantStatusCode {
+					t.Errorf("got status %d, want %d", upstreamErr.statusCode, tt.wantStatusCode)
+				}
+				if !bytes.Contains(upstreamErr.body, []byte(`"error"`)) {
+					t.Errorf("error body not kept: %s", upstreamErr.body)
+				}
+				return
+			}
+			if errors.As(err, &upstreamErr) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStallWatcher(t *testing.T) {
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	watcher := newStallWatcher(pr, 20*time.Millisecond, cancel)
+	defer watcher.Close()
+	// No stall detected before the first byte
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pw.Write([]byte("data: a\n\n"))
+	}()
+	if _, err := watcher.Read(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("stall detected before the first byte")
+	}
+	select {
+	case <-ctx.Done():
+		if !errors.Is(context.Cause(ctx), errUpstreamStalled) {
+			t.Errorf("got cause %v", context.Cause(ctx))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stall not detected")
+	}
+}